@@ -0,0 +1,259 @@
+package eventsum
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Identifies a period of an event instance
+type periodKey struct {
+	instanceId int
+	start      int64 // unix seconds
+}
+
+// Counts of a period not saved yet
+type pendingPeriod struct {
+	period EventInstancePeriod
+	weight float64 // estimated count of the sampled events
+}
+
+func (p *pendingPeriod) merge(period EventInstancePeriod, weight float64) {
+	p.period.Count += period.Count
+	if period.Updated.After(p.period.Updated) {
+		p.period.Updated = period.Updated
+	}
+	p.period.Extrapolated = p.period.Extrapolated || period.Extrapolated
+	p.weight += weight
+}
+
+type periodShard struct {
+	sync.Mutex
+	periods map[periodKey]*pendingPeriod
+}
+
+// aggregator keeps the counts of the periods of event instances in memory
+// across batches, so that a hot event seen in many batches updates its period
+// once per flush interval. Periods are spread over shards to limit contention
+// between the save workers.
+type aggregator struct {
+	shards   []*periodShard
+	size     int64 // periods held, updated atomically
+	max      int64
+	interval time.Duration
+	full     chan struct{} // signals the aggregator holds max periods
+	quit     chan struct{}
+	done     chan struct{}
+
+	flushLock sync.Mutex // one flush at a time, so that acks follow their periods
+	ackLock   sync.Mutex
+	acks      map[uint64]int // events saved by wal segment, acknowledged once flushed
+	commits   []func()       // run once flushed, e.g. to commit kafka offsets
+}
+
+// Returns nil if aggregation is disabled
+func newAggregator(config conf.AggregationConfig) *aggregator {
+	if config.FlushInterval <= 0 {
+		return nil
+	}
+	a := &aggregator{
+		shards:   make([]*periodShard, config.Shards),
+		max:      int64(config.MaxPeriods),
+		interval: time.Duration(config.FlushInterval) * time.Second,
+		full:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		acks:     make(map[uint64]int),
+	}
+	for i := range a.shards {
+		a.shards[i] = &periodShard{periods: make(map[periodKey]*pendingPeriod)}
+	}
+	return a
+}
+
+func (a *aggregator) shard(key periodKey) *periodShard {
+	h := uint64(key.instanceId)*31 + uint64(key.start)
+	return a.shards[h%uint64(len(a.shards))]
+}
+
+// Adds the counts of a period. Returns false if the period is not held yet
+// and the aggregator is full, in which case the period should be saved
+// directly.
+func (a *aggregator) add(period EventInstancePeriod, weight float64) bool {
+	key := periodKey{period.EventInstanceId, period.StartTime.Unix()}
+	s := a.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if p, ok := s.periods[key]; ok {
+		p.merge(period, weight)
+		return true
+	}
+	if atomic.LoadInt64(&a.size) >= a.max {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+		return false
+	}
+	s.periods[key] = &pendingPeriod{period: period, weight: weight}
+	metrics.AggregatedPeriods(int(atomic.AddInt64(&a.size, 1)))
+	return true
+}
+
+// Records the events of a batch whose periods were added, to acknowledge
+// their wal segments once the periods are flushed
+func (a *aggregator) deferAcks(evts []UnaddedEvent) {
+	a.ackLock.Lock()
+	defer a.ackLock.Unlock()
+	for _, evt := range evts {
+		if evt.WALSegment != 0 {
+			a.acks[evt.WALSegment]++
+		}
+	}
+}
+
+// Records a function to run once the periods added so far are flushed
+func (a *aggregator) deferCommit(commit func()) {
+	a.ackLock.Lock()
+	defer a.ackLock.Unlock()
+	a.commits = append(a.commits, commit)
+}
+
+// Takes the periods held, and the acknowledgements and commits of the batches
+// they count. The acknowledgements and commits are taken first, so that they
+// only cover periods taken.
+func (a *aggregator) take() ([]*pendingPeriod, map[uint64]int, []func()) {
+	a.ackLock.Lock()
+	acks, commits := a.acks, a.commits
+	a.acks, a.commits = make(map[uint64]int), nil
+	a.ackLock.Unlock()
+
+	var periods []*pendingPeriod
+	for _, s := range a.shards {
+		s.Lock()
+		for _, p := range s.periods {
+			periods = append(periods, p)
+		}
+		n := len(s.periods)
+		s.periods = make(map[periodKey]*pendingPeriod)
+		s.Unlock()
+		atomic.AddInt64(&a.size, -int64(n))
+	}
+	metrics.AggregatedPeriods(int(atomic.LoadInt64(&a.size)))
+	return periods, acks, commits
+}
+
+// Puts back periods, acknowledgements and commits taken but not saved, to be
+// saved by the next flush. Periods are put back even if the aggregator is full.
+func (a *aggregator) restore(periods []*pendingPeriod, acks map[uint64]int, commits []func()) {
+	for _, p := range periods {
+		key := periodKey{p.period.EventInstanceId, p.period.StartTime.Unix()}
+		s := a.shard(key)
+		s.Lock()
+		if q, ok := s.periods[key]; ok {
+			q.merge(p.period, p.weight)
+		} else {
+			s.periods[key] = p
+			atomic.AddInt64(&a.size, 1)
+		}
+		s.Unlock()
+	}
+	metrics.AggregatedPeriods(int(atomic.LoadInt64(&a.size)))
+
+	a.ackLock.Lock()
+	for segment, n := range acks {
+		a.acks[segment] += n
+	}
+	a.commits = append(commits, a.commits...)
+	a.ackLock.Unlock()
+}
+
+// Flushes every interval, or as soon as the aggregator is full, until stopped
+func (a *aggregator) run(flush func() error) {
+	defer close(a.done)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.full:
+		case <-a.quit:
+			return
+		}
+		flush()
+	}
+}
+
+// Stops the periodic flushes, waiting for a flush in progress
+func (a *aggregator) stop() {
+	close(a.quit)
+	<-a.done
+}
+
+// Saves the periods aggregated with a single bulk upsert, acknowledges the wal
+// segments of the batches they count and runs their commits. The periods are kept for the next
+// flush if the upsert fails.
+func (es *eventStore) flushPeriods() error {
+	if es.aggregator == nil {
+		return nil
+	}
+	es.aggregator.flushLock.Lock()
+	defer es.aggregator.flushLock.Unlock()
+
+	start := time.Now()
+	pending, acks, commits := es.aggregator.take()
+	periods := make([]EventInstancePeriod, 0, len(pending))
+	for _, p := range pending {
+		period := p.period
+		if period.Extrapolated {
+			// sampled events stand for 1/rate events each
+			period.Count = int(math.Round(p.weight))
+		}
+		periods = append(periods, period)
+	}
+	if err := es.ds.UpsertEventInstancePeriods(periods); err != nil {
+		es.log.App().Errorf("Error flushing %d event instance periods, kept for the next flush: %v", len(periods), err)
+		es.aggregator.restore(pending, acks, commits)
+		return err
+	}
+	metrics.EventStoreLatency("FlushPeriods", start)
+	metrics.PeriodsFlushed(len(periods))
+	for segment, n := range acks {
+		es.wal.Ack(segment, n)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	return nil
+}
+
+// Runs commit once the periods of the batches saved so far are flushed, e.g.
+// to commit the kafka offsets of the batches, or right away if aggregation is
+// disabled.
+func (es *eventStore) afterFlush(commit func()) {
+	if es.aggregator == nil {
+		commit()
+		return
+	}
+	es.aggregator.deferCommit(commit)
+}
+
+// Saves a batch of events and flushes the periods aggregated, for callers that
+// must know the events are saved once it returns. If only the flush fails, the
+// error reports no event as failed, so that callers retry the flush alone
+// rather than counting the events again.
+func (es *eventStore) saveFlushed(evts []UnaddedEvent) error {
+	if err := es.SaveToDB(evts); err != nil {
+		return err
+	}
+	if err := es.flushPeriods(); err != nil {
+		return &saveError{err: err}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package eventsum
+
+import (
+	"errors"
+	"testing"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/rules"
+)
+
+// upsertDataStore records the bulk upserts of periods, and fails them while
+// err is set
+type upsertDataStore struct {
+	periodDataStore
+	upserts *[][]EventInstancePeriod
+	err     *error
+}
+
+func (u upsertDataStore) UpsertEventInstancePeriods(evts []EventInstancePeriod) error {
+	if *u.err != nil {
+		return *u.err
+	}
+	*u.upserts = append(*u.upserts, evts)
+	return nil
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	globalRule = rules.NewRule()
+	var upserts [][]EventInstancePeriod
+	var upsertErr error
+	ds := upsertDataStore{periodDataStore{periods: map[int]EventInstancePeriod{}}, &upserts, &upsertErr}
+	es := newTestEventStore(5)
+	es.ds = ds
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	es.aggregator = newAggregator(conf.AggregationConfig{FlushInterval: 10, MaxPeriods: 2, Shards: 4})
+
+	event := func(message string) UnaddedEvent {
+		return UnaddedEvent{
+			Service:     "wish_be",
+			Environment: "prod",
+			Name:        "KeyError",
+			Type:        "python",
+			Data:        EventData{Message: message, Raw: message},
+			Timestamp:   "2020-01-26 00:53:20",
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := es.SaveToDB([]UnaddedEvent{event("a"), event("bb"), event("bb")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ds.periods) != 0 {
+		t.Errorf("expected the periods to be kept in memory, got %+v", ds.periods)
+	}
+
+	// the aggregator is full, so the period of a new instance is saved directly
+	if err := es.SaveToDB([]UnaddedEvent{event("ccc")}); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := ds.periods[3]; !ok || p.Count != 1 || len(ds.periods) != 1 {
+		t.Errorf("expected only the new period to be saved directly, got %+v", ds.periods)
+	}
+
+	// a failed flush keeps the periods for the next one
+	upsertErr = errors.New("db is down")
+	if err := es.flushPeriods(); err == nil {
+		t.Fatalf("expected the flush to fail")
+	}
+	upsertErr = nil
+	if err := es.SaveToDB([]UnaddedEvent{event("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := es.flushPeriods(); err != nil {
+		t.Fatal(err)
+	}
+	if len(upserts) != 1 || len(upserts[0]) != 2 {
+		t.Fatalf("expected a single upsert of 2 periods, got %+v", upserts)
+	}
+	counts := map[int]int{}
+	for _, p := range upserts[0] {
+		counts[p.EventInstanceId] = p.Count
+	}
+	if counts[1] != 4 || counts[2] != 6 {
+		t.Errorf("expected the counts of every batch to be added up, got %v", counts)
+	}
+
+	if err := es.flushPeriods(); err != nil || len(upserts) != 2 || len(upserts[1]) != 0 {
+		t.Errorf("expected nothing left to flush, got %+v, %v", upserts, err)
+	}
+}
+
+func TestSaveFlushedRetriesFlushOnly(t *testing.T) {
+	globalRule = rules.NewRule()
+	var upserts [][]EventInstancePeriod
+	upsertErr := errors.New("db is down")
+	es := newTestEventStore(5)
+	es.ds = upsertDataStore{periodDataStore{periods: map[int]EventInstancePeriod{}}, &upserts, &upsertErr}
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	es.aggregator = newAggregator(conf.AggregationConfig{FlushInterval: 10, MaxPeriods: 10, Shards: 4})
+
+	evts := []UnaddedEvent{{Service: "wish_be", Environment: "prod", Name: "KeyError", Type: "python",
+		Data: EventData{Message: "a", Raw: "a"}, Timestamp: "2020-01-26 00:53:20"}}
+	err := es.saveFlushed(evts)
+	if err == nil {
+		t.Fatalf("expected the flush to fail")
+	}
+	if _, failed := splitSaved(evts, err); len(failed) != 0 {
+		t.Fatalf("expected no event to be reported as failed, got %+v", failed)
+	}
+
+	// retrying with the events left only retries the flush
+	upsertErr = nil
+	if err := es.saveFlushed(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(upserts) != 1 || len(upserts[0]) != 1 || upserts[0][0].Count != 1 {
+		t.Errorf("expected the event to be counted once, got %+v", upserts)
+	}
+}
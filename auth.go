@@ -0,0 +1,335 @@
+package eventsum
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/datastore"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Capabilities of API keys. Admin keys have every capability.
+const (
+	capabilityIngest = "ingest"
+	capabilityRead   = "read"
+	capabilityAdmin  = "admin"
+)
+
+// Prefix of the keys issued, so that they are easy to spot, e.g. in logs
+const apiKeyPrefix = "esk_"
+
+// Header and query parameter carrying a key. Keys are also accepted as bearer
+// tokens, and as the sentry_key of the Sentry SDKs, which take them from DSNs.
+const (
+	apiKeyHeader = "X-Eventsum-Key"
+	apiKeyParam  = "eventsum_key"
+)
+
+var (
+	errMissingAPIKey = errors.New("missing API key")
+	errInvalidAPIKey = errors.New("invalid API key")
+	errRevokedAPIKey = errors.New("revoked API key")
+)
+
+type apiKeyContextKey struct{}
+
+type cachedAPIKey struct {
+	key     APIKey
+	err     error // errInvalidAPIKey for keys not found, cached too
+	expires time.Time
+}
+
+// authenticator checks the API keys of requests against the keys stored in the
+// DB, which are cached for a while
+type authenticator struct {
+	sync.Mutex
+	ds           datastore.DataStore
+	ttl          time.Duration
+	forceService bool
+	bootstrap    string // hex SHA-256 of the bootstrap key
+	cache        map[string]cachedAPIKey
+}
+
+// Returns nil when authentication is disabled
+func newAuthenticator(config conf.AuthConfig, ds datastore.DataStore) *authenticator {
+	if !config.Enabled {
+		return nil
+	}
+	return &authenticator{
+		ds:           ds,
+		ttl:          time.Duration(config.CacheTTL) * time.Second,
+		forceService: config.ForceService,
+		bootstrap:    strings.ToLower(config.BootstrapKeySHA256),
+		cache:        make(map[string]cachedAPIKey),
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the key of a request, from any of the places keys are accepted in
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	// e.g. `Sentry sentry_version=7, sentry_key=<key>, sentry_client=...`
+	if auth := r.Header.Get("X-Sentry-Auth"); auth != "" {
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "Sentry "), ",") {
+			if kv := strings.SplitN(strings.TrimSpace(field), "=", 2); len(kv) == 2 && kv[0] == "sentry_key" {
+				return kv[1]
+			}
+		}
+	}
+	query := r.URL.Query()
+	if key := query.Get(apiKeyParam); key != "" {
+		return key
+	}
+	return query.Get("sentry_key")
+}
+
+// Finds a key, e.g. the key of a request or of a gRPC call
+func (a *authenticator) authenticate(raw string) (APIKey, error) {
+	if raw == "" {
+		return APIKey{}, errMissingAPIKey
+	}
+	hash := hashAPIKey(raw)
+	if a.bootstrap != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.bootstrap)) == 1 {
+		return APIKey{Prefix: "bootstrap", Capabilities: []string{capabilityAdmin}}, nil
+	}
+
+	now := time.Now()
+	a.Lock()
+	cached, ok := a.cache[hash]
+	a.Unlock()
+	if !ok || now.After(cached.expires) {
+		key, err := a.ds.FindAPIKey(hash)
+		if err == datastore.ErrAPIKeyNotFound {
+			err = errInvalidAPIKey
+		} else if err != nil {
+			// not cached, the DB may be back for the next request
+			return key, err
+		}
+		cached = cachedAPIKey{key, err, now.Add(a.ttl)}
+		a.Lock()
+		a.expire(now)
+		a.cache[hash] = cached
+		a.Unlock()
+	}
+	if cached.err != nil {
+		return cached.key, cached.err
+	}
+	if cached.key.RevokedAt != nil {
+		return cached.key, errRevokedAPIKey
+	}
+	return cached.key, nil
+}
+
+// Drops the expired keys of the cache, so that it does not grow with every
+// invalid key tried
+func (a *authenticator) expire(now time.Time) {
+	for hash, cached := range a.cache {
+		if now.After(cached.expires) {
+			delete(a.cache, hash)
+		}
+	}
+}
+
+func hasCapability(key APIKey, capability string) bool {
+	for _, c := range key.Capabilities {
+		if c == capability || c == capabilityAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Wraps a handler so that it requires a key with the given capability. The key
+// is added to the context of the request. Keys scoped to a service are only
+// accepted by the ingest routes, which check the service of every event.
+func (h *httpHandler) authorize(capability string, next httprouter.Handle) httprouter.Handle {
+	return h.authorizeKey(capability, capability == capabilityIngest, next)
+}
+
+// Like authorize, but also accepts keys scoped to a service for routes whose
+// handler checks the service it reads with authorizeService
+func (h *httpHandler) authorizeScoped(capability string, next httprouter.Handle) httprouter.Handle {
+	return h.authorizeKey(capability, true, next)
+}
+
+func (h *httpHandler) authorizeKey(capability string, scoped bool, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if h.auth == nil {
+			next(w, r, ps)
+			return
+		}
+		key, err := h.auth.authenticate(requestAPIKey(r))
+		switch err {
+		case nil:
+		case errMissingAPIKey, errInvalidAPIKey, errRevokedAPIKey:
+			metrics.AuthRejected(err.Error())
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			h.sendError(w, http.StatusUnauthorized, err, "Unauthorized")
+			return
+		default:
+			h.sendError(w, http.StatusInternalServerError, err, "Error checking API key")
+			return
+		}
+		if !hasCapability(key, capability) {
+			metrics.AuthRejected("missing capability")
+			h.sendError(w, http.StatusForbidden, errors.Errorf("API key cannot %s", capability), "Forbidden")
+			return
+		}
+		if key.Service != "" && !scoped {
+			metrics.AuthRejected("wrong service")
+			h.sendError(w, http.StatusForbidden, errors.Errorf("API key scoped to service '%s' cannot %s every service", key.Service, capability), "Forbidden")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)), ps)
+	}
+}
+
+// Returns the service the key of a request is scoped to, if any
+func keyService(r *http.Request) string {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	return key.Service
+}
+
+// Checks that the key of a request may read the events of a service
+func (h *httpHandler) authorizeService(r *http.Request, service string) error {
+	if scope := keyService(r); scope != "" && scope != service {
+		metrics.AuthRejected("wrong service")
+		return errors.Errorf("API key cannot read events of service '%s'", service)
+	}
+	return nil
+}
+
+// Like authorizeService, for a service given by its id
+func (h *httpHandler) authorizeServiceId(r *http.Request, serviceId int) error {
+	scope := keyService(r)
+	if scope == "" || h.es.ds.GetServicesMap()[scope].Id == serviceId {
+		return nil
+	}
+	metrics.AuthRejected("wrong service")
+	return errors.Errorf("API key cannot read events of service %d", serviceId)
+}
+
+// Checks that the key of a request, or of a gRPC call, may capture an event.
+// The event of a key scoped to another service is rejected, or captured under
+// the service of the key if force_service is set.
+func (h *httpHandler) authorizeEvent(ctx context.Context, evt *UnaddedEvent) error {
+	key, ok := ctx.Value(apiKeyContextKey{}).(APIKey)
+	if !ok || key.Service == "" || key.Service == evt.Service {
+		return nil
+	}
+	if h.auth.forceService {
+		evt.Service = key.Service
+		return nil
+	}
+	metrics.AuthRejected("wrong service")
+	return errors.Errorf("API key cannot capture events of service '%s'", evt.Service)
+}
+
+// Body of the requests issuing a key
+type apiKeyRequest struct {
+	Service      string   `json:"service"`
+	Capabilities []string `json:"capabilities"`
+	Description  string   `json:"description"`
+}
+
+// Issues a key. The key itself is only returned by this response.
+func (h *httpHandler) issueAPIKeyHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Error decoding JSON key")
+		return
+	}
+	if len(req.Capabilities) == 0 {
+		h.sendError(w, http.StatusBadRequest, errors.New("capabilities cannot be empty"), "Invalid key")
+		return
+	}
+	for _, c := range req.Capabilities {
+		if c != capabilityIngest && c != capabilityRead && c != capabilityAdmin {
+			h.sendError(w, http.StatusBadRequest, errors.Errorf("unknown capability '%s'", c), "Invalid key")
+			return
+		}
+	}
+	if _, ok := h.es.ds.GetServicesMap()[req.Service]; req.Service != "" && !ok {
+		h.sendError(w, http.StatusBadRequest, errors.Errorf("unknown service '%s'", req.Service), "Invalid key")
+		return
+	}
+	// admin routes act on every service
+	if req.Service != "" && hasCapability(APIKey{Capabilities: req.Capabilities}, capabilityAdmin) {
+		h.sendError(w, http.StatusBadRequest, errors.New("a key scoped to a service cannot be an admin key"), "Invalid key")
+		return
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		h.sendError(w, http.StatusInternalServerError, err, "Error generating key")
+		return
+	}
+	raw := apiKeyPrefix + hex.EncodeToString(b)
+	key, err := h.es.ds.AddAPIKey(APIKey{
+		Prefix:       raw[:len(apiKeyPrefix)+8],
+		Service:      req.Service,
+		Capabilities: req.Capabilities,
+		Description:  req.Description,
+	}, hashAPIKey(raw))
+	if err != nil {
+		h.sendError(w, http.StatusInternalServerError, err, "Error issuing key")
+		return
+	}
+	key.Key = raw
+	h.sendResp(w, "key", key)
+}
+
+// Lists the keys, revoked ones included, without the keys themselves
+func (h *httpHandler) listAPIKeysHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	keys, err := h.es.ds.ListAPIKeys()
+	if err != nil {
+		h.sendError(w, http.StatusInternalServerError, err, "Error listing keys")
+		return
+	}
+	h.sendResp(w, "keys", keys)
+}
+
+// Revokes a key. Servers that cached the key accept it until the cache TTL.
+func (h *httpHandler) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, ok := h.registryId(w, ps)
+	if !ok {
+		return
+	}
+	key, err := h.es.ds.RevokeAPIKey(id)
+	if err == datastore.ErrAPIKeyNotFound {
+		h.sendError(w, http.StatusNotFound, err, "Error")
+		return
+	} else if err != nil {
+		h.sendError(w, http.StatusInternalServerError, err, "Error revoking key")
+		return
+	}
+	if h.auth != nil {
+		h.auth.Lock()
+		h.auth.cache = make(map[string]cachedAPIKey)
+		h.auth.Unlock()
+	}
+	h.sendResp(w, "key", key)
+}
@@ -0,0 +1,222 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/datastore"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// apiKeyDataStore keeps its keys in memory, by hash
+type apiKeyDataStore struct {
+	stubDataStore
+	keys   map[string]APIKey
+	finds  int
+	hashes []string
+}
+
+func (d *apiKeyDataStore) AddAPIKey(key APIKey, hash string) (APIKey, error) {
+	key.Id = len(d.hashes) + 1
+	key.CreatedAt = time.Now()
+	d.keys[hash] = key
+	d.hashes = append(d.hashes, hash)
+	return key, nil
+}
+
+func (d *apiKeyDataStore) FindAPIKey(hash string) (APIKey, error) {
+	d.finds++
+	key, ok := d.keys[hash]
+	if !ok {
+		return key, datastore.ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (d *apiKeyDataStore) RevokeAPIKey(id int) (APIKey, error) {
+	if id < 1 || id > len(d.hashes) {
+		return APIKey{}, datastore.ErrAPIKeyNotFound
+	}
+	key := d.keys[d.hashes[id-1]]
+	now := time.Now()
+	key.RevokedAt = &now
+	d.keys[d.hashes[id-1]] = key
+	return key, nil
+}
+
+func newAuthHandler(t *testing.T, es *eventStore, forceService bool) (httpHandler, *apiKeyDataStore) {
+	ds := &apiKeyDataStore{keys: make(map[string]APIKey)}
+	es.ds = ds
+	config := conf.DefaultConfig()
+	config.Auth = conf.AuthConfig{Enabled: true, ForceService: forceService, CacheTTL: 60, BootstrapKeySHA256: hashAPIKey("bootstrap")}
+	h := newHTTPHandler(es, newTestLogger(t), config)
+	es.log = h.log
+	return h, ds
+}
+
+// Issues a key through the admin API, authenticated with the bootstrap key
+func issueTestKey(t *testing.T, h *httpHandler, body string) APIKey {
+	r := httptest.NewRequest("POST", "/admin/keys", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer bootstrap")
+	w := httptest.NewRecorder()
+	h.authorize(capabilityAdmin, h.issueAPIKeyHandler)(w, r, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the key to be issued, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Key APIKey `json:"key"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Key
+}
+
+func TestAuthorize(t *testing.T) {
+	h, ds := newAuthHandler(t, newTestEventStore(1), false)
+	ingest := issueTestKey(t, &h, `{"service": "wish_be", "capabilities": ["ingest"]}`)
+	admin := issueTestKey(t, &h, `{"capabilities": ["admin"]}`)
+	if !strings.HasPrefix(ingest.Key, apiKeyPrefix) || !strings.HasPrefix(ingest.Key, ingest.Prefix) {
+		t.Fatalf("unexpected key %q with prefix %q", ingest.Key, ingest.Prefix)
+	}
+	if _, ok := ds.keys[ingest.Key]; ok {
+		t.Errorf("expected the key to be stored hashed")
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		h.sendResp(w, "ok", true)
+	}
+	tests := []struct {
+		name       string
+		capability string
+		setKey     func(r *http.Request)
+		code       int
+	}{
+		{"missing", capabilityIngest, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"invalid", capabilityIngest, func(r *http.Request) { r.Header.Set(apiKeyHeader, "esk_nope") }, http.StatusUnauthorized},
+		{"header", capabilityIngest, func(r *http.Request) { r.Header.Set(apiKeyHeader, ingest.Key) }, http.StatusOK},
+		{"bearer", capabilityIngest, func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+ingest.Key) }, http.StatusOK},
+		{"sentry header", capabilityIngest, func(r *http.Request) {
+			r.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_key="+ingest.Key+", sentry_client=raven")
+		}, http.StatusOK},
+		{"query", capabilityIngest, func(r *http.Request) { r.URL.RawQuery = "sentry_key=" + ingest.Key }, http.StatusOK},
+		{"missing capability", capabilityRead, func(r *http.Request) { r.Header.Set(apiKeyHeader, ingest.Key) }, http.StatusForbidden},
+		{"admin", capabilityRead, func(r *http.Request) { r.URL.RawQuery = apiKeyParam + "=" + admin.Key }, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/search", nil)
+		test.setKey(r)
+		w := httptest.NewRecorder()
+		h.authorize(test.capability, ok)(w, r, nil)
+		if w.Code != test.code {
+			t.Errorf("%s: expected a %d, got %d: %s", test.name, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	// keys are cached, until revoked
+	finds := ds.finds
+	r := httptest.NewRequest("GET", "/search", nil)
+	r.Header.Set(apiKeyHeader, ingest.Key)
+	h.authorize(capabilityIngest, ok)(httptest.NewRecorder(), r, nil)
+	if ds.finds != finds {
+		t.Errorf("expected the key to be cached")
+	}
+
+	w := httptest.NewRecorder()
+	r = httptest.NewRequest("DELETE", "/admin/keys/1", nil)
+	r.Header.Set(apiKeyHeader, admin.Key)
+	h.authorize(capabilityAdmin, h.revokeAPIKeyHandler)(w, r, httprouter.Params{{Key: "id", Value: "1"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the key to be revoked, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/search", nil)
+	r.Header.Set(apiKeyHeader, ingest.Key)
+	h.authorize(capabilityIngest, ok)(w, r, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked keys to be rejected, got %d", w.Code)
+	}
+}
+
+func TestIssueAPIKeyValidation(t *testing.T) {
+	h, _ := newAuthHandler(t, newTestEventStore(1), false)
+	for _, body := range []string{
+		`{"capabilities": []}`,
+		`{"capabilities": ["write"]}`,
+		`{"service": "unknown", "capabilities": ["ingest"]}`,
+		`{"service": "wish_be", "capabilities": ["ingest", "admin"]}`,
+		`not json`,
+	} {
+		w := httptest.NewRecorder()
+		h.issueAPIKeyHandler(w, httptest.NewRequest("POST", "/admin/keys", strings.NewReader(body)), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a 400, got %d", body, w.Code)
+		}
+	}
+}
+
+func TestReadServiceScopedKey(t *testing.T) {
+	h, _ := newAuthHandler(t, newTestEventStore(1), false)
+	key := issueTestKey(t, &h, `{"service": "wish_be", "capabilities": ["read"]}`)
+	get := func(handle httprouter.Handle, url string) int {
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set(apiKeyHeader, key.Key)
+		w := httptest.NewRecorder()
+		handle(w, r, nil)
+		return w.Code
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		h.sendResp(w, "ok", true)
+	}
+	if code := get(h.authorize(capabilityRead, ok), "/histogram"); code != http.StatusForbidden {
+		t.Errorf("expected routes reading every service to be rejected, got %d", code)
+	}
+	if code := get(h.authorizeScoped(capabilityRead, h.searchEventsHandler), "/search?service_id=4"); code != http.StatusForbidden {
+		t.Errorf("expected a search of another service to be rejected, got %d", code)
+	}
+	if code := get(h.authorizeScoped(capabilityRead, h.opsdbEventsHandler), "/opsdb?service=crond&environment=prod"); code != http.StatusForbidden {
+		t.Errorf("expected events of another service to be rejected, got %d", code)
+	}
+	if code := get(h.authorizeScoped(capabilityRead, ok), "/search"); code != http.StatusOK {
+		t.Errorf("expected routes checking the service to accept the key, got %d", code)
+	}
+}
+
+func TestCaptureServiceScopedKey(t *testing.T) {
+	capture := func(h *httpHandler, key, service string) int {
+		evt := `{"service":"` + service + `","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`
+		r := httptest.NewRequest("POST", "/capture", strings.NewReader(evt))
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		h.authorize(capabilityIngest, h.captureEventsHandler)(w, r, nil)
+		return w.Code
+	}
+
+	es := newTestEventStore(5)
+	h, _ := newAuthHandler(t, es, false)
+	key := issueTestKey(t, &h, `{"service": "wish_be", "capabilities": ["ingest"]}`)
+	if code := capture(&h, key.Key, "wish_be"); code != http.StatusOK {
+		t.Errorf("expected events of the service of the key to be captured, got %d", code)
+	}
+	if code := capture(&h, key.Key, "crond"); code != http.StatusForbidden {
+		t.Errorf("expected events of another service to be rejected, got %d", code)
+	}
+
+	es = newTestEventStore(5)
+	h, _ = newAuthHandler(t, es, true)
+	key = issueTestKey(t, &h, `{"service": "wish_be", "capabilities": ["ingest"]}`)
+	if code := capture(&h, key.Key, "crond"); code != http.StatusOK {
+		t.Fatalf("expected events of another service to be captured, got %d", code)
+	}
+	if evt := <-es.channel.queue; evt.Service != "wish_be" {
+		t.Errorf("expected the service of the key to be forced, got %s", evt.Service)
+	}
+}
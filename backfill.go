@@ -0,0 +1,175 @@
+package eventsum
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/log"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Returned when the backfill stops because events are dropped to disk again
+var errBackfillPaused = errors.New("events are being dropped to disk")
+
+// backfiller replays the events dropped to disk while the DB was overloaded,
+// at a limited rate
+type backfiller struct {
+	sync.Mutex
+	rate     float64 // events per second, 0 for no limit
+	progress BackfillProgress
+	ctx      context.Context // cancelled when the server stops
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func newBackfiller(rate float64) *backfiller {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backfiller{rate: rate, ctx: ctx, cancel: cancel}
+}
+
+// Starts replaying the files dropped to disk in the background. Returns false
+// if a backfill is already running, or if the backfiller is stopped.
+func (b *backfiller) start(es *eventStore) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.progress.Running || b.ctx.Err() != nil {
+		return false
+	}
+	now := time.Now()
+	b.progress = BackfillProgress{Running: true, StartedAt: &now}
+	b.wg.Add(1)
+	go b.run(es)
+	return true
+}
+
+// Stops the backfill running, if any, once the batch being saved is done, and
+// waits for it. The events left are saved by a backfill after the restart.
+func (b *backfiller) stop() {
+	b.Lock()
+	b.cancel()
+	b.Unlock()
+	b.wg.Wait()
+}
+
+func (b *backfiller) run(es *eventStore) {
+	defer b.wg.Done()
+	err := b.replay(es)
+
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	b.progress.Running = false
+	b.progress.FinishedAt = &now
+	if err != nil {
+		b.progress.Error = err.Error()
+		es.log.App().Errorf("Backfill stopped after %d events: %v", b.progress.Events, err)
+	} else if b.progress.Files > 0 {
+		es.log.App().Infof("Backfilled %d events from %d files", b.progress.Events, b.progress.Files)
+	}
+}
+
+// Saves the events of every file dropped to disk, oldest first, deleting each
+// file once saved. A file that fails to be saved is rewritten with the events
+// left, which are saved by the next backfill.
+func (b *backfiller) replay(es *eventStore) error {
+	files, err := es.log.EventLogFiles()
+	if err != nil {
+		return errors.Wrap(err, "listing files dropped to disk")
+	}
+	b.Lock()
+	b.progress.Files = len(files)
+	b.Unlock()
+
+	for _, file := range files {
+		evts, err := log.ReadEventLog(file)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", file)
+		}
+		for len(evts) > 0 {
+			if b.ctx.Err() != nil {
+				// the file is left with the events not saved yet
+				if err := log.WriteEventLog(file, evts); err != nil {
+					return errors.Wrapf(err, "rewriting %s", file)
+				}
+				return errStopped
+			}
+			if es.dropToDisk.Check() {
+				return errBackfillPaused
+			}
+			n := es.channel.BatchSize
+			if n <= 0 || n > len(evts) {
+				n = len(evts)
+			}
+			start := time.Now()
+			if err := es.saveFlushed(evts[:n]); err != nil {
+				// the file is left with the events not saved, so that the
+				// next backfill does not count the others twice
+				_, failed := splitSaved(evts[:n], err)
+				if werr := log.WriteEventLog(file, append(failed, evts[n:]...)); werr != nil {
+					return errors.Wrapf(werr, "rewriting %s", file)
+				}
+				return errors.Wrapf(err, "saving events of %s", file)
+			}
+			metrics.Backfilled(n)
+			evts = evts[n:]
+
+			b.Lock()
+			b.progress.Events += n
+			b.Unlock()
+			b.wait(n, start)
+		}
+		if err := os.Remove(file); err != nil {
+			return errors.Wrapf(err, "deleting %s", file)
+		}
+		b.Lock()
+		b.progress.FilesDone++
+		b.Unlock()
+	}
+	return nil
+}
+
+// Waits for as long as saving n events takes at the backfill rate, or until
+// the backfiller is stopped
+func (b *backfiller) wait(n int, start time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	sleepContext(b.ctx, time.Duration(float64(n)/b.rate*float64(time.Second))-time.Since(start))
+}
+
+func (es *eventStore) backfillProgress() BackfillProgress {
+	es.backfill.Lock()
+	progress := es.backfill.progress
+	es.backfill.Unlock()
+
+	progress.DropToDisk = es.dropToDisk.Check()
+	if files, err := es.log.EventLogFiles(); err == nil {
+		progress.PendingFiles = len(files)
+	}
+	return progress
+}
+
+// Reports the progress of the last backfill, and the files left to replay
+func (h *httpHandler) backfillHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.sendResp(w, "backfill", h.es.backfillProgress())
+}
+
+// Starts a backfill, e.g. to retry the files of a backfill that failed
+func (h *httpHandler) startBackfillHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.es.dropToDisk.Check() {
+		h.sendError(w, http.StatusConflict, errBackfillPaused, "Backfill not started")
+		return
+	}
+	if !h.es.backfill.start(h.es) {
+		h.sendError(w, http.StatusConflict, errors.New("a backfill is already running"), "Backfill not started")
+		return
+	}
+	h.sendResp(w, "backfill", h.es.backfillProgress())
+}
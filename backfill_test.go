@@ -0,0 +1,203 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/log"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/rules"
+	"github.com/ContextLogic/eventsum/scrubber"
+	"github.com/ContextLogic/eventsum/truncate"
+)
+
+// Returns a logger dropping events to the given dir
+func newEventDirLogger(t *testing.T, dir string) *log.Logger {
+	f, err := ioutil.TempFile("", "logconfig")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	config, _ := json.Marshal(map[string]interface{}{
+		"log_save_data_interval":         60,
+		"log_data_period_check_interval": 60,
+		"event_logging":                  dir,
+	})
+	f.Write(config)
+	f.Close()
+	return log.NewLogger(f.Name(), nil)
+}
+
+func TestDropToDiskAndBackfill(t *testing.T) {
+	globalRule = rules.NewRule()
+	dir, err := ioutil.TempDir("", "eventsum-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := periodDataStore{periods: map[int]EventInstancePeriod{}}
+	es := newTestEventStore(5)
+	es.ds = ds
+	es.log = newEventDirLogger(t, dir)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	es.backfill = newBackfiller(0)
+	h := newHTTPHandler(es, es.log, conf.DefaultConfig())
+
+	event := func(message string) UnaddedEvent {
+		return UnaddedEvent{
+			Service:     "wish_be",
+			Environment: "prod",
+			Name:        "KeyError",
+			Type:        "python",
+			Data:        EventData{Message: message, Raw: message},
+			Timestamp:   "2020-01-26 00:53:20",
+		}
+	}
+
+	es.dropToDisk.TurnOn()
+	if err := es.SaveToDB([]UnaddedEvent{event("a"), event("bb"), event("bb")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.periods) != 0 {
+		t.Errorf("expected no event to be saved while dropping to disk")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Fatalf("expected the batch to be dropped to one file, got %v", files)
+	}
+
+	w := httptest.NewRecorder()
+	h.startBackfillHandler(w, httptest.NewRequest("POST", "/admin/backfill", nil), nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected no backfill while dropping to disk, got %d", w.Code)
+	}
+
+	es.dropToDisk.TurnOff()
+	es.BackFillToDB()
+	deadline := time.Now().Add(time.Second)
+	for es.backfillProgress().Running && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	progress := es.backfillProgress()
+	if progress.Running || progress.Events != 3 || progress.FilesDone != 1 || progress.PendingFiles != 0 || progress.Error != "" {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if ds.periods[1].Count != 1 || ds.periods[2].Count != 2 {
+		t.Errorf("expected the events to be backfilled, got %+v", ds.periods)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("expected the backfilled file to be deleted, got %v", files)
+	}
+}
+
+func TestDropToDiskScrubbedAndTruncated(t *testing.T) {
+	globalRule = rules.NewRule()
+	dir, err := ioutil.TempDir("", "eventsum-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es := newTestEventStore(1)
+	es.log = newEventDirLogger(t, dir)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	scrub := conf.DefaultConfig().Scrub
+	scrub.Enabled = true
+	if es.scrubber, err = scrubber.New(scrub); err != nil {
+		t.Fatal(err)
+	}
+	es.truncator = truncate.New(conf.LimitsConfig{StringLength: 40})
+	h := newHTTPHandler(es, es.log, conf.DefaultConfig())
+
+	body := `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20",
+		"event_data":{"message":"no account for jane@example.com"},"extra_args":{"query":"` + strings.Repeat("x", 100) + `"}}`
+	w := httptest.NewRecorder()
+	h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(body)), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+
+	es.dropToDisk.TurnOn()
+	if err := es.SaveToDB([]UnaddedEvent{<-es.channel.queue}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := es.log.EventLogFiles()
+	if len(files) != 1 {
+		t.Fatalf("expected the event to be dropped to one file, got %v", files)
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "jane@example.com") || strings.Contains(string(content), strings.Repeat("x", 41)) {
+		t.Errorf("expected the dropped event to be scrubbed and truncated, got %s", content)
+	}
+}
+
+func TestBackfillStop(t *testing.T) {
+	globalRule = rules.NewRule()
+	dir, err := ioutil.TempDir("", "eventsum-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ds := periodDataStore{periods: map[int]EventInstancePeriod{}}
+	es := newTestEventStore(1)
+	es.ds = ds
+	es.log = newEventDirLogger(t, dir)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	// one event per batch, and a batch per second
+	es.backfill = newBackfiller(1)
+
+	var evts []UnaddedEvent
+	for _, message := range []string{"a", "bb", "ccc"} {
+		evts = append(evts, UnaddedEvent{Service: "wish_be", Environment: "prod", Name: "KeyError", Type: "python",
+			Data: EventData{Message: message, Raw: message}, Timestamp: "2020-01-26 00:53:20"})
+	}
+	es.dropToDisk.TurnOn()
+	if err := es.SaveToDB(evts); err != nil {
+		t.Fatal(err)
+	}
+	es.dropToDisk.TurnOff()
+
+	es.BackFillToDB()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	es.backfill.stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the backfill to stop without waiting for the rate, took %v", elapsed)
+	}
+
+	progress := es.backfillProgress()
+	if progress.Running || progress.Events != 1 || progress.Error != errStopped.Error() {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if es.backfill.start(es) {
+		t.Errorf("expected no backfill to start once stopped")
+	}
+	// the file is left with the events not saved
+	files, _ := es.log.EventLogFiles()
+	if len(files) != 1 {
+		t.Fatalf("expected the file to be kept, got %v", files)
+	}
+	if left, err := log.ReadEventLog(files[0]); err != nil || len(left) != 2 {
+		t.Errorf("expected 2 events left, got %d: %v", len(left), err)
+	}
+	if len(ds.periods) != 1 {
+		t.Errorf("expected 1 event to be backfilled, got %+v", ds.periods)
+	}
+}
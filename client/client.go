@@ -0,0 +1,416 @@
+// Package client reports events to an eventsum server from Go programs.
+//
+// Events are buffered in memory and sent in batches by a background goroutine,
+// so capturing an event never blocks on the network. Once the buffer is full,
+// new events are dropped rather than growing the memory of the program.
+//
+//	c, err := client.New(client.Config{Endpoint: "http://eventsum:8080", Service: "merchant_be", Environment: "prod"})
+//	defer c.Close(context.Background())
+//
+//	defer c.Recover()
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/retryafter"
+)
+
+type Config struct {
+	Endpoint              string // base url of the eventsum server
+	APIKey                string // key with the ingest capability, if the server requires one
+	Service               string
+	Environment           string
+	TimeFormat            string              // time format of the server
+	ConfigurableFilters   map[string][]string // filters applied to every event
+	ConfigurableGroupings []string            // groupings applied to every event
+	BufferSize            int                 // most events waiting to be sent
+	BatchSize             int                 // most events sent per request
+	FlushInterval         time.Duration       // time between two sends of the buffer
+	MaxRetries            int                 // retries of a failed request before dropping its batch, negative for none
+	MinBackoff            time.Duration       // backoff after the first failed request
+	MaxBackoff            time.Duration
+	HTTPClient            *http.Client
+	OnError               func(error) // called when events are dropped, if set
+}
+
+// Header the server reads the API key from
+const apiKeyHeader = "X-Eventsum-Key"
+
+func DefaultConfig() Config {
+	return Config{
+		Environment:   "default",
+		TimeFormat:    "2006-01-02 15:04:05",
+		BufferSize:    1000,
+		BatchSize:     100,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    5,
+		MinBackoff:    500 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+		HTTPClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Client builds events and sends them to the eventsum server
+type Client struct {
+	config Config
+	url    string
+
+	mu     sync.Mutex
+	buffer []models.UnaddedEvent
+	full   chan struct{}      // signals the buffer holds a full batch
+	flush  chan chan struct{} // requests the whole buffer to be sent
+	quit   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+}
+
+// Creates a client, and starts sending the events it captures. The zero
+// values of the config are replaced by the defaults.
+func New(config Config) (*Client, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("missing eventsum endpoint")
+	}
+	if config.Service == "" {
+		return nil, errors.New("missing service")
+	}
+	defaults := DefaultConfig()
+	if config.Environment == "" {
+		config.Environment = defaults.Environment
+	}
+	if config.TimeFormat == "" {
+		config.TimeFormat = defaults.TimeFormat
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaults.BufferSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaults.FlushInterval
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaults.MaxRetries
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaults.MinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaults.MaxBackoff
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = defaults.HTTPClient
+	}
+
+	c := &Client{
+		config: config,
+		url:    strings.TrimRight(config.Endpoint, "/") + "/capture/batch",
+		full:   make(chan struct{}, 1),
+		flush:  make(chan chan struct{}),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Builds an event of the client's service and environment, timestamped now.
+// The event gets a random id, so that the server counts it once even if its
+// batch is retried.
+func (c *Client) Event(name, eventType string, message interface{}, raw interface{}, extraArgs map[string]interface{}) models.UnaddedEvent {
+	if extraArgs == nil {
+		extraArgs = make(map[string]interface{})
+	}
+	return models.UnaddedEvent{
+		Service:     c.config.Service,
+		Environment: c.config.Environment,
+		Name:        name,
+		Type:        eventType,
+		Data: models.EventData{
+			RawMessage: message,
+			Raw:        raw,
+		},
+		ExtraArgs:             extraArgs,
+		Timestamp:             time.Now().UTC().Format(c.config.TimeFormat),
+		ConfigurableFilters:   c.config.ConfigurableFilters,
+		ConfigurableGroupings: c.config.ConfigurableGroupings,
+		EventId:               newEventId(),
+	}
+}
+
+func newEventId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// Adds the event to the buffer. Returns false if the buffer is full, in which
+// case the event is dropped.
+func (c *Client) Capture(evt models.UnaddedEvent) bool {
+	c.mu.Lock()
+	if len(c.buffer) >= c.config.BufferSize {
+		c.mu.Unlock()
+		c.onError(errors.Errorf("buffer is full, dropping event %s", evt.Name))
+		return false
+	}
+	c.buffer = append(c.buffer, evt)
+	isFull := len(c.buffer) >= c.config.BatchSize
+	c.mu.Unlock()
+
+	if isFull {
+		select {
+		case c.full <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// Captures an error, with the stack trace of the caller. The type of the error
+// becomes the event name.
+func (c *Client) CaptureError(err error, extraArgs map[string]interface{}) bool {
+	return c.Capture(c.errorEvent(err, Stacktrace(1), extraArgs))
+}
+
+// Captures the value passed to panic, with the stack trace of the panicking
+// goroutine. It must be called from a deferred function.
+func (c *Client) CapturePanic(v interface{}, extraArgs map[string]interface{}) bool {
+	return c.Capture(c.panicEvent(v, extraArgs))
+}
+
+// Recovers from a panic and captures it. It must be deferred directly:
+//
+//	defer c.Recover()
+func (c *Client) Recover() {
+	if v := recover(); v != nil {
+		c.Capture(c.panicEvent(v, nil))
+	}
+}
+
+// Returns a handler capturing the panics of next, along with the method and
+// url of the request, and responding with a 500
+func (c *Client) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// aborting a response is not an error
+				panic(v)
+			}
+			c.Capture(c.panicEvent(v, map[string]interface{}{
+				"method": r.Method,
+				"url":    r.URL.String(),
+			}))
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Client) panicEvent(v interface{}, extraArgs map[string]interface{}) models.UnaddedEvent {
+	if err, ok := v.(error); ok {
+		return c.errorEvent(err, panicStacktrace(), extraArgs)
+	}
+	return c.Event("panic", "go", fmt.Sprint(v), panicStacktrace(), extraArgs)
+}
+
+func (c *Client) errorEvent(err error, stacktrace models.StackTrace, extraArgs map[string]interface{}) models.UnaddedEvent {
+	return c.Event(fmt.Sprintf("%T", err), "go", err.Error(), stacktrace, extraArgs)
+}
+
+// Sends every buffered event, and waits until they are sent or the context is
+// done
+func (c *Client) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case c.flush <- done:
+	case <-c.done:
+		return errors.New("client is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flushes the buffer, then stops the background sending
+func (c *Client) Close(ctx context.Context) error {
+	err := c.Flush(ctx)
+	c.closed.Do(func() { close(c.quit) })
+	<-c.done
+	return err
+}
+
+// Sends the buffer every flush interval, or as soon as it holds a batch
+func (c *Client) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sendAll()
+		case <-c.full:
+			c.sendAll()
+		case done := <-c.flush:
+			c.sendAll()
+			close(done)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Sends the buffered events, one batch at a time
+func (c *Client) sendAll() {
+	for {
+		c.mu.Lock()
+		n := len(c.buffer)
+		if n > c.config.BatchSize {
+			n = c.config.BatchSize
+		}
+		batch := c.buffer[:n:n]
+		c.buffer = c.buffer[n:]
+		c.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		c.send(batch)
+	}
+}
+
+// Sends a batch, retrying with an exponential backoff. The events the server
+// had no room for are sent again, after the delay it asked for. The batch is
+// dropped once the retries are exhausted, or if the client is closed
+// meanwhile.
+func (c *Client) send(batch []models.UnaddedEvent) {
+	backoff := c.config.MinBackoff
+	for attempt := 0; ; attempt++ {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			c.onError(errors.Wrap(err, "encoding events"))
+			return
+		}
+		retry, rejected, err := c.post(body)
+		var requeued []models.UnaddedEvent
+		for _, result := range rejected {
+			if result.Index < 0 || result.Index >= len(batch) {
+				continue
+			}
+			if result.Retry {
+				requeued = append(requeued, batch[result.Index])
+			} else {
+				c.onError(errors.Errorf("event %s rejected: %s", batch[result.Index].Name, result.Error))
+			}
+		}
+		if err == nil {
+			return
+		}
+		if len(requeued) > 0 {
+			batch = requeued
+		}
+		if !retry || attempt >= c.config.MaxRetries {
+			c.onError(errors.Wrapf(err, "dropping %d events", len(batch)))
+			return
+		}
+
+		wait := backoff
+		if delay := retryafter.Delay(err); delay > wait {
+			wait = delay
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.quit:
+			timer.Stop()
+			c.onError(errors.Wrapf(err, "client closed, dropping %d events", len(batch)))
+			return
+		}
+		if backoff *= 2; backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// Posts the batch, and tells whether a failed request should be retried.
+// Returns the results of the events the server rejected, and an error to retry
+// after if some were rejected for lack of room.
+func (c *Client) post(body []byte) (bool, []models.CaptureResult, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.config.APIKey != "" {
+		req.Header.Set(apiKeyHeader, c.config.APIKey)
+	}
+	resp, err := c.config.HTTPClient.Do(req)
+	if err != nil {
+		return true, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err := errors.Errorf("server responded %s: %s", resp.Status, respBody)
+		return true, nil, retryafter.New(err, resp.Header.Get("Retry-After"))
+	case resp.StatusCode >= 500:
+		return true, nil, errors.Errorf("server responded %s: %s", resp.Status, respBody)
+	case resp.StatusCode >= 300:
+		return false, nil, errors.Errorf("server responded %s: %s", resp.Status, respBody)
+	}
+
+	var captured struct {
+		Results []models.CaptureResult `json:"results"`
+	}
+	var rejected []models.CaptureResult
+	retries := 0
+	if err := json.Unmarshal(respBody, &captured); err == nil {
+		for _, result := range captured.Results {
+			if !result.Accepted {
+				rejected = append(rejected, result)
+			}
+			if result.Retry {
+				retries++
+			}
+		}
+	}
+	if retries > 0 {
+		err := errors.Errorf("server is overloaded, %d events to send again", retries)
+		return true, rejected, retryafter.New(err, resp.Header.Get("Retry-After"))
+	}
+	return false, rejected, nil
+}
+
+func (c *Client) onError(err error) {
+	if c.config.OnError != nil {
+		c.config.OnError(err)
+	}
+}
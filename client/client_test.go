@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// captureServer records the events it receives, and fails the given number
+// of requests first. The last event of the next requests, up to the given
+// number of rejections, is rejected for lack of room.
+type captureServer struct {
+	sync.Mutex
+	events     []models.UnaddedEvent
+	keys       []string
+	requests   int
+	failures   int
+	rejections int
+}
+
+func (s *captureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	s.keys = append(s.keys, r.Header.Get(apiKeyHeader))
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var evts []models.UnaddedEvent
+	json.NewDecoder(r.Body).Decode(&evts)
+	if s.rejections > 0 && len(evts) > 0 {
+		s.rejections--
+		s.events = append(s.events, evts[:len(evts)-1]...)
+		w.Header().Set("Retry-After", "0")
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []models.CaptureResult{
+			{Index: len(evts) - 1, Error: "ingest buffer is full", Retry: true},
+		}})
+		return
+	}
+	s.events = append(s.events, evts...)
+	w.Write([]byte(`{"results": []}`))
+}
+
+func newTestClient(t *testing.T, server *captureServer, config Config) (*Client, func()) {
+	ts := httptest.NewServer(server)
+	config.Endpoint = ts.URL
+	config.Service = "merchant_be"
+	config.MinBackoff = time.Millisecond
+	c, err := New(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c, ts.Close
+}
+
+func TestClientCapture(t *testing.T) {
+	server := &captureServer{failures: 2}
+	c, closeServer := newTestClient(t, server, Config{BatchSize: 2, APIKey: "esk_test"})
+	defer closeServer()
+
+	c.CaptureError(errors.New("boom"), map[string]interface{}{"user_id": 4})
+	func() {
+		defer c.Recover()
+		panic(errors.New("out of stock"))
+	}()
+	c.Capture(c.Event("slow_query", "perf", "select 1", nil, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	server.Lock()
+	defer server.Unlock()
+	if len(server.events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", server.events)
+	}
+	if server.requests != 4 {
+		t.Errorf("expected 2 failed and 2 successful requests, got %d", server.requests)
+	}
+	if server.keys[0] != "esk_test" {
+		t.Errorf("expected the API key to be sent, got %q", server.keys[0])
+	}
+
+	errEvt := server.events[0]
+	if errEvt.Service != "merchant_be" || errEvt.Environment != "default" || errEvt.Type != "go" ||
+		errEvt.Name != "*errors.fundamental" || errEvt.Data.RawMessage != "boom" || errEvt.ExtraArgs["user_id"] != 4.0 {
+		t.Errorf("unexpected error event: %+v", errEvt)
+	}
+	if len(errEvt.EventId) != 32 || errEvt.EventId == server.events[1].EventId {
+		t.Errorf("expected events to have distinct ids, got %q", errEvt.EventId)
+	}
+	if _, err := time.Parse(DefaultConfig().TimeFormat, errEvt.Timestamp); err != nil {
+		t.Errorf("unexpected timestamp: %v", err)
+	}
+	if frame := lastFrame(t, errEvt); frame.Function != "TestClientCapture" {
+		t.Errorf("expected the stack to end in the test, got %+v", frame)
+	}
+
+	panicEvt := server.events[1]
+	if panicEvt.Name != "*errors.fundamental" || panicEvt.Data.RawMessage != "out of stock" {
+		t.Errorf("unexpected panic event: %+v", panicEvt)
+	}
+	if frame := lastFrame(t, panicEvt); frame.Function != "TestClientCapture.func1" {
+		t.Errorf("expected the stack to end where the panic happened, got %+v", frame)
+	}
+}
+
+func TestClientRetriesEventsWithoutRoom(t *testing.T) {
+	server := &captureServer{rejections: 1}
+	var dropped []error
+	c, closeServer := newTestClient(t, server, Config{BatchSize: 2, OnError: func(err error) { dropped = append(dropped, err) }})
+	defer closeServer()
+
+	c.Capture(c.Event("a", "perf", "a", nil, nil))
+	c.Capture(c.Event("b", "perf", "b", nil, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Close(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	server.Lock()
+	defer server.Unlock()
+	if len(server.events) != 2 || server.events[0].Name != "a" || server.events[1].Name != "b" {
+		t.Errorf("expected the rejected event to be sent again alone, got %+v", server.events)
+	}
+	if server.requests != 2 || len(dropped) != 0 {
+		t.Errorf("expected 2 requests and no event dropped, got %d, %v", server.requests, dropped)
+	}
+}
+
+func TestClientMiddleware(t *testing.T) {
+	server := &captureServer{}
+	c, closeServer := newTestClient(t, server, Config{})
+	defer closeServer()
+
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/orders?id=3", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected a 500, got %d", w.Code)
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server.Lock()
+	defer server.Unlock()
+	if len(server.events) != 1 {
+		t.Fatalf("expected 1 event, got %+v", server.events)
+	}
+	evt := server.events[0]
+	if evt.Name != "panic" || evt.Data.RawMessage != "handler failed" || evt.ExtraArgs["method"] != "GET" || evt.ExtraArgs["url"] != "/orders?id=3" {
+		t.Errorf("unexpected event: %+v", evt)
+	}
+}
+
+func TestClientBufferFull(t *testing.T) {
+	var dropped []error
+	c := &Client{config: Config{BufferSize: 2, BatchSize: 10, OnError: func(err error) { dropped = append(dropped, err) }}, full: make(chan struct{}, 1)}
+	for i := 0; i < 3; i++ {
+		c.Capture(models.UnaddedEvent{Name: "evt"})
+	}
+	if len(c.buffer) != 2 || len(dropped) != 1 {
+		t.Errorf("expected 2 buffered and 1 dropped events, got %d and %v", len(c.buffer), dropped)
+	}
+}
+
+func TestSplitFunctionName(t *testing.T) {
+	tests := map[string][2]string{
+		"github.com/ContextLogic/eventsum.(*eventStore).Send": {"github.com/ContextLogic/eventsum", "(*eventStore).Send"},
+		"github.com/a/b.c/d.F.func1":                          {"github.com/a/b.c/d", "F.func1"},
+		"main.main":                                           {"main", "main"},
+	}
+	for name, expected := range tests {
+		module, function := splitFunctionName(name)
+		if module != expected[0] || function != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s", name, expected, module, function)
+		}
+	}
+}
+
+func lastFrame(t *testing.T, evt models.UnaddedEvent) models.Frame {
+	b, _ := json.Marshal(evt.Data.Raw)
+	var stacktrace models.StackTrace
+	if err := json.Unmarshal(b, &stacktrace); err != nil || len(stacktrace.Frames) == 0 {
+		t.Fatalf("invalid stack trace %s: %v", b, err)
+	}
+	return stacktrace.Frames[len(stacktrace.Frames)-1]
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Most frames kept in a stack trace
+const maxFrames = 64
+
+// Returns the stack trace of the calling goroutine. Skip is the number of
+// callers to leave out, 0 being the caller of Stacktrace. Frames are ordered
+// from the outermost call to the innermost, like in Python tracebacks.
+func Stacktrace(skip int) models.StackTrace {
+	return toStackTrace(callers(skip + 3))
+}
+
+// Returns the stack trace of a panicking goroutine, starting at the function
+// that panicked. It must be called from a deferred function.
+func panicStacktrace() models.StackTrace {
+	frames := callers(2)
+	// leave out the deferred functions, up to the runtime's panic handler
+	for i, frame := range frames {
+		if frame.Function == "runtime.gopanic" {
+			frames = frames[i+1:]
+			break
+		}
+	}
+	return toStackTrace(frames)
+}
+
+// Returns the frames of the calling goroutine, from the innermost call
+func callers(skip int) []runtime.Frame {
+	pcs := make([]uintptr, maxFrames)
+	n := runtime.Callers(skip, pcs)
+
+	var frames []runtime.Frame
+	iter := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := iter.Next()
+		if frame.Function != "" {
+			frames = append(frames, frame)
+		}
+		if !more {
+			return frames
+		}
+	}
+}
+
+func toStackTrace(frames []runtime.Frame) models.StackTrace {
+	stacktrace := models.StackTrace{Frames: make([]models.Frame, len(frames))}
+	for i, frame := range frames {
+		module, function := splitFunctionName(frame.Function)
+		// runtime frames are ordered from the innermost call
+		stacktrace.Frames[len(frames)-1-i] = models.Frame{
+			AbsPath:  frame.File,
+			Filename: filepath.Base(frame.File),
+			Function: function,
+			Module:   module,
+			LineNo:   frame.Line,
+		}
+	}
+	return stacktrace
+}
+
+// Splits a runtime function name, e.g. `github.com/a/b.(*T).Method`, into its
+// package path and function name
+func splitFunctionName(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	dot += slash + 1
+	return name[:dot], name[dot+1:]
+}
@@ -11,19 +11,32 @@ import (
 	"github.com/ContextLogic/eventsum"
 	c "github.com/ContextLogic/eventsum/config"
 	"github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/parsers"
 )
 
 func main() {
 	var config c.Flags
 	parser := flags.NewParser(&config, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("tail", "Forward events from NDJSON files",
+		"Follows NDJSON files of events, across rotations, and forwards the events to a remote eventsum server.",
+		&tailCommand{})
 	_, err := parser.Parse()
 	if err != nil {
 		logger.Fatal(err)
 	}
+	// the subcommand already ran
+	if parser.Active != nil {
+		return
+	}
 	e := eventsum.New(config)
 	e.AddFilter("exception_python_remove_line_no", exceptionPythonRemoveLineNo)
 	e.AddFilter("exception_python_process_stack_vars", exceptionPythonProcessStackVars)
 	e.AddFilter("exception_python_remove_stack_vars", exceptionPythonRemoveStackVars)
+	// parse stack traces sent as strings, e.g. "parse_java_stack"
+	for name, filter := range parsers.Filters() {
+		e.AddFilter(name, filter)
+	}
 	//e.AddGrouping("query_perf_trace_grouping", queryPerfTraceGrouping)
 	//e.AddConsolidation(consolidationFunction)
 	e.Start()
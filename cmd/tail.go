@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventsum/tail"
+)
+
+// tailCommand runs the binary as an agent forwarding the events written to
+// NDJSON files to a remote eventsum server
+type tailCommand struct {
+	Endpoint      string        `short:"e" long:"endpoint" description:"base url of the eventsum server" required:"true"`
+	APIKey        string        `short:"k" long:"api-key" env:"EVENTSUM_API_KEY" description:"key with the ingest capability, if the server requires one"`
+	StateFile     string        `short:"s" long:"state" description:"file the read offsets are saved to" default:"eventsum-tail.state"`
+	BatchSize     int           `long:"batch-size" description:"events forwarded per request" default:"100"`
+	FlushInterval time.Duration `long:"flush-interval" description:"longest time an event waits for its batch to fill" default:"5s"`
+	PollInterval  time.Duration `long:"poll-interval" description:"time between two reads of the files" default:"1s"`
+	Args          struct {
+		Files []string `positional-arg-name:"file" required:"1"`
+	} `positional-args:"yes"`
+}
+
+func (c *tailCommand) Execute(args []string) error {
+	config := tail.DefaultConfig()
+	config.Files = c.Args.Files
+	config.StateFile = c.StateFile
+	config.Endpoint = c.Endpoint
+	config.APIKey = c.APIKey
+	config.BatchSize = c.BatchSize
+	config.FlushInterval = c.FlushInterval
+	config.PollInterval = c.PollInterval
+
+	agent, err := tail.NewAgent(config, logger.StandardLogger())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		cancel()
+	}()
+	return agent.Run(ctx)
+}
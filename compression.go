@@ -0,0 +1,213 @@
+package eventsum
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/ContextLogic/eventsum/metrics"
+)
+
+// Returned by the request body once more than the maximum allowed
+// number of bytes have been decompressed.
+var errBodyTooLarge = errors.New("request body too large")
+
+// Services body sizes are reported under, besides the known services
+const (
+	mixedServices  = "mixed"   // a batch of events from more than one service
+	unknownService = "unknown" // a service not in the registry
+)
+
+type bodyStatsKey struct{}
+
+// bodyStats keeps track of the number of bytes read from the wire and
+// the number of bytes after decompression for a single request.
+type bodyStats struct {
+	encoding     string
+	compressed   countingReader
+	decompressed countingReader
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	io.Reader
+
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedReader returns errBodyTooLarge once more than limit bytes are read,
+// unlike io.LimitReader which silently stops at the limit.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// decompressedBody closes both the decoder and the original request body
+type decompressedBody struct {
+	io.Reader
+
+	closers []io.Closer
+}
+
+func (d *decompressedBody) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// zstdCloser adapts zstd.Decoder, whose Close does not return an error
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// decompress transparently decodes request bodies sent with a gzip, deflate
+// or zstd Content-Encoding, and caps the size of the decoded body at maxBytes.
+// Sizes are recorded on the request so that handlers can export them once the
+// service of the event is known.
+func decompress(maxBytes int64, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" {
+			encoding = "identity"
+		}
+
+		stats := &bodyStats{encoding: encoding}
+		stats.compressed.Reader = r.Body
+
+		var decoded io.Reader
+		closers := []io.Closer{r.Body}
+		switch encoding {
+		case "identity":
+			decoded = &stats.compressed
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(&stats.compressed)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Error reading gzip body: %v", err)))
+				return
+			}
+			decoded = gz
+			closers = append(closers, gz)
+		case "deflate":
+			fl := flate.NewReader(&stats.compressed)
+			decoded = fl
+			closers = append(closers, fl)
+		case "zstd":
+			zd, err := zstd.NewReader(&stats.compressed)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Error reading zstd body: %v", err)))
+				return
+			}
+			decoded = zd
+			closers = append(closers, zstdCloser{zd})
+		default:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte(fmt.Sprintf("Unsupported Content-Encoding: %s", encoding)))
+			return
+		}
+
+		if maxBytes > 0 {
+			decoded = &limitedReader{r: decoded, limit: maxBytes}
+		}
+		stats.decompressed.Reader = decoded
+
+		r.Body = &decompressedBody{Reader: &stats.decompressed, closers: closers}
+		r.Header.Del("Content-Encoding")
+		r = r.WithContext(context.WithValue(r.Context(), bodyStatsKey{}, stats))
+		h(w, r, p)
+	}
+}
+
+// limitedBody closes the original request body, and counts the requests
+// rejected for their size
+type limitedBody struct {
+	limitedReader
+	io.Closer
+
+	rejected bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.limitedReader.Read(p)
+	if err == errBodyTooLarge && !l.rejected {
+		l.rejected = true
+		metrics.Truncated("body_bytes")
+	}
+	return n, err
+}
+
+// limitBody caps the size of request bodies as received, before any
+// decompression, at maxBytes. Requests announcing a larger body are rejected
+// right away, the others once they read past the limit.
+func limitBody(maxBytes int64, h httprouter.Handle) httprouter.Handle {
+	if maxBytes <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r.ContentLength > maxBytes {
+			metrics.Truncated("body_bytes")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(fmt.Sprintf("Request body larger than %d bytes", maxBytes)))
+			return
+		}
+		r.Body = &limitedBody{limitedReader: limitedReader{r: r.Body, limit: maxBytes}, Closer: r.Body}
+		h(w, r, p)
+	}
+}
+
+// Exports the compressed and decompressed sizes of the request body under the
+// given service. Services sent by clients are only used as labels once known,
+// so that the number of labels stays bounded. Does nothing if the request did
+// not go through decompress.
+func (h *httpHandler) recordBodySize(r *http.Request, service string) {
+	stats, ok := r.Context().Value(bodyStatsKey{}).(*bodyStats)
+	if !ok {
+		return
+	}
+	if _, known := h.es.ds.GetServicesMap()[service]; !known && service != mixedServices {
+		service = unknownService
+	}
+	metrics.RequestBodyBytes(service, stats.encoding, stats.compressed.n, stats.decompressed.n)
+}
+
+// Returns the status code to respond with when the request body could not be decoded
+func decodeErrorStatus(err error) int {
+	if err == errBodyTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,94 @@
+package eventsum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompress(t *testing.T) {
+	payload := `{"event_name": "KeyError", "event_type": "python"}`
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(payload))
+	gw.Close()
+
+	zw, _ := zstd.NewWriter(nil)
+	zs := zw.EncodeAll([]byte(payload), nil)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		maxBytes int64
+		status   int
+	}{
+		{"identity", "", []byte(payload), 1024, http.StatusOK},
+		{"gzip", "gzip", gz.Bytes(), 1024, http.StatusOK},
+		{"zstd", "zstd", zs, 1024, http.StatusOK},
+		{"too large", "gzip", gz.Bytes(), 10, http.StatusRequestEntityTooLarge},
+		{"bad gzip", "gzip", []byte(payload), 1024, http.StatusBadRequest},
+		{"unsupported", "br", []byte(payload), 1024, http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		h := decompress(test.maxBytes, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(decodeErrorStatus(err))
+				return
+			}
+			if string(b) != payload {
+				t.Errorf("%s: unexpected body %q", test.name, b)
+			}
+		})
+
+		req := httptest.NewRequest("POST", "/capture", bytes.NewReader(test.body))
+		if test.encoding != "" {
+			req.Header.Set("Content-Encoding", strings.ToUpper(test.encoding))
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req, nil)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	payload := strings.Repeat("x", 100)
+	read := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(decodeErrorStatus(err))
+		}
+	}
+
+	tests := []struct {
+		name          string
+		maxBytes      int64
+		contentLength int64
+		status        int
+	}{
+		{"under the limit", 100, 100, http.StatusOK},
+		{"announced over the limit", 99, 100, http.StatusRequestEntityTooLarge},
+		{"read over the limit", 99, -1, http.StatusRequestEntityTooLarge},
+		{"no limit", 0, 100, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/capture", strings.NewReader(payload))
+		req.ContentLength = test.contentLength
+		rec := httptest.NewRecorder()
+		limitBody(test.maxBytes, read)(rec, req, nil)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+		}
+	}
+}
@@ -16,40 +16,267 @@ type Flags struct {
 
 // config are settings used ... XXX
 type EventsumConfig struct {
-	DataSourceInstance string                    `json:"data_source_instance"`
-	DataSourceSchema   string                    `json:"data_source_schema"`
-	DatabaseName       string                    `json:"database_name"`
-	LogConfigFile      string                    `json:"log_config_file"`
-	BatchSize          int                       `json:"event_batch_limit"`
-	TimeLimit          int                       `json:"event_time_limit"` // in seconds
-	ServerPort         int                       `json:"server_port"`
-	TimeInterval       int                       `json:"time_interval"` // in minutes
-	TimeFormat         string                    `json:"time_format"`
-	Services           map[string]map[string]int `json:"services"`
-	Environments       map[string]map[string]int `json:"environments"`
-	RegionsMap         map[string]int            `json:"regions_map"`
-	Region             string                    `json:"region"`
-	DrainSecond        int                       `json:"drain_second"` // in seconds
-	ServiceAggMapping  map[string]string         `json:"service_aggregation_mapping"`
+	DataSourceInstance   string                    `json:"data_source_instance"`
+	DataSourceSchema     string                    `json:"data_source_schema"`
+	DatabaseName         string                    `json:"database_name"`
+	LogConfigFile        string                    `json:"log_config_file"`
+	BatchSize            int                       `json:"event_batch_limit"`
+	TimeLimit            int                       `json:"event_time_limit"`   // in seconds
+	IngestBufferSize     int                       `json:"ingest_buffer_size"` // most events queued before captures are rejected
+	IngestWait           int                       `json:"ingest_wait"`        // in ms, time a capture waits for room in a full buffer
+	RetryAfter           int                       `json:"retry_after"`        // in seconds, sent along with 429 responses
+	SaveWorkers          int                       `json:"save_workers"`       // batches saved concurrently
+	SaveQueueSize        int                       `json:"save_queue_size"`    // most batches waiting for a save worker
+	ServerPort           int                       `json:"server_port"`
+	GrpcPort             int                       `json:"grpc_port"`     // 0 disables the gRPC server
+	TimeInterval         int                       `json:"time_interval"` // in minutes
+	TimeFormat           string                    `json:"time_format"`
+	Services             map[string]map[string]int `json:"services"`
+	Environments         map[string]map[string]int `json:"environments"`
+	RegionsMap           map[string]int            `json:"regions_map"`
+	Region               string                    `json:"region"`
+	DrainSecond          int                       `json:"drain_second"` // in seconds
+	ServiceAggMapping    map[string]string         `json:"service_aggregation_mapping"`
+	MaxDecompressedBytes int64                     `json:"max_decompressed_bytes"` // in bytes
+	SentryProjects       map[string]SentryProject  `json:"sentry_projects"`
+	Kafka                KafkaConfig               `json:"kafka"`
+	Syslog               SyslogConfig              `json:"syslog"`
+	OTLP                 OTLPConfig                `json:"otlp"`
+	DiscardLogSize       int                       `json:"discard_log_size"` // number of discarded events listed by /admin/discarded
+	Dedupe               DedupeConfig              `json:"dedupe"`
+	Timestamps           TimestampConfig           `json:"timestamps"`
+	Quotas               map[string]QuotaConfig    `json:"quotas"`   // by "service/environment", "service" or "*"
+	Sampling             []SamplingRule            `json:"sampling"` // the first rule matching an event applies
+	Scrub                ScrubConfig               `json:"scrub"`
+	Registry             RegistryConfig            `json:"registry"`
+	Auth                 AuthConfig                `json:"auth"`
+	Limits               LimitsConfig              `json:"limits"`
+	WAL                  WALConfig                 `json:"wal"`
+	BackfillRate         float64                   `json:"backfill_rate"` // events per second replayed from disk, 0 for no limit
+	Aggregation          AggregationConfig         `json:"aggregation"`
+	IDCache              IDCacheConfig             `json:"id_cache"`
+}
+
+// SentryProject maps a Sentry project id onto an eventsum service, along with
+// the defaults applied to every event received for that project.
+type SentryProject struct {
+	Service               string              `json:"service"`
+	Environment           string              `json:"environment"`
+	ConfigurableFilters   map[string][]string `json:"configurable_filters"`
+	ConfigurableGroupings []string            `json:"configurable_groupings"`
+}
+
+// KafkaConfig configures the consumption of events from a Kafka topic. The
+// consumer is disabled unless both brokers and topic are set.
+type KafkaConfig struct {
+	Brokers     []string `json:"brokers"`
+	Topic       string   `json:"topic"`
+	Group       string   `json:"group"`
+	Parallelism int      `json:"parallelism"` // number of group members run by this server
+	Version     string   `json:"version"`     // version of the kafka brokers
+}
+
+func (k KafkaConfig) Enabled() bool {
+	return len(k.Brokers) > 0 && k.Topic != ""
+}
+
+// SyslogConfig configures the syslog listeners. Each listener is disabled while
+// its port is 0.
+type SyslogConfig struct {
+	UdpPort     int               `json:"udp_port"`
+	TcpPort     int               `json:"tcp_port"`
+	Environment string            `json:"environment"` // environment of every syslog event
+	Severities  []string          `json:"severities"`  // severities kept, e.g. "err", the others are dropped
+	Services    map[string]string `json:"services"`    // app-name to service, unmapped app-names are used as is
+}
+
+// OTLPConfig maps the resources of OTLP exports onto services and
+// environments.
+type OTLPConfig struct {
+	Services     map[string]string `json:"services"`     // service.name to service, unmapped names are used as is
+	Environments map[string]string `json:"environments"` // deployment.environment to environment, unmapped names are used as is
+}
+
+// DedupeConfig configures how long the ids of captured events are remembered,
+// so that events retried by clients are counted once.
+type DedupeConfig struct {
+	TTL      int  `json:"ttl"`      // in seconds, 0 disables deduplication
+	MaxKeys  int  `json:"max_keys"` // most ids kept in memory
+	Postgres bool `json:"postgres"` // also share ids between servers through the event_dedupe table
+}
+
+// Policies applied to timestamps too far from the time the event is received
+const (
+	TimestampAccept = "accept" // keep the timestamp
+	TimestampClamp  = "clamp"  // replace the timestamp by the receive time
+	TimestampReject = "reject" // reject the event
+)
+
+// TimestampConfig bounds how far event timestamps may be from the time the
+// server receives the events.
+type TimestampConfig struct {
+	MaxFuture int    `json:"max_future"` // in seconds
+	MaxPast   int    `json:"max_past"`   // in seconds
+	Policy    string `json:"policy"`     // applied to timestamps out of bounds
+}
+
+// QuotaConfig limits the events captured for each service and environment.
+// Events over a limit are acknowledged but dropped.
+type QuotaConfig struct {
+	Rate  float64 `json:"rate"`  // events per second, 0 for no rate limit
+	Burst int     `json:"burst"` // most events captured at once above the rate, defaults to the rate
+	Daily int64   `json:"daily"` // events per UTC day, 0 for no daily quota
+}
+
+// SamplingRule keeps a share of the events of a service, event type and event
+// name. Empty fields match any event. The counts of the events kept are
+// extrapolated, each of them being counted 1/rate times.
+type SamplingRule struct {
+	Service string  `json:"service"`
+	Type    string  `json:"event_type"`
+	Name    string  `json:"event_name"`
+	Rate    float64 `json:"rate"` // share of the events kept, in (0, 1]
+}
+
+// ScrubConfig configures the scrubbing of personal data and secrets out of
+// events before they are saved.
+type ScrubConfig struct {
+	Enabled     bool              `json:"enabled"`
+	Keys        []string          `json:"keys"`     // values under keys ending with any of these names, as whole words, are replaced, case insensitively
+	Values      []string          `json:"values"`   // built-in rules replacing matching values, e.g. "email"
+	Patterns    map[string]string `json:"patterns"` // more rules replacing the values matching a regex, by name
+	Replacement string            `json:"replacement"`
+}
+
+// LimitsConfig bounds the size of requests and of the events saved. Larger
+// requests are rejected, while larger events are truncated. 0 disables a limit.
+type LimitsConfig struct {
+	BodyBytes    int64 `json:"body_bytes"`    // in bytes, of request bodies as received, before decompression
+	Frames       int   `json:"frames"`        // frames kept at both the top and the bottom of a stack trace
+	FrameVars    int   `json:"frame_vars"`    // variables kept per frame
+	StringLength int   `json:"string_length"` // in bytes
+	Depth        int   `json:"depth"`         // of nested objects and arrays
+}
+
+// WALConfig configures the write-ahead log keeping captured events on disk
+// until they are saved. The WAL is disabled unless dir is set.
+type WALConfig struct {
+	Dir          string `json:"dir"`
+	SegmentBytes int64  `json:"segment_bytes"` // size of a segment file before a new one is started
+	SyncInterval int    `json:"sync_interval"` // in ms, time between two fsyncs of the segment written to
+}
+
+// AggregationConfig configures the counts of event instance periods kept in
+// memory across batches before being saved. Aggregation is disabled unless
+// flush_interval is set.
+type AggregationConfig struct {
+	FlushInterval int `json:"flush_interval"` // in seconds, time between two saves of the counts
+	MaxPeriods    int `json:"max_periods"`    // most periods kept in memory, saved directly once reached
+	Shards        int `json:"shards"`
+}
+
+// IDCacheConfig configures the caches of the ids of event bases, details and
+// instances, by hash. The caches are disabled unless size is set.
+type IDCacheConfig struct {
+	Size int `json:"size"` // most ids kept by each cache, the least recently used being evicted
+	TTL  int `json:"ttl"`  // in seconds, time an id is kept, 0 for no expiry
+}
+
+// RegistryConfig configures the registry of services, environments and
+// regions. The entries of the config are added to the registry at startup.
+type RegistryConfig struct {
+	Refresh      int  `json:"refresh"`       // in seconds, how often the registry is reloaded from the DB
+	AutoRegister bool `json:"auto_register"` // add the unknown services and environments of captured events
+}
+
+// AuthConfig configures the API keys required by the HTTP endpoints
+type AuthConfig struct {
+	Enabled            bool   `json:"enabled"`
+	ForceService       bool   `json:"force_service"`        // capture the events of a key scoped to a service under that service
+	CacheTTL           int    `json:"cache_ttl"`            // in seconds, how long keys are cached, and so how long revoked keys still work
+	BootstrapKeySHA256 string `json:"bootstrap_key_sha256"` // hex SHA-256 of a key with every capability, e.g. to issue the first keys
 }
 
 func DefaultConfig() EventsumConfig {
 	return EventsumConfig{
-		DataSourceInstance: "config/datasourceinstance.yaml",
-		DataSourceSchema:   "config/schema.json",
-		DatabaseName:       "eventsum",
-		LogConfigFile:      "config/logconfig.json",
-		BatchSize:          5,
-		TimeLimit:          5,
-		ServerPort:         8080,
-		TimeInterval:       15,
-		TimeFormat:         "2006-01-02 15:04:05",
-		Services:           map[string]map[string]int{},
-		Environments:       map[string]map[string]int{},
-		ServiceAggMapping:  map[string]string{},
-		RegionsMap:         map[string]int{},
-		Region:             "default",
-		DrainSecond:        0,
+		DataSourceInstance:   "config/datasourceinstance.yaml",
+		DataSourceSchema:     "config/schema.json",
+		DatabaseName:         "eventsum",
+		LogConfigFile:        "config/logconfig.json",
+		BatchSize:            5,
+		TimeLimit:            5,
+		IngestBufferSize:     1000,
+		IngestWait:           100,
+		RetryAfter:           1,
+		SaveWorkers:          4,
+		SaveQueueSize:        8,
+		ServerPort:           8080,
+		TimeInterval:         15,
+		TimeFormat:           "2006-01-02 15:04:05",
+		Services:             map[string]map[string]int{},
+		Environments:         map[string]map[string]int{},
+		ServiceAggMapping:    map[string]string{},
+		RegionsMap:           map[string]int{},
+		Region:               "default",
+		DrainSecond:          0,
+		MaxDecompressedBytes: 10 << 20,
+		SentryProjects:       map[string]SentryProject{},
+		Quotas:               map[string]QuotaConfig{},
+		DiscardLogSize:       100,
+		Kafka: KafkaConfig{
+			Group:       "eventsum",
+			Parallelism: 1,
+			Version:     "1.0.0",
+		},
+		Syslog: SyslogConfig{
+			Environment: "default",
+			Severities:  []string{"emerg", "alert", "crit", "err"},
+			Services:    map[string]string{},
+		},
+		OTLP: OTLPConfig{
+			Services:     map[string]string{},
+			Environments: map[string]string{},
+		},
+		Dedupe: DedupeConfig{
+			TTL:     600,
+			MaxKeys: 100000,
+		},
+		Timestamps: TimestampConfig{
+			MaxFuture: 300,
+			MaxPast:   7 * 24 * 3600,
+			Policy:    TimestampAccept,
+		},
+		Auth: AuthConfig{
+			CacheTTL: 60,
+		},
+		Registry: RegistryConfig{
+			Refresh: 60,
+		},
+		Scrub: ScrubConfig{
+			Keys: []string{"password", "passwd", "secret", "secret_key", "token", "authorization", "api_key",
+				"access_key", "cookie", "session", "credential", "credentials", "private_key"},
+			Values:      []string{"email", "credit_card", "jwt", "aws_access_key"},
+			Patterns:    map[string]string{},
+			Replacement: "[Filtered]",
+		},
+		BackfillRate: 1000,
+		WAL: WALConfig{
+			SegmentBytes: 64 << 20,
+			SyncInterval: 200,
+		},
+		Aggregation: AggregationConfig{
+			MaxPeriods: 100000,
+			Shards:     16,
+		},
+		IDCache: IDCacheConfig{
+			Size: 10000,
+			TTL:  600,
+		},
+		// event limits change the hashes of the events they cut, and so
+		// which bases new events are grouped under, so they are opt-in
+		Limits: LimitsConfig{
+			BodyBytes: 5 << 20,
+		},
 	}
 }
 
@@ -59,7 +286,7 @@ func ParseEventsumConfig(file string, region string) (EventsumConfig, error) {
 	configuration := DefaultConfig()
 	f, err := os.Open(file)
 	if err != nil {
-		return configuration, fmt.Errorf("Error", err)
+		return configuration, fmt.Errorf("Error: %s", err)
 	}
 	defer f.Close()
 	decoder := json.NewDecoder(f)
@@ -73,6 +300,55 @@ func ParseEventsumConfig(file string, region string) (EventsumConfig, error) {
 		configuration.Region = region
 	}
 
+	switch configuration.Timestamps.Policy {
+	case TimestampAccept, TimestampClamp, TimestampReject:
+	default:
+		return configuration, fmt.Errorf("error: unknown timestamp policy '%s'", configuration.Timestamps.Policy)
+	}
+
+	for key, quota := range configuration.Quotas {
+		if quota.Rate < 0 || quota.Burst < 0 || quota.Daily < 0 {
+			return configuration, fmt.Errorf("error: negative limit in quota '%s'", key)
+		}
+	}
+
+	for i, rule := range configuration.Sampling {
+		if rule.Rate <= 0 || rule.Rate > 1 {
+			return configuration, fmt.Errorf("error: sample rate of rule %d is not in (0, 1]", i)
+		}
+	}
+
+	if l := configuration.Limits; l.BodyBytes < 0 || l.Frames < 0 || l.FrameVars < 0 || l.StringLength < 0 || l.Depth < 0 {
+		return configuration, fmt.Errorf("error: negative limit in limits")
+	}
+
+	if configuration.SaveWorkers < 0 || configuration.SaveQueueSize < 0 {
+		return configuration, fmt.Errorf("error: negative save_workers or save_queue_size")
+	}
+
+	if configuration.BackfillRate < 0 {
+		return configuration, fmt.Errorf("error: negative backfill_rate")
+	}
+
+	if w := configuration.WAL; w.Dir != "" && (w.SegmentBytes <= 0 || w.SyncInterval <= 0) {
+		return configuration, fmt.Errorf("error: wal segment_bytes and sync_interval must be positive")
+	}
+
+	if a := configuration.Aggregation; a.FlushInterval < 0 || (a.FlushInterval > 0 && (a.MaxPeriods <= 0 || a.Shards <= 0)) {
+		return configuration, fmt.Errorf("error: aggregation flush_interval is negative, or max_periods and shards are not positive")
+	}
+
+	if configuration.IDCache.Size < 0 || configuration.IDCache.TTL < 0 {
+		return configuration, fmt.Errorf("error: negative id_cache size or ttl")
+	}
+
+	if configuration.Auth.CacheTTL < 0 {
+		return configuration, fmt.Errorf("error: negative auth cache_ttl %d", configuration.Auth.CacheTTL)
+	}
+	if h := configuration.Auth.BootstrapKeySHA256; h != "" && len(h) != 64 {
+		return configuration, fmt.Errorf("error: auth bootstrap_key_sha256 is not a hex SHA-256")
+	}
+
 	return configuration, nil
 }
 
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/util"
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+const apiKeyColumns = "_id, prefix, COALESCE(service, ''), capabilities, COALESCE(description, ''), created_at, revoked_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	var key APIKey
+	var capabilities []byte
+	err := row.Scan(&key.Id, &key.Prefix, &key.Service, &capabilities, &key.Description, &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		return key, err
+	}
+	if err := json.Unmarshal(capabilities, &key.Capabilities); err != nil {
+		return key, errors.Wrap(err, "decoding API key capabilities")
+	}
+	return key, nil
+}
+
+// Stores a new key under its hash
+func (p *postgresStore) AddAPIKey(key APIKey, hash string) (APIKey, error) {
+	var service interface{}
+	if key.Service != "" {
+		service = key.Service
+	}
+	row := p.DB.QueryRow("INSERT INTO api_key (key_hash, prefix, service, capabilities, description) "+
+		"VALUES ($1, $2, $3, $4, $5) RETURNING "+apiKeyColumns,
+		hash, key.Prefix, service, util.EncodeToJsonRawMsg(key.Capabilities), key.Description)
+	added, err := scanAPIKey(row)
+	if err != nil {
+		metrics.DBError("write")
+	}
+	return added, err
+}
+
+// Finds a key by its hash, revoked or not
+func (p *postgresStore) FindAPIKey(hash string) (APIKey, error) {
+	key, err := scanAPIKey(p.DB.QueryRow("SELECT "+apiKeyColumns+" FROM api_key WHERE key_hash = $1", hash))
+	if err == sql.ErrNoRows {
+		return key, ErrAPIKeyNotFound
+	} else if err != nil {
+		metrics.DBError("read")
+	}
+	return key, err
+}
+
+// Lists the keys, revoked ones included, by id
+func (p *postgresStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := p.DB.Query("SELECT " + apiKeyColumns + " FROM api_key ORDER BY _id")
+	if err != nil {
+		metrics.DBError("read")
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			metrics.DBError("read")
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (p *postgresStore) RevokeAPIKey(id int) (APIKey, error) {
+	key, err := scanAPIKey(p.DB.QueryRow("UPDATE api_key SET revoked_at = COALESCE(revoked_at, now()) WHERE _id = $1 RETURNING "+apiKeyColumns, id))
+	if err == sql.ErrNoRows {
+		return key, ErrAPIKeyNotFound
+	} else if err != nil {
+		metrics.DBError("write")
+	}
+	return key, err
+}
@@ -83,6 +83,19 @@ type DataStore interface {
 	AddEventDetails(evtDetail EventDetail) (int64, error)
 	UpdateEventInstancePeriod(evt EventInstancePeriod) error
 	AddEventInstancePeriods(evt EventInstancePeriod) error
+	UpsertEventInstancePeriods(evts []EventInstancePeriod) error
+	AddEventKey(key string, now, expiresAt time.Time) (bool, error)
+	DeleteEventKey(key string) error
+	DeleteExpiredEventKeys(now time.Time) error
+	ListRegistryEntries(kind string) ([]RegistryEntry, error)
+	AddRegistryEntry(kind string, name string) (RegistryEntry, error)
+	RenameRegistryEntry(kind string, id int, name string) (RegistryEntry, error)
+	RetireRegistryEntry(kind string, id int) (RegistryEntry, error)
+	RefreshRegistry() error
+	AddAPIKey(key APIKey, hash string) (APIKey, error)
+	FindAPIKey(hash string) (APIKey, error)
+	ListAPIKeys() ([]APIKey, error)
+	RevokeAPIKey(id int) (APIKey, error)
 	Test(from string, to string, evtId int) (DataPointArrays, error)
 }
 
@@ -93,13 +106,9 @@ type postgresStore struct {
 	DB       *sql.DB
 
 	// Variables stored in memory (for faster access)
-	Services            []EventService
-	ServiceAggMap       map[string]string
-	ServicesNameMap     map[string]EventService
-	Environments        []EventEnvironment
-	EnvironmentsNameMap map[string]EventEnvironment
-	RegionsMap          map[string]int
-	Region              int
+	ServiceAggMap map[string]string
+	registry      *registry // services, environments and regions
+	Region        int
 }
 
 // Create a new dataStore
@@ -131,22 +140,17 @@ func NewDataStore(c config.EventsumConfig) (*postgresStore, error) {
 		return nil, err
 	}
 
-	// build services and environment variables from config file
-	services := []EventService{}
-	servicesNameMap := make(map[string]EventService)
+	// build services and environment variables from config file, they seed
+	// the registry
+	services := make(map[string]int)
 	serviceAggMap := make(map[string]string)
-	environments := []EventEnvironment{}
-	environmentsNameMap := make(map[string]EventEnvironment)
+	environments := make(map[string]int)
 
 	for k, v := range c.Services {
-		service := EventService{Id: v["service_id"], Name: k}
-		services = append(services, service)
-		servicesNameMap[k] = service
+		services[k] = v["service_id"]
 	}
 	for k, v := range c.Environments {
-		environment := EventEnvironment{Id: v["environment_id"], Name: k}
-		environments = append(environments, environment)
-		environmentsNameMap[k] = environment
+		environments[k] = v["environment_id"]
 	}
 	// Override the service with rpc exception to the *_rpc suffix service name
 	for k, v := range c.ServiceAggMapping {
@@ -166,19 +170,17 @@ func NewDataStore(c config.EventsumConfig) (*postgresStore, error) {
 	regionID := c.RegionsMap[c.Region]
 
 	client := &datamanclient.Client{Transport: transport}
-	return &postgresStore{
-		Name:                c.DatabaseName,
-		Client:              client,
-		DBConfig:            storagenodeConfig,
-		Services:            services,
-		ServicesNameMap:     servicesNameMap,
-		Environments:        environments,
-		EnvironmentsNameMap: environmentsNameMap,
-		ServiceAggMap:       serviceAggMap,
-		DB:                  db,
-		Region:              regionID,
-		RegionsMap:          c.RegionsMap,
-	}, nil
+	p := &postgresStore{
+		Name:          c.DatabaseName,
+		Client:        client,
+		DBConfig:      storagenodeConfig,
+		ServiceAggMap: serviceAggMap,
+		registry:      newRegistry(services, environments, c.RegionsMap),
+		DB:            db,
+		Region:        regionID,
+	}
+	go p.refreshRegistry(time.Duration(c.Registry.Refresh) * time.Second)
+	return p, nil
 }
 
 func (p *postgresStore) Query(typ query.QueryType,
@@ -361,30 +363,10 @@ func (p *postgresStore) AddEventDetail(evt *EventDetail) error {
 	return err
 }
 
-func (p *postgresStore) GetServices() []EventService {
-	return p.Services
-}
-
-func (p *postgresStore) GetEnvironments() []EventEnvironment {
-	return p.Environments
-}
-
-func (p *postgresStore) GetServicesMap() map[string]EventService {
-	return p.ServicesNameMap
-}
-
-func (p *postgresStore) GetEnvironmentsMap() map[string]EventEnvironment {
-	return p.EnvironmentsNameMap
-}
-
 func (p *postgresStore) GetServicesAggMap() map[string]string {
 	return p.ServiceAggMap
 }
 
-func (p *postgresStore) GetRegionsMap() map[string]int {
-	return p.RegionsMap
-}
-
 // Return all event group ids that appear in event_base
 func (p *postgresStore) GetGroups() ([]EventGroup, error) {
 
@@ -1478,9 +1460,9 @@ func (p *postgresStore) UpdateEventInstance(evt EventInstance, targetId int64) e
 func (p *postgresStore) AddInstanceEvent(evt EventInstance) (int64, error) {
 	var id int64
 	row := p.DB.QueryRow("INSERT INTO event_instance "+
-		"(event_base_id, event_detail_id, event_environment_id, raw_data, generic_data, generic_data_hash, event_message, created_at) "+
-		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING _id",
-		evt.EventBaseId, evt.EventDetailId, evt.EventEnvironmentId, util.EncodeToJsonRawMsg(evt.RawData), util.EncodeToJsonRawMsg(evt.GenericData), evt.GenericDataHash, evt.EventMessage, evt.CreatedAt)
+		"(event_base_id, event_detail_id, event_environment_id, raw_data, generic_data, generic_data_hash, event_message, created_at, received_at, scrubbed) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING _id",
+		evt.EventBaseId, evt.EventDetailId, evt.EventEnvironmentId, util.EncodeToJsonRawMsg(evt.RawData), util.EncodeToJsonRawMsg(evt.GenericData), evt.GenericDataHash, evt.EventMessage, evt.CreatedAt, evt.ReceivedAt, util.EncodeToJsonRawMsg(evt.Scrubbed))
 	err := row.Scan(&id)
 	if err != nil {
 		return -1, err
@@ -1490,8 +1472,8 @@ func (p *postgresStore) AddInstanceEvent(evt EventInstance) (int64, error) {
 
 func (p *postgresStore) UpdateEventInstancePeriod(evt EventInstancePeriod) error {
 	var id int64
-	row := p.DB.QueryRow("UPDATE event_instance_period SET count = count + $1 WHERE event_instance_id = $2 AND start_time = $3 AND end_time = $4 AND region_id = $5 RETURNING _id",
-		evt.Count, evt.EventInstanceId, evt.StartTime, evt.EndTime, p.Region)
+	row := p.DB.QueryRow("UPDATE event_instance_period SET count = count + $1, extrapolated = extrapolated OR $6 WHERE event_instance_id = $2 AND start_time = $3 AND end_time = $4 AND region_id = $5 RETURNING _id",
+		evt.Count, evt.EventInstanceId, evt.StartTime, evt.EndTime, p.Region, evt.Extrapolated)
 	err := row.Scan(&id)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1505,11 +1487,89 @@ func (p *postgresStore) UpdateEventInstancePeriod(evt EventInstancePeriod) error
 
 func (p *postgresStore) AddEventInstancePeriods(evt EventInstancePeriod) error {
 	var id int64
-	row := p.DB.QueryRow("INSERT INTO event_instance_period (event_instance_id, start_time, end_time, updated, count, region_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING _id",
-		evt.EventInstanceId, evt.StartTime, evt.EndTime, evt.Updated, evt.Count, p.Region)
+	row := p.DB.QueryRow("INSERT INTO event_instance_period (event_instance_id, start_time, end_time, updated, count, region_id, extrapolated) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING _id",
+		evt.EventInstanceId, evt.StartTime, evt.EndTime, evt.Updated, evt.Count, p.Region, evt.Extrapolated)
 	err := row.Scan(&id)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Rows of event_instance_period upserted by a single statement, below the
+// limit of 65535 parameters
+const upsertPeriodsChunk = 1000
+
+// Adds the counts of periods to their rows, creating the rows missing, in a
+// single transaction. A period must not appear twice in evts.
+func (p *postgresStore) UpsertEventInstancePeriods(evts []EventInstancePeriod) error {
+	if len(evts) == 0 {
+		return nil
+	}
+	tx, err := p.DB.Begin()
+	if err != nil {
+		metrics.DBError("write")
+		return err
+	}
+	for len(evts) > 0 {
+		n := upsertPeriodsChunk
+		if n > len(evts) {
+			n = len(evts)
+		}
+		values := make([]string, 0, n)
+		args := make([]interface{}, 0, 7*n)
+		for i, evt := range evts[:n] {
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", 7*i+1, 7*i+2, 7*i+3, 7*i+4, 7*i+5, 7*i+6, 7*i+7))
+			args = append(args, evt.EventInstanceId, evt.StartTime, evt.EndTime, evt.Updated, evt.Count, p.Region, evt.Extrapolated)
+		}
+		_, err := tx.Exec("INSERT INTO event_instance_period (event_instance_id, start_time, end_time, updated, count, region_id, extrapolated) VALUES "+
+			strings.Join(values, ", ")+" ON CONFLICT (event_instance_id, start_time, end_time, region_id) DO UPDATE SET "+
+			"count = event_instance_period.count + EXCLUDED.count, updated = GREATEST(event_instance_period.updated, EXCLUDED.updated), "+
+			"extrapolated = event_instance_period.extrapolated OR EXCLUDED.extrapolated", args...)
+		if err != nil {
+			tx.Rollback()
+			metrics.DBError("write")
+			return err
+		}
+		evts = evts[n:]
+	}
+	if err := tx.Commit(); err != nil {
+		metrics.DBError("write")
+		return err
+	}
+	return nil
+}
+
+// Records the id of a captured event until it expires. Returns false if the
+// id is already recorded and has not expired yet.
+func (p *postgresStore) AddEventKey(key string, now, expiresAt time.Time) (bool, error) {
+	var added string
+	row := p.DB.QueryRow("INSERT INTO event_dedupe (key, expires_at) VALUES ($1, $2) "+
+		"ON CONFLICT (key) DO UPDATE SET expires_at = EXCLUDED.expires_at WHERE event_dedupe.expires_at <= $3 RETURNING key",
+		key, expiresAt, now)
+	err := row.Scan(&added)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		metrics.DBError("write")
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *postgresStore) DeleteEventKey(key string) error {
+	_, err := p.DB.Exec("DELETE FROM event_dedupe WHERE key = $1", key)
+	if err != nil {
+		metrics.DBError("write")
+	}
+	return err
+}
+
+func (p *postgresStore) DeleteExpiredEventKeys(now time.Time) error {
+	_, err := p.DB.Exec("DELETE FROM event_dedupe WHERE expires_at <= $1", now)
+	if err != nil {
+		metrics.DBError("write")
+	}
+	return err
+}
@@ -0,0 +1,293 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Kinds of registry entries
+const (
+	RegistryServices     = "services"
+	RegistryEnvironments = "environments"
+	RegistryRegions      = "regions"
+)
+
+var (
+	ErrUnknownRegistryKind   = errors.New("unknown registry kind")
+	ErrRegistryEntryExists   = errors.New("registry entry already exists")
+	ErrRegistryEntryNotFound = errors.New("registry entry not found")
+)
+
+// Tables of the registry entries, by kind
+var registryTables = map[string]string{
+	RegistryServices:     "service",
+	RegistryEnvironments: "environment",
+	RegistryRegions:      "region",
+}
+
+// registry caches the active services, environments and regions of the
+// service, environment and region tables. Until it is first loaded, or if the
+// DB cannot be reached, it holds the entries of the config.
+type registry struct {
+	sync.RWMutex
+	services        []EventService
+	servicesMap     map[string]EventService
+	environments    []EventEnvironment
+	environmentsMap map[string]EventEnvironment
+	regionsMap      map[string]int
+
+	refreshing sync.Mutex
+	seed       map[string]map[string]int // entries of the config, by kind
+	seeded     bool
+}
+
+func newRegistry(services, environments, regions map[string]int) *registry {
+	r := &registry{seed: map[string]map[string]int{
+		RegistryServices:     services,
+		RegistryEnvironments: environments,
+		RegistryRegions:      regions,
+	}}
+	r.set(entries(services), entries(environments), entries(regions))
+	return r
+}
+
+// Lists entries given by name and id, e.g. those of the config
+func entries(ids map[string]int) []RegistryEntry {
+	list := make([]RegistryEntry, 0, len(ids))
+	for name, id := range ids {
+		list = append(list, RegistryEntry{Id: id, Name: name})
+	}
+	return list
+}
+
+// Replaces the cached entries by the active ones of the lists
+func (r *registry) set(services, environments, regions []RegistryEntry) {
+	servicesList := []EventService{}
+	servicesMap := make(map[string]EventService)
+	for _, e := range services {
+		if e.RetiredAt == nil {
+			service := EventService{Id: e.Id, Name: e.Name}
+			servicesList = append(servicesList, service)
+			servicesMap[e.Name] = service
+		}
+	}
+	environmentsList := []EventEnvironment{}
+	environmentsMap := make(map[string]EventEnvironment)
+	for _, e := range environments {
+		if e.RetiredAt == nil {
+			environment := EventEnvironment{Id: e.Id, Name: e.Name}
+			environmentsList = append(environmentsList, environment)
+			environmentsMap[e.Name] = environment
+		}
+	}
+	regionsMap := make(map[string]int)
+	for _, e := range regions {
+		if e.RetiredAt == nil {
+			regionsMap[e.Name] = e.Id
+		}
+	}
+	sort.Slice(servicesList, func(i, j int) bool { return servicesList[i].Name < servicesList[j].Name })
+	sort.Slice(environmentsList, func(i, j int) bool { return environmentsList[i].Name < environmentsList[j].Name })
+
+	// the maps are replaced rather than updated, so that callers can keep
+	// reading the ones they got
+	r.Lock()
+	defer r.Unlock()
+	r.services, r.servicesMap = servicesList, servicesMap
+	r.environments, r.environmentsMap = environmentsList, environmentsMap
+	r.regionsMap = regionsMap
+}
+
+func (r *registry) getServices() []EventService {
+	r.RLock()
+	defer r.RUnlock()
+	return r.services
+}
+
+func (r *registry) getServicesMap() map[string]EventService {
+	r.RLock()
+	defer r.RUnlock()
+	return r.servicesMap
+}
+
+func (r *registry) getEnvironments() []EventEnvironment {
+	r.RLock()
+	defer r.RUnlock()
+	return r.environments
+}
+
+func (r *registry) getEnvironmentsMap() map[string]EventEnvironment {
+	r.RLock()
+	defer r.RUnlock()
+	return r.environmentsMap
+}
+
+func (r *registry) getRegionsMap() map[string]int {
+	r.RLock()
+	defer r.RUnlock()
+	return r.regionsMap
+}
+
+func (p *postgresStore) GetServices() []EventService {
+	return p.registry.getServices()
+}
+
+func (p *postgresStore) GetEnvironments() []EventEnvironment {
+	return p.registry.getEnvironments()
+}
+
+func (p *postgresStore) GetServicesMap() map[string]EventService {
+	return p.registry.getServicesMap()
+}
+
+func (p *postgresStore) GetEnvironmentsMap() map[string]EventEnvironment {
+	return p.registry.getEnvironmentsMap()
+}
+
+func (p *postgresStore) GetRegionsMap() map[string]int {
+	return p.registry.getRegionsMap()
+}
+
+// Reloads the registry periodically
+func (p *postgresStore) refreshRegistry(interval time.Duration) {
+	p.RefreshRegistry()
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.RefreshRegistry()
+	}
+}
+
+// Reloads the registry from the DB, after adding the entries of the config
+// to it the first time
+func (p *postgresStore) RefreshRegistry() error {
+	p.registry.refreshing.Lock()
+	defer p.registry.refreshing.Unlock()
+
+	if !p.registry.seeded {
+		if err := p.seedRegistry(); err != nil {
+			return err
+		}
+		p.registry.seeded = true
+	}
+	services, err := p.ListRegistryEntries(RegistryServices)
+	if err != nil {
+		return err
+	}
+	environments, err := p.ListRegistryEntries(RegistryEnvironments)
+	if err != nil {
+		return err
+	}
+	regions, err := p.ListRegistryEntries(RegistryRegions)
+	if err != nil {
+		return err
+	}
+	p.registry.set(services, environments, regions)
+	return nil
+}
+
+// Adds the entries of the config to the registry, keeping their ids. Entries
+// already in the registry, even retired, are left as they are.
+func (p *postgresStore) seedRegistry() error {
+	for kind, ids := range p.registry.seed {
+		table := registryTables[kind]
+		for name, id := range ids {
+			_, err := p.DB.Exec(fmt.Sprintf("INSERT INTO %s (_id, name) VALUES ($1, $2) ON CONFLICT DO NOTHING", table), id, name)
+			if err != nil {
+				metrics.DBError("write")
+				return errors.Wrapf(err, "adding %s '%s' to the registry", table, name)
+			}
+		}
+		// ids of new entries follow the ids of the config
+		_, err := p.DB.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', '_id'), GREATEST((SELECT MAX(_id) FROM %[1]s), 1))", table))
+		if err != nil {
+			metrics.DBError("write")
+			return errors.Wrapf(err, "updating the ids of %s", table)
+		}
+	}
+	return nil
+}
+
+// Lists the entries of a kind, retired ones included, by id
+func (p *postgresStore) ListRegistryEntries(kind string) ([]RegistryEntry, error) {
+	table, ok := registryTables[kind]
+	if !ok {
+		return nil, ErrUnknownRegistryKind
+	}
+	rows, err := p.DB.Query(fmt.Sprintf("SELECT _id, name, created_at, retired_at FROM %s ORDER BY _id", table))
+	if err != nil {
+		metrics.DBError("read")
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []RegistryEntry{}
+	for rows.Next() {
+		var e RegistryEntry
+		if err := rows.Scan(&e.Id, &e.Name, &e.CreatedAt, &e.RetiredAt); err != nil {
+			metrics.DBError("read")
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+func (p *postgresStore) AddRegistryEntry(kind string, name string) (RegistryEntry, error) {
+	table, ok := registryTables[kind]
+	if !ok {
+		return RegistryEntry{}, ErrUnknownRegistryKind
+	}
+	row := p.DB.QueryRow(fmt.Sprintf("INSERT INTO %s (name) VALUES ($1) RETURNING _id, name, created_at, retired_at", table), name)
+	return p.registryEntryChanged(row)
+}
+
+func (p *postgresStore) RenameRegistryEntry(kind string, id int, name string) (RegistryEntry, error) {
+	table, ok := registryTables[kind]
+	if !ok {
+		return RegistryEntry{}, ErrUnknownRegistryKind
+	}
+	row := p.DB.QueryRow(fmt.Sprintf("UPDATE %s SET name = $1 WHERE _id = $2 RETURNING _id, name, created_at, retired_at", table), name, id)
+	return p.registryEntryChanged(row)
+}
+
+// Retires an entry, so that events are no longer captured under it
+func (p *postgresStore) RetireRegistryEntry(kind string, id int) (RegistryEntry, error) {
+	table, ok := registryTables[kind]
+	if !ok {
+		return RegistryEntry{}, ErrUnknownRegistryKind
+	}
+	row := p.DB.QueryRow(fmt.Sprintf("UPDATE %s SET retired_at = COALESCE(retired_at, now()) WHERE _id = $1 RETURNING _id, name, created_at, retired_at", table), id)
+	return p.registryEntryChanged(row)
+}
+
+// Scans the entry returned by a change of the registry, and reloads the
+// registry so that the change applies right away on this server
+func (p *postgresStore) registryEntryChanged(row *sql.Row) (RegistryEntry, error) {
+	var e RegistryEntry
+	if err := row.Scan(&e.Id, &e.Name, &e.CreatedAt, &e.RetiredAt); err != nil {
+		if err == sql.ErrNoRows {
+			return e, ErrRegistryEntryNotFound
+		}
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+			return e, ErrRegistryEntryExists
+		}
+		metrics.DBError("write")
+		return e, err
+	}
+	// the registry is reloaded periodically anyway if this fails
+	p.RefreshRegistry()
+	return e, nil
+}
@@ -0,0 +1,130 @@
+package eventsum
+
+import (
+	"sync"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/datastore"
+	"github.com/ContextLogic/eventsum/log"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// dedupeStore remembers the ids of the events captured within a TTL, so that
+// events retried by clients are acknowledged but counted once. Ids are kept in
+// memory, and optionally in postgres to be shared between servers.
+type dedupeStore struct {
+	sync.Mutex
+	ttl      time.Duration
+	maxKeys  int
+	expiries map[string]time.Time
+	keys     []dedupeKey         // in order of expiry, as every key has the same TTL
+	ds       datastore.DataStore // nil unless ids are shared through postgres
+	log      *log.Logger
+
+	lastCleanup time.Time // of the expired ids in postgres
+}
+
+type dedupeKey struct {
+	key       string
+	expiresAt time.Time
+}
+
+// Returns nil if deduplication is disabled
+func newDedupeStore(config conf.DedupeConfig, ds datastore.DataStore, log *log.Logger) *dedupeStore {
+	if config.TTL <= 0 {
+		return nil
+	}
+	d := &dedupeStore{
+		ttl:      time.Duration(config.TTL) * time.Second,
+		maxKeys:  config.MaxKeys,
+		expiries: make(map[string]time.Time),
+		log:      log,
+	}
+	if config.Postgres {
+		d.ds = ds
+	}
+	return d
+}
+
+// Returns the dedupe key of an event, or "" if it has no id. Ids are only
+// unique within a service.
+func dedupeKeyOf(evt UnaddedEvent) string {
+	if evt.EventId == "" {
+		return ""
+	}
+	return evt.Service + "/" + evt.EventId
+}
+
+// Records the key, and returns true if it was already recorded within the TTL.
+// Postgres errors are logged, and the key is then considered new, as counting
+// an event twice is better than losing it.
+func (d *dedupeStore) seen(key string, now time.Time) bool {
+	d.Lock()
+	d.expire(now)
+	if _, ok := d.expiries[key]; ok {
+		d.Unlock()
+		metrics.DedupeHit("memory")
+		return true
+	}
+	expiresAt := now.Add(d.ttl)
+	d.expiries[key] = expiresAt
+	d.keys = append(d.keys, dedupeKey{key, expiresAt})
+	cleanup := d.ds != nil && now.Sub(d.lastCleanup) > d.ttl
+	if cleanup {
+		d.lastCleanup = now
+	}
+	d.Unlock()
+
+	if d.ds == nil {
+		return false
+	}
+	if cleanup {
+		go func() {
+			if err := d.ds.DeleteExpiredEventKeys(now); err != nil {
+				d.log.App().Errorf("Error deleting expired event ids: %v", err)
+			}
+		}()
+	}
+	added, err := d.ds.AddEventKey(key, now, expiresAt)
+	if err != nil {
+		d.log.App().Errorf("Error recording event id %s: %v", key, err)
+		return false
+	}
+	if !added {
+		metrics.DedupeHit("postgres")
+	}
+	return !added
+}
+
+// Forgets a key, so that the event can be captured again, e.g. after it was
+// rejected
+func (d *dedupeStore) forget(key string) {
+	d.Lock()
+	delete(d.expiries, key)
+	d.Unlock()
+
+	if d.ds != nil {
+		if err := d.ds.DeleteEventKey(key); err != nil {
+			d.log.App().Errorf("Error deleting event id %s: %v", key, err)
+		}
+	}
+}
+
+// Drops the expired keys, and the oldest ones beyond the most kept in memory.
+// Must be called with the lock held.
+func (d *dedupeStore) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.keys); i++ {
+		k := d.keys[i]
+		if k.expiresAt.After(now) && (d.maxKeys <= 0 || len(d.keys)-i < d.maxKeys) {
+			break
+		}
+		// a forgotten key may have been recorded again since
+		if d.expiries[k.key].Equal(k.expiresAt) {
+			delete(d.expiries, k.key)
+		}
+	}
+	d.keys = d.keys[i:]
+}
@@ -0,0 +1,79 @@
+package eventsum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+func TestDedupeStore(t *testing.T) {
+	d := newDedupeStore(conf.DedupeConfig{TTL: 60, MaxKeys: 2}, nil, nil)
+	now := time.Now()
+
+	if d.seen("wish_be/a", now) || !d.seen("wish_be/a", now.Add(time.Second)) {
+		t.Errorf("expected the second capture of a to be a duplicate")
+	}
+	if d.seen("wish_be/a", now.Add(61*time.Second)) {
+		t.Errorf("expected a to expire after the TTL")
+	}
+
+	// only the 2 most recent keys are kept
+	d.seen("wish_be/b", now.Add(62*time.Second))
+	d.seen("wish_be/c", now.Add(63*time.Second))
+	if d.seen("wish_be/a", now.Add(64*time.Second)) {
+		t.Errorf("expected a to be dropped beyond the most kept keys")
+	}
+
+	d.forget("wish_be/c")
+	if d.seen("wish_be/c", now.Add(65*time.Second)) {
+		t.Errorf("expected a forgotten key to be new")
+	}
+
+	if newDedupeStore(conf.DedupeConfig{TTL: 0}, nil, nil) != nil {
+		t.Errorf("expected a TTL of 0 to disable deduplication")
+	}
+}
+
+func TestCaptureIdempotencyKey(t *testing.T) {
+	es := newTestEventStore(2)
+	es.dedupe = newDedupeStore(conf.DefaultConfig().Dedupe, nil, nil)
+	h := newHTTPHandler(es, newTestLogger(t), conf.DefaultConfig())
+	evt := `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`
+
+	capture := func(key string) int {
+		r := httptest.NewRequest("POST", "/capture", strings.NewReader(evt))
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.captureEventsHandler(w, r, nil)
+		return w.Code
+	}
+
+	for _, key := range []string{"a", "a", "b"} {
+		if code := capture(key); code != http.StatusOK {
+			t.Errorf("%s: expected a 200, got %d", key, code)
+		}
+	}
+	if len(es.channel.queue) != 2 {
+		t.Fatalf("expected the retried event to be queued once, got %d events", len(es.channel.queue))
+	}
+	if queued := <-es.channel.queue; queued.EventId != "a" {
+		t.Errorf("expected the key to become the event id, got %q", queued.EventId)
+	}
+
+	// an event rejected because the queue is full can be retried
+	es.channel.queue <- UnaddedEvent{}
+	if code := capture("c"); code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429, got %d", code)
+	}
+	<-es.channel.queue
+	if code := capture("c"); code != http.StatusOK || len(es.channel.queue) != 2 {
+		t.Errorf("expected the retried event to be queued, got %d", code)
+	}
+}
@@ -0,0 +1,156 @@
+package eventsum
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/datastore"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Reasons an event is rejected at capture, or discarded before being saved
+const (
+	reasonUnknownService      = "unknown_service"
+	reasonUnknownEnvironment  = "unknown_environment"
+	reasonUnknownAggregation  = "unknown_service_aggregation"
+	reasonInstanceFilter      = "instance_filter"
+	reasonGenericData         = "generic_data"
+	reasonBaseFilter          = "base_filter"
+	reasonExtraArgsFilter     = "extra_args_filter"
+	reasonThrottled           = "throttled"
+	reasonTimestampOutOfRange = "timestamp_out_of_range"
+	reasonInvalidTimestamp    = "invalid_timestamp"
+	reasonUnprocessable       = "unprocessable" // any other unprocessable event
+)
+
+// unprocessableError is the error of a well formed event that cannot be
+// summarized, e.g. because its service is unknown. It is rejected with a 422.
+type unprocessableError struct {
+	reason string
+	err    error
+}
+
+func (e *unprocessableError) Error() string {
+	return e.err.Error()
+}
+
+// Returns the reason an event is discarded for, given the error it got
+func discardReason(err error) string {
+	if ue, ok := err.(*unprocessableError); ok {
+		return ue.reason
+	}
+	return reasonUnprocessable
+}
+
+// Returns the status of a response rejecting an invalid event
+func validationStatus(err error) int {
+	if _, ok := err.(*unprocessableError); ok {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadRequest
+}
+
+// Finds the service and environment of an event. RPC exceptions are counted
+// under the service they aggregate to, e.g. merchant_be -> merchant_be_rpc, so
+// the name of that service is returned too. Unknown services and environments
+// are registered if auto-register is on.
+func (es *eventStore) findServiceEnvironment(evt UnaddedEvent) (string, EventService, EventEnvironment, error) {
+	service, ok := es.GetServiceAggregationMapping(evt)
+	if !ok {
+		return "", EventService{}, EventEnvironment{}, &unprocessableError{reasonUnknownAggregation,
+			errors.Errorf("no service aggregation mapping for RPC exceptions of service '%s'", evt.Service)}
+	}
+	serviceId, ok := es.ds.GetServicesMap()[service]
+	if !ok && es.autoRegister {
+		serviceId.Name = service
+		serviceId.Id, ok = es.register(datastore.RegistryServices, service)
+	}
+	if !ok {
+		return "", EventService{}, EventEnvironment{}, &unprocessableError{reasonUnknownService,
+			errors.Errorf("unknown service '%s'", service)}
+	}
+	environmentId, ok := es.ds.GetEnvironmentsMap()[evt.Environment]
+	if !ok && es.autoRegister {
+		environmentId.Name = evt.Environment
+		environmentId.Id, ok = es.register(datastore.RegistryEnvironments, evt.Environment)
+	}
+	if !ok {
+		return "", EventService{}, EventEnvironment{}, &unprocessableError{reasonUnknownEnvironment,
+			errors.Errorf("unknown environment '%s'", evt.Environment)}
+	}
+	return service, serviceId, environmentId, nil
+}
+
+// Records an event accepted at capture but discarded before being saved
+func (es *eventStore) discard(evt UnaddedEvent, reason string, err error) {
+	metrics.EventDiscarded(reason)
+	es.discarded.add(DiscardedEvent{
+		Event:       evt,
+		Reason:      reason,
+		Error:       err.Error(),
+		DiscardedAt: time.Now().UTC(),
+	})
+}
+
+// discardLog keeps the last discarded events in a ring buffer
+type discardLog struct {
+	sync.Mutex
+	events []DiscardedEvent
+	next   int // index of the next event to overwrite, once the buffer is full
+	size   int
+}
+
+func newDiscardLog(size int) *discardLog {
+	return &discardLog{size: size}
+}
+
+func (d *discardLog) add(evt DiscardedEvent) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.size <= 0 {
+		return
+	}
+	if len(d.events) < d.size {
+		d.events = append(d.events, evt)
+		return
+	}
+	d.events[d.next] = evt
+	d.next = (d.next + 1) % d.size
+}
+
+// Returns up to limit events, the most recently discarded first
+func (d *discardLog) last(limit int) []DiscardedEvent {
+	d.Lock()
+	defer d.Unlock()
+
+	if limit <= 0 || limit > len(d.events) {
+		limit = len(d.events)
+	}
+	events := make([]DiscardedEvent, 0, limit)
+	for i := 0; i < limit; i++ {
+		// the newest event is right before the next one to overwrite
+		j := (d.next - 1 - i + 2*len(d.events)) % len(d.events)
+		events = append(events, d.events[j])
+	}
+	return events
+}
+
+// Lists the last discarded events, up to the `limit` query parameter
+func (h *httpHandler) discardedEventsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit := 0
+	if str := r.URL.Query().Get("limit"); str != "" {
+		var err error
+		if limit, err = strconv.Atoi(str); err != nil || limit < 0 {
+			h.sendError(w, http.StatusBadRequest, errors.New("limit must be a positive int"), "Error")
+			return
+		}
+	}
+	h.sendResp(w, "discarded", h.es.discarded.last(limit))
+}
@@ -1,6 +1,9 @@
 package eventsum
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -13,15 +16,69 @@ import (
 	"github.com/ContextLogic/eventsum/log"
 	"github.com/ContextLogic/eventsum/metrics"
 	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/scrubber"
+	"github.com/ContextLogic/eventsum/truncate"
 	"github.com/ContextLogic/eventsum/util"
+	"github.com/ContextLogic/eventsum/wal"
 )
 
+// Returned by Send when the ingest buffer stays full for the whole wait budget
+var errQueueFull = errors.New("ingest buffer is full")
+
+// Returned by Send once the ingest buffer is closed at shutdown
+var errStopped = errors.New("server is shutting down")
+
+// Returned by SendAll for a payload of more events than the ingest buffer holds
+var errPayloadTooLarge = errors.New("payload holds more events than the ingest buffer")
+
+// Returned by SaveToDB when DB operations failed for some of the events of a
+// batch. The periods of the other events are saved, so that only the failed
+// events must be saved again.
+type saveError struct {
+	failed []int // indices of the failed events in the batch
+	err    error // last DB error
+}
+
+func (e *saveError) Error() string {
+	return fmt.Sprintf("%d events not saved: %v", len(e.failed), e.err)
+}
+
+// Splits a batch given to SaveToDB into the events saved and the events to
+// save again, according to the error it returned. No event is saved on errors
+// other than a saveError.
+func splitSaved(evts []UnaddedEvent, err error) (saved, failed []UnaddedEvent) {
+	if err == nil {
+		return evts, nil
+	}
+	se, ok := err.(*saveError)
+	if !ok {
+		return nil, evts
+	}
+	isFailed := make(map[int]bool, len(se.failed))
+	for _, i := range se.failed {
+		isFailed[i] = true
+	}
+	for i, evt := range evts {
+		if isFailed[i] {
+			failed = append(failed, evt)
+		} else {
+			saved = append(saved, evt)
+		}
+	}
+	return saved, failed
+}
+
 // Wrapper struct for Event Channel
 type eventChannel struct {
-	queue     chan UnaddedEvent
+	queue     chan UnaddedEvent // ingest buffer, sized independently of the batches
 	BatchSize int
 	ticker    *time.Ticker
 	quit      chan int
+	full      chan struct{} // signals the queue holds a full batch
+	wait      time.Duration // time Send waits for room in a full queue
+
+	sync.RWMutex      // held by Send while sending, so that the queue is not closed meanwhile
+	closed       bool // once the queue is closed at shutdown
 }
 
 type eventStore struct {
@@ -30,8 +87,20 @@ type eventStore struct {
 	log          *log.Logger
 	timeInterval int // interval time for event_instance_period
 	timeFormat   string
-	dropToDisk   DropEventSwitch   // switch to write evts to local disk logs
-	dropEvent    DropEventThrottle // switch to drop
+	dropToDisk   DropEventSwitch     // switch to write evts to local disk logs
+	dropEvent    DropEventThrottle   // switch to drop
+	discarded    *discardLog         // last events discarded before being saved
+	dedupe       *dedupeStore        // ids of the events captured recently, nil if disabled
+	quotas       *quotaLimiter       // rate limits and daily quotas by service, nil if none
+	sampler      *sampler            // sampling rules, nil if none
+	scrubber     *scrubber.Scrubber  // replaces personal data of the events captured, nil if disabled
+	truncator    *truncate.Truncator // bounds the size of events at capture and before they are hashed, nil if unlimited
+	autoRegister bool                // add unknown services and environments to the registry
+	wal          *wal.WAL            // keeps events on disk until they are saved, nil if disabled
+	backfill     *backfiller         // replays the events dropped to disk
+	saver        *savePool           // workers saving the batches taken off the channel
+	aggregator   *aggregator         // counts of periods kept across batches, nil if disabled
+	ids          *idCaches           // ids of bases, details and instances by hash, nil if disabled
 }
 
 type DropEventSwitch struct {
@@ -82,28 +151,65 @@ func (d *DropEventThrottle) ToBeDropped() bool {
 // about the events and how they are processed. The event channel,
 // is the queue, and ds contains the link to the data store, or the DB.
 func newEventStore(ds datastore.DataStore, config conf.EventsumConfig, log *log.Logger) *eventStore {
-	return &eventStore{
+	bufferSize := config.IngestBufferSize
+	if bufferSize < config.BatchSize {
+		bufferSize = config.BatchSize
+	}
+	metrics.IngestQueue(0, bufferSize)
+
+	scrub, err := scrubber.New(config.Scrub)
+	if err != nil {
+		log.App().Fatalf("Unable to configure scrubbing: %v", err)
+	}
+
+	es := &eventStore{
 		ds,
 		&eventChannel{
-			make(chan UnaddedEvent, config.BatchSize),
-			config.BatchSize,
-			time.NewTicker(time.Duration(config.TimeLimit) * time.Second),
-			make(chan int),
+			queue:     make(chan UnaddedEvent, bufferSize),
+			BatchSize: config.BatchSize,
+			ticker:    time.NewTicker(time.Duration(config.TimeLimit) * time.Second),
+			quit:      make(chan int),
+			full:      make(chan struct{}, 1),
+			wait:      time.Duration(config.IngestWait) * time.Millisecond,
 		},
 		log,
 		config.TimeInterval,
 		config.TimeFormat,
 		DropEventSwitch{flag: false},
 		DropEventThrottle{Prob: 100},
+		newDiscardLog(config.DiscardLogSize),
+		newDedupeStore(config.Dedupe, ds, log),
+		newQuotaLimiter(config.Quotas),
+		newSampler(config.Sampling),
+		scrub,
+		truncate.New(config.Limits),
+		config.Registry.AutoRegister,
+		openWAL(config.WAL, log),
+		newBackfiller(config.BackfillRate),
+		nil,
+		newAggregator(config.Aggregation),
+		newIDCaches(config.IDCache),
 	}
+	es.saver = newSavePool(config.SaveWorkers, config.SaveQueueSize, es.saveBatch)
+	return es
 }
 
-// Starts the periodic processing of channel
+// Starts the periodic processing of channel, after replaying the events left
+// in the write-ahead log, or dropped to disk, by a previous run
 func (es *eventStore) Start() {
+	if es.wal != nil {
+		go es.replayWAL(es.saver.ctx)
+	}
+	es.BackFillToDB()
+	if es.aggregator != nil {
+		go es.aggregator.run(es.flushPeriods)
+	}
 	for {
 		select {
 		case <-es.channel.ticker.C:
 			es.SummarizeBatchEvents()
+		case <-es.channel.full:
+			es.SummarizeBatchEvents()
 		case <-es.channel.quit:
 			es.channel.ticker.Stop()
 			return
@@ -115,11 +221,169 @@ func (es *eventStore) Stop() {
 	es.channel.quit <- 0
 }
 
-// Add new UnaddedEvent to channel, process if full
-func (es *eventStore) Send(exc UnaddedEvent) {
-	es.channel.queue <- exc
-	if len(es.channel.queue) == es.channel.BatchSize {
-		go es.SummarizeBatchEvents()
+// Closes the ingest buffer, once the events left in it are the last ones to
+// be saved. Send fails with errStopped from then on.
+func (es *eventStore) closeQueue() {
+	es.channel.Lock()
+	defer es.channel.Unlock()
+	es.channel.closed = true
+	close(es.channel.queue)
+}
+
+// Scrubs personal data out of an event accepted at capture, before it is
+// persisted anywhere, e.g. in the wal or on disk, or exposed by the discard
+// log. The names of the rules that replaced values are kept on the event.
+func (es *eventStore) scrub(evt *UnaddedEvent) {
+	if es.scrubber == nil {
+		return
+	}
+	evt.Scrubbed = es.scrubber.Scrub(evt)
+	for _, rule := range evt.Scrubbed {
+		metrics.Scrubbed(rule)
+	}
+}
+
+// Truncates an event to the limits. Events are truncated once scrubbed at
+// capture, and again before being hashed, since filters may expand them.
+func (es *eventStore) truncate(evt *UnaddedEvent) {
+	if es.truncator == nil {
+		return
+	}
+	for _, limit := range es.truncator.Truncate(evt) {
+		metrics.Truncated(limit)
+	}
+}
+
+// Add new UnaddedEvent to channel, and signal a batch is ready once it holds
+// BatchSize events. If the channel is full, waits up to the wait budget for
+// room, then gives up with errQueueFull so that callers can ask clients to
+// retry later. An event whose id was already sent within the dedupe TTL, not
+// kept by a sampling rule, or whose service is over its rate limit or daily
+// quota, is acknowledged but not added. Events added are first appended to the
+// write-ahead log, if any.
+func (es *eventStore) Send(exc UnaddedEvent) error {
+	es.channel.RLock()
+	defer es.channel.RUnlock()
+	if es.channel.closed {
+		return errStopped
+	}
+	return es.send(exc)
+}
+
+// Sends the events of a payload, e.g. a Sentry envelope or an OTLP export,
+// either all of them or none. The channel is locked until the events are sent,
+// so that its room for every event is not taken by other senders meanwhile. If
+// there is no room for them after the wait budget, none is sent and
+// errQueueFull is returned, so that clients can retry the whole payload
+// without events being counted twice.
+func (es *eventStore) SendAll(evts []UnaddedEvent) error {
+	es.channel.Lock()
+	defer es.channel.Unlock()
+	if es.channel.closed {
+		return errStopped
+	}
+	if len(evts) > cap(es.channel.queue) {
+		return errPayloadTooLarge
+	}
+	if !es.channel.waitRoom(len(evts)) {
+		metrics.IngestRejected()
+		return errQueueFull
+	}
+	for _, exc := range evts {
+		if err := es.send(exc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Waits up to the wait budget for room for n events in the queue. Must be
+// called with the lock held, so that only the consumer changes the room left.
+func (c *eventChannel) waitRoom(n int) bool {
+	deadline := time.Now().Add(c.wait)
+	for cap(c.queue)-len(c.queue) < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// Must be called with the lock of the channel held
+func (es *eventStore) send(exc UnaddedEvent) error {
+	start := time.Now()
+	if !es.admit(&exc) {
+		return nil
+	}
+	if es.wal != nil {
+		if err := es.appendWAL(&exc); err != nil {
+			es.log.App().Errorf("Error appending event to the wal: %v", err)
+			es.forget([]UnaddedEvent{exc})
+			return err
+		}
+	}
+
+	select {
+	case es.channel.queue <- exc:
+	default:
+		timer := time.NewTimer(es.channel.wait)
+		defer timer.Stop()
+		select {
+		case es.channel.queue <- exc:
+		case <-timer.C:
+			metrics.IngestRejected()
+			// the client will retry the event
+			es.forget([]UnaddedEvent{exc})
+			es.ackWAL([]UnaddedEvent{exc})
+			return errQueueFull
+		}
+	}
+	metrics.IngestWait(start)
+
+	length := len(es.channel.queue)
+	metrics.IngestQueue(length, cap(es.channel.queue))
+	if length >= es.channel.BatchSize {
+		select {
+		case es.channel.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Applies the dedupe, the sampling rules and the quotas to an event. Returns
+// false if the event is to be acknowledged but not added.
+func (es *eventStore) admit(exc *UnaddedEvent) bool {
+	now := time.Now()
+	if es.dedupe != nil {
+		if key := dedupeKeyOf(*exc); key != "" && es.dedupe.seen(key, now) {
+			return false
+		}
+	}
+	if es.sampler != nil && !es.sampler.sample(exc) {
+		metrics.SampledOut(exc.Service)
+		return false
+	}
+	if es.quotas != nil {
+		if ok, limit := es.quotas.allow(exc.Service, exc.Environment, now); !ok {
+			metrics.QuotaDropped(exc.Service, exc.Environment, limit)
+			return false
+		}
+	}
+	return true
+}
+
+// Forgets the dedupe keys of events admitted but not added, so that they are
+// not taken for duplicates once retried
+func (es *eventStore) forget(evts []UnaddedEvent) {
+	if es.dedupe == nil {
+		return
+	}
+	for _, exc := range evts {
+		if key := dedupeKeyOf(exc); key != "" {
+			es.dedupe.forget(key)
+		}
 	}
 }
 
@@ -135,10 +399,11 @@ func (es *eventStore) SummarizeBatchEvents() {
 		exc := <-es.channel.queue
 		evtsToAdd = append(evtsToAdd, exc)
 	}
+	metrics.IngestQueue(len(es.channel.queue), cap(es.channel.queue))
 	if len(evtsToAdd) == 0 {
 		return
 	}
-	go es.SaveToDB(evtsToAdd)
+	es.saver.submit(evtsToAdd)
 
 	// Match events with each other to find similar ones
 
@@ -293,81 +558,106 @@ func (es *eventStore) SummarizeBatchEvents() {
 	//}
 }
 
-func (es *eventStore) SaveToDB(evtsToAdd []UnaddedEvent) {
-
-	//TODO enable to write to disk in the future
-	//if es.dropToDisk.Check() {
-	//	if es.dropEvent.ToBeDropped() {
-	//		//drop the events directly
-	//		return
-	//	}
-	//	//otherwise write events to local disk file and to be backfilled later.
-	//	// es.log.DropEventToDiskLog(evtsToAdd)
-	//	return
-	//}
+// Saves a batch of events into the DB. Events that cannot be processed are
+// skipped. If any of the DB operations failed, a *saveError lists the events
+// whose periods were not saved, so that callers able to replay them (e.g. the
+// kafka consumer) save them again without counting the other events twice.
+func (es *eventStore) SaveToDB(evtsToAdd []UnaddedEvent) error {
 
 	//TODO for now using throttling to gate how many events got written to DB.
 	if es.dropEvent.ToBeDropped() {
 		//drop the events directly
-		return
+		for _, event := range evtsToAdd {
+			es.discard(event, reasonThrottled, errors.New("events are throttled"))
+		}
+		return nil
+	}
+
+	// write events to local disk files, to be backfilled once the switch is off.
+	// Events are scrubbed and truncated at capture, so no personal data or
+	// oversized event reaches the files.
+	if es.dropToDisk.Check() {
+		if err := es.log.DropEventToDiskLog(evtsToAdd); err != nil {
+			es.log.App().Errorf("Error dropping %d events to disk: %v", len(evtsToAdd), err)
+			return err
+		}
+		metrics.DroppedToDisk(len(evtsToAdd))
+		return nil
 	}
 
+	var dbErr error
 	var eventBase EventBase
 	var eventDetail EventDetail
 	var eventInstance EventInstance
 	var eventInstancePeriod EventInstancePeriod
 
 	var eventInstancePeriodMap = make(map[string]*EventInstancePeriod)
+	var weights = make(map[string]float64) // estimated counts of the periods, by hash
+	var sources = make(map[string][]int)   // indices of the events counted by the periods, by hash
+	var failed []int
+
+	for i, event := range evtsToAdd {
 
-	for _, event := range evtsToAdd {
+		// events persisted before being truncated at capture, e.g. by an
+		// older version, are truncated here. Truncating again is a no-op.
+		es.truncate(&event)
 
 		rawEvent := event // Used for grouping
 		rawDetail := event.ExtraArgs
 		event, err := globalRule.ProcessFilter(event, "instance")
 		if err != nil {
 			es.log.App().Errorf("Error when processing instance: %v", err)
+			es.discard(rawEvent, reasonInstanceFilter, err)
 			continue
 		}
 
 		if err = util.ProcessGenericData(&event); err != nil {
 			es.log.App().Errorf("Error when processing event instance generic data %v", err)
+			es.discard(rawEvent, reasonGenericData, err)
 			continue
 		}
+		// after each filter, e.g. a parser expanding a stack trace, and before
+		// the hash of its output
+		es.truncate(&event)
 
-		// Get service name from config.json, but for RPCException
-		// we consider service_aggregation_mapping to override service
-		// with rpc exception to `*_rpc` suffix, e.g. merchant_be -> merchant_be_rpc
-		service, ok := es.GetServiceAggregationMapping(rawEvent)
-		if ok {
-			rawEvent.Service = service
-		} else {
+		// timestamps are normalized to the time format at capture. They are
+		// checked before any row is added, so that no row is left orphaned.
+		t, err := time.Parse(es.timeFormat, rawEvent.Timestamp)
+		if err != nil {
+			es.discard(rawEvent, reasonInvalidTimestamp, err)
 			continue
 		}
-
-		// Get service id from config.json, e.g. "merchant_be": {"service_id": 4}
-		serviceId, ok := es.ds.GetServicesMap()[rawEvent.Service]
-		if !ok {
-			continue
+		receivedAt, err := time.Parse(time.RFC3339Nano, rawEvent.ReceivedAt)
+		if err != nil {
+			receivedAt = time.Now().UTC()
 		}
+		startTime, endTime := util.FindBoundingTime(t, es.timeInterval)
 
-		// Get environment id from config.json, e.g. "prod": {"environment_id": 1}
-		environmentId, ok := es.ds.GetEnvironmentsMap()[rawEvent.Environment]
-		if !ok {
+		// Services and environments are checked at capture, but they may
+		// have been removed from the config since
+		service, serviceId, environmentId, err := es.findServiceEnvironment(rawEvent)
+		if err != nil {
+			es.discard(rawEvent, discardReason(err), err)
 			continue
 		}
+		rawEvent.Service = service
 
 		genericData := event.Data
 		event, err = globalRule.ProcessFilter(event, "base")
 		if err != nil {
 			es.log.App().Errorf("Error when processing base: %v", err)
+			es.discard(rawEvent, reasonBaseFilter, err)
 			continue
 		}
+		es.truncate(&event)
 		processedData := event.Data
 		event, err = globalRule.ProcessFilter(event, "extra_args")
 		if err != nil {
 			es.log.App().Errorf("Error when processing extra args: %v", err)
+			es.discard(rawEvent, reasonExtraArgsFilter, err)
 			continue
 		}
+		es.truncate(&event)
 		processedDetail := event.ExtraArgs
 
 		// We add service_id to hash generic data as to map between
@@ -394,9 +684,11 @@ func (es *eventStore) SaveToDB(evtsToAdd []UnaddedEvent) {
 		}
 
 		//either find base event id or create a new base event
-		baseEvtId, err := es.ds.FindEventBaseId(eventBase)
+		baseEvtId, err := es.findEventBaseId(eventBase)
 		if err != nil {
 			es.log.App().Errorf("error when getting base event id: %v", err)
+			dbErr = err
+			failed = append(failed, i)
 			continue
 		}
 
@@ -408,15 +700,14 @@ func (es *eventStore) SaveToDB(evtsToAdd []UnaddedEvent) {
 		}
 
 		//either find event detail id or create a new event detail
-		evtDetailId, err := es.ds.FindEventDetailId(eventDetail)
+		evtDetailId, err := es.findEventDetailId(eventDetail)
 		if err != nil {
 			es.log.App().Errorf("error when getting event detail id: %v", err)
+			dbErr = err
+			failed = append(failed, i)
 			continue
 		}
 
-		t, err := time.Parse(es.timeFormat, rawEvent.Timestamp)
-		startTime, endTime := util.FindBoundingTime(t, es.timeInterval)
-
 		//create instance event
 		eventInstance = EventInstance{
 			EventDetailId:      int(evtDetailId),
@@ -427,12 +718,16 @@ func (es *eventStore) SaveToDB(evtsToAdd []UnaddedEvent) {
 			GenericDataHash:    genericDataHash,
 			EventMessage:       rawEvent.Data.Message,
 			CreatedAt:          t,
+			ReceivedAt:         receivedAt,
+			Scrubbed:           rawEvent.Scrubbed,
 		}
 
 		//either find event instance id or create a new event instance
-		evtInstanceId, err := es.ds.FindEventInstanceId(eventInstance)
+		evtInstanceId, err := es.findEventInstanceId(eventInstance)
 		if err != nil {
 			es.log.App().Errorf("error when getting event instance id: %v", err)
+			dbErr = err
+			failed = append(failed, i)
 			continue
 		}
 
@@ -452,24 +747,47 @@ func (es *eventStore) SaveToDB(evtsToAdd []UnaddedEvent) {
 				EndTime:         endTime,
 				Count:           1,
 				Updated:         t,
+				Extrapolated:    rawEvent.SampleWeight > 1,
 			}
 		} else {
 			tmpValue.Count += 1
 			tmpValue.Updated = t
+			tmpValue.Extrapolated = tmpValue.Extrapolated || rawEvent.SampleWeight > 1
 		}
+		weights[eipHash] += rawEvent.Weight()
+		sources[eipHash] = append(sources[eipHash], i)
 
 	}
 
-	for _, v := range eventInstancePeriodMap {
+	for k, v := range eventInstancePeriodMap {
 		e := EventInstancePeriod{
 			EventInstanceId: v.EventInstanceId,
 			StartTime:       v.StartTime,
 			EndTime:         v.EndTime,
 			Count:           v.Count,
 			Updated:         v.Updated,
+			Extrapolated:    v.Extrapolated,
+		}
+		if es.aggregator != nil {
+			if es.aggregator.add(e, weights[k]) {
+				continue
+			}
+			metrics.AggregationOverflow()
 		}
-		es.ds.UpdateEventInstancePeriod(e)
+		if e.Extrapolated {
+			// sampled events stand for 1/rate events each
+			e.Count = int(math.Round(weights[k]))
+		}
+		if err := es.ds.UpdateEventInstancePeriod(e); err != nil {
+			es.log.App().Errorf("error when updating event instance period: %v", err)
+			dbErr = err
+			failed = append(failed, sources[k]...)
+		}
+	}
+	if dbErr != nil {
+		return &saveError{failed: failed, err: dbErr}
 	}
+	return nil
 }
 
 func (es *eventStore) GetServiceAggregationMapping(evt UnaddedEvent) (string, bool) {
@@ -486,8 +804,10 @@ func (es *eventStore) CheckRPCException(evt UnaddedEvent) bool {
 	return r
 }
 
+// Replays the events dropped to disk in the background, unless already
+// replaying them
 func (es *eventStore) BackFillToDB() {
-	//TODO BackFillToDB
+	es.backfill.start(es)
 }
 
 func (es *eventStore) GeneralQuery(
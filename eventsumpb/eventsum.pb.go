@@ -0,0 +1,550 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: eventsum.proto
+
+package eventsumpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	_struct "github.com/golang/protobuf/ptypes/struct"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Mirrors models.UnaddedEvent
+type UnaddedEvent struct {
+	Service               string                  `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+	Environment           string                  `protobuf:"bytes,2,opt,name=environment,proto3" json:"environment,omitempty"`
+	EventName             string                  `protobuf:"bytes,3,opt,name=event_name,json=eventName,proto3" json:"event_name,omitempty"`
+	EventType             string                  `protobuf:"bytes,4,opt,name=event_type,json=eventType,proto3" json:"event_type,omitempty"`
+	EventData             *EventData              `protobuf:"bytes,5,opt,name=event_data,json=eventData,proto3" json:"event_data,omitempty"`
+	ExtraArgs             *_struct.Struct         `protobuf:"bytes,6,opt,name=extra_args,json=extraArgs,proto3" json:"extra_args,omitempty"`
+	Timestamp             string                  `protobuf:"bytes,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	ConfigurableFilters   map[string]*FilterNames `protobuf:"bytes,8,rep,name=configurable_filters,json=configurableFilters,proto3" json:"configurable_filters,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	ConfigurableGroupings []string                `protobuf:"bytes,9,rep,name=configurable_groupings,json=configurableGroupings,proto3" json:"configurable_groupings,omitempty"`
+	XXX_NoUnkeyedLiteral  struct{}                `json:"-"`
+	XXX_unrecognized      []byte                  `json:"-"`
+	XXX_sizecache         int32                   `json:"-"`
+}
+
+func (m *UnaddedEvent) Reset()         { *m = UnaddedEvent{} }
+func (m *UnaddedEvent) String() string { return proto.CompactTextString(m) }
+func (*UnaddedEvent) ProtoMessage()    {}
+func (*UnaddedEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_643b25260f61e085, []int{0}
+}
+
+func (m *UnaddedEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_UnaddedEvent.Unmarshal(m, b)
+}
+func (m *UnaddedEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_UnaddedEvent.Marshal(b, m, deterministic)
+}
+func (m *UnaddedEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_UnaddedEvent.Merge(m, src)
+}
+func (m *UnaddedEvent) XXX_Size() int {
+	return xxx_messageInfo_UnaddedEvent.Size(m)
+}
+func (m *UnaddedEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_UnaddedEvent.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_UnaddedEvent proto.InternalMessageInfo
+
+func (m *UnaddedEvent) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *UnaddedEvent) GetEnvironment() string {
+	if m != nil {
+		return m.Environment
+	}
+	return ""
+}
+
+func (m *UnaddedEvent) GetEventName() string {
+	if m != nil {
+		return m.EventName
+	}
+	return ""
+}
+
+func (m *UnaddedEvent) GetEventType() string {
+	if m != nil {
+		return m.EventType
+	}
+	return ""
+}
+
+func (m *UnaddedEvent) GetEventData() *EventData {
+	if m != nil {
+		return m.EventData
+	}
+	return nil
+}
+
+func (m *UnaddedEvent) GetExtraArgs() *_struct.Struct {
+	if m != nil {
+		return m.ExtraArgs
+	}
+	return nil
+}
+
+func (m *UnaddedEvent) GetTimestamp() string {
+	if m != nil {
+		return m.Timestamp
+	}
+	return ""
+}
+
+func (m *UnaddedEvent) GetConfigurableFilters() map[string]*FilterNames {
+	if m != nil {
+		return m.ConfigurableFilters
+	}
+	return nil
+}
+
+func (m *UnaddedEvent) GetConfigurableGroupings() []string {
+	if m != nil {
+		return m.ConfigurableGroupings
+	}
+	return nil
+}
+
+// Mirrors models.EventData
+type EventData struct {
+	Message              *_struct.Value `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	RawData              *_struct.Value `protobuf:"bytes,2,opt,name=raw_data,json=rawData,proto3" json:"raw_data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *EventData) Reset()         { *m = EventData{} }
+func (m *EventData) String() string { return proto.CompactTextString(m) }
+func (*EventData) ProtoMessage()    {}
+func (*EventData) Descriptor() ([]byte, []int) {
+	return fileDescriptor_643b25260f61e085, []int{1}
+}
+
+func (m *EventData) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EventData.Unmarshal(m, b)
+}
+func (m *EventData) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EventData.Marshal(b, m, deterministic)
+}
+func (m *EventData) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EventData.Merge(m, src)
+}
+func (m *EventData) XXX_Size() int {
+	return xxx_messageInfo_EventData.Size(m)
+}
+func (m *EventData) XXX_DiscardUnknown() {
+	xxx_messageInfo_EventData.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EventData proto.InternalMessageInfo
+
+func (m *EventData) GetMessage() *_struct.Value {
+	if m != nil {
+		return m.Message
+	}
+	return nil
+}
+
+func (m *EventData) GetRawData() *_struct.Value {
+	if m != nil {
+		return m.RawData
+	}
+	return nil
+}
+
+type FilterNames struct {
+	Names                []string `protobuf:"bytes,1,rep,name=names,proto3" json:"names,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FilterNames) Reset()         { *m = FilterNames{} }
+func (m *FilterNames) String() string { return proto.CompactTextString(m) }
+func (*FilterNames) ProtoMessage()    {}
+func (*FilterNames) Descriptor() ([]byte, []int) {
+	return fileDescriptor_643b25260f61e085, []int{2}
+}
+
+func (m *FilterNames) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FilterNames.Unmarshal(m, b)
+}
+func (m *FilterNames) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FilterNames.Marshal(b, m, deterministic)
+}
+func (m *FilterNames) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FilterNames.Merge(m, src)
+}
+func (m *FilterNames) XXX_Size() int {
+	return xxx_messageInfo_FilterNames.Size(m)
+}
+func (m *FilterNames) XXX_DiscardUnknown() {
+	xxx_messageInfo_FilterNames.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FilterNames proto.InternalMessageInfo
+
+func (m *FilterNames) GetNames() []string {
+	if m != nil {
+		return m.Names
+	}
+	return nil
+}
+
+type CaptureResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CaptureResponse) Reset()         { *m = CaptureResponse{} }
+func (m *CaptureResponse) String() string { return proto.CompactTextString(m) }
+func (*CaptureResponse) ProtoMessage()    {}
+func (*CaptureResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_643b25260f61e085, []int{3}
+}
+
+func (m *CaptureResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CaptureResponse.Unmarshal(m, b)
+}
+func (m *CaptureResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CaptureResponse.Marshal(b, m, deterministic)
+}
+func (m *CaptureResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CaptureResponse.Merge(m, src)
+}
+func (m *CaptureResponse) XXX_Size() int {
+	return xxx_messageInfo_CaptureResponse.Size(m)
+}
+func (m *CaptureResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_CaptureResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CaptureResponse proto.InternalMessageInfo
+
+// Result of an event of the stream that was not accepted
+type CaptureResult struct {
+	Index                int32    `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Error                string   `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CaptureResult) Reset()         { *m = CaptureResult{} }
+func (m *CaptureResult) String() string { return proto.CompactTextString(m) }
+func (*CaptureResult) ProtoMessage()    {}
+func (*CaptureResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_643b25260f61e085, []int{4}
+}
+
+func (m *CaptureResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CaptureResult.Unmarshal(m, b)
+}
+func (m *CaptureResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CaptureResult.Marshal(b, m, deterministic)
+}
+func (m *CaptureResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CaptureResult.Merge(m, src)
+}
+func (m *CaptureResult) XXX_Size() int {
+	return xxx_messageInfo_CaptureResult.Size(m)
+}
+func (m *CaptureResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_CaptureResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CaptureResult proto.InternalMessageInfo
+
+func (m *CaptureResult) GetIndex() int32 {
+	if m != nil {
+		return m.Index
+	}
+	return 0
+}
+
+func (m *CaptureResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type CaptureStreamResponse struct {
+	Accepted             int32            `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Rejected             []*CaptureResult `protobuf:"bytes,2,rep,name=rejected,proto3" json:"rejected,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *CaptureStreamResponse) Reset()         { *m = CaptureStreamResponse{} }
+func (m *CaptureStreamResponse) String() string { return proto.CompactTextString(m) }
+func (*CaptureStreamResponse) ProtoMessage()    {}
+func (*CaptureStreamResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_643b25260f61e085, []int{5}
+}
+
+func (m *CaptureStreamResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CaptureStreamResponse.Unmarshal(m, b)
+}
+func (m *CaptureStreamResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CaptureStreamResponse.Marshal(b, m, deterministic)
+}
+func (m *CaptureStreamResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CaptureStreamResponse.Merge(m, src)
+}
+func (m *CaptureStreamResponse) XXX_Size() int {
+	return xxx_messageInfo_CaptureStreamResponse.Size(m)
+}
+func (m *CaptureStreamResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_CaptureStreamResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CaptureStreamResponse proto.InternalMessageInfo
+
+func (m *CaptureStreamResponse) GetAccepted() int32 {
+	if m != nil {
+		return m.Accepted
+	}
+	return 0
+}
+
+func (m *CaptureStreamResponse) GetRejected() []*CaptureResult {
+	if m != nil {
+		return m.Rejected
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*UnaddedEvent)(nil), "eventsum.UnaddedEvent")
+	proto.RegisterMapType((map[string]*FilterNames)(nil), "eventsum.UnaddedEvent.ConfigurableFiltersEntry")
+	proto.RegisterType((*EventData)(nil), "eventsum.EventData")
+	proto.RegisterType((*FilterNames)(nil), "eventsum.FilterNames")
+	proto.RegisterType((*CaptureResponse)(nil), "eventsum.CaptureResponse")
+	proto.RegisterType((*CaptureResult)(nil), "eventsum.CaptureResult")
+	proto.RegisterType((*CaptureStreamResponse)(nil), "eventsum.CaptureStreamResponse")
+}
+
+func init() { proto.RegisterFile("eventsum.proto", fileDescriptor_643b25260f61e085) }
+
+var fileDescriptor_643b25260f61e085 = []byte{
+	// 561 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0x5f, 0x6f, 0xd3, 0x3e,
+	0x14, 0x55, 0xda, 0x75, 0x6d, 0x6e, 0x7f, 0xfb, 0x01, 0xde, 0x3f, 0x53, 0x0d, 0x51, 0x95, 0x97,
+	0x4a, 0x13, 0x29, 0x64, 0x02, 0x21, 0xe0, 0x05, 0xc6, 0x40, 0x42, 0x88, 0x87, 0x0c, 0x78, 0x40,
+	0x42, 0x93, 0x93, 0xdc, 0x65, 0x81, 0xc6, 0x8e, 0x6c, 0xa7, 0x5b, 0xbf, 0x03, 0x8f, 0x7c, 0x60,
+	0x14, 0x3b, 0x49, 0x53, 0x6d, 0xe3, 0xcd, 0xf7, 0x9e, 0x73, 0xae, 0xcf, 0xfd, 0x03, 0xff, 0xe3,
+	0x02, 0xb9, 0x56, 0x45, 0xe6, 0xe5, 0x52, 0x68, 0x41, 0x06, 0x75, 0x3c, 0x3a, 0x48, 0x84, 0x48,
+	0xe6, 0x38, 0x33, 0xf9, 0xb0, 0x38, 0x9f, 0x29, 0x2d, 0x8b, 0x48, 0x5b, 0xde, 0xe4, 0xf7, 0x06,
+	0xfc, 0xf7, 0x95, 0xb3, 0x38, 0xc6, 0xf8, 0xa4, 0x54, 0x10, 0x0a, 0x7d, 0x85, 0x72, 0x91, 0x46,
+	0x48, 0x9d, 0xb1, 0x33, 0x75, 0x83, 0x3a, 0x24, 0x63, 0x18, 0x22, 0x5f, 0xa4, 0x52, 0xf0, 0x0c,
+	0xb9, 0xa6, 0x1d, 0x83, 0xb6, 0x53, 0xe4, 0x01, 0x80, 0xf9, 0xf6, 0x8c, 0xb3, 0x0c, 0x69, 0xd7,
+	0x10, 0x5c, 0x93, 0xf9, 0xcc, 0x32, 0x5c, 0xc1, 0x7a, 0x99, 0x23, 0xdd, 0x68, 0xc1, 0x5f, 0x96,
+	0x39, 0x12, 0xbf, 0x86, 0x63, 0xa6, 0x19, 0xed, 0x8d, 0x9d, 0xe9, 0xd0, 0xdf, 0xf6, 0x9a, 0xbe,
+	0x8c, 0xbd, 0x77, 0x4c, 0xb3, 0x4a, 0x53, 0x3e, 0xc9, 0x73, 0x00, 0xbc, 0xd2, 0x92, 0x9d, 0x31,
+	0x99, 0x28, 0xba, 0x69, 0x34, 0xfb, 0x9e, 0xed, 0xd8, 0xab, 0x3b, 0xf6, 0x4e, 0x4d, 0xc7, 0x81,
+	0x6b, 0xa8, 0x6f, 0x64, 0xa2, 0xc8, 0x01, 0xb8, 0x3a, 0xcd, 0x50, 0x69, 0x96, 0xe5, 0xb4, 0x6f,
+	0x9d, 0x34, 0x09, 0x12, 0xc2, 0x4e, 0x24, 0xf8, 0x79, 0x9a, 0x14, 0x92, 0x85, 0x73, 0x3c, 0x3b,
+	0x4f, 0xe7, 0x1a, 0xa5, 0xa2, 0x83, 0x71, 0x77, 0x3a, 0xf4, 0x67, 0x2b, 0x4f, 0xed, 0xc9, 0x79,
+	0xc7, 0x2d, 0xc9, 0x7b, 0xab, 0x38, 0xe1, 0x5a, 0x2e, 0x83, 0xed, 0xe8, 0x3a, 0x42, 0x9e, 0xc1,
+	0xde, 0xda, 0x1f, 0x89, 0x14, 0x45, 0x9e, 0xf2, 0x44, 0x51, 0x77, 0xdc, 0x9d, 0xba, 0xc1, 0x6e,
+	0x1b, 0xfd, 0x50, 0x83, 0xa3, 0x1f, 0x40, 0x6f, 0xfb, 0x87, 0xdc, 0x85, 0xee, 0x2f, 0x5c, 0x56,
+	0x6b, 0x2b, 0x9f, 0xe4, 0x10, 0x7a, 0x0b, 0x36, 0x2f, 0xd0, 0x2c, 0x6b, 0xe8, 0xef, 0xae, 0x9c,
+	0x5b, 0x61, 0xb9, 0x16, 0x15, 0x58, 0xce, 0xcb, 0xce, 0x0b, 0x67, 0x92, 0x83, 0xdb, 0xcc, 0x99,
+	0x3c, 0x81, 0x7e, 0x86, 0x4a, 0xb1, 0xc4, 0x9e, 0xc2, 0xd0, 0xdf, 0xbb, 0x36, 0xd9, 0x6f, 0xa5,
+	0x32, 0xa8, 0x69, 0xe4, 0x29, 0x0c, 0x24, 0xbb, 0xb4, 0x0b, 0xec, 0xfc, 0x5b, 0x22, 0xd9, 0x65,
+	0xf9, 0xc9, 0xe4, 0x11, 0x0c, 0x5b, 0x5e, 0xc8, 0x0e, 0xf4, 0xca, 0xe3, 0x51, 0xd4, 0x31, 0x53,
+	0xb0, 0xc1, 0xe4, 0x1e, 0xdc, 0x39, 0x66, 0xb9, 0x2e, 0x24, 0x06, 0xa8, 0x72, 0xc1, 0x15, 0x4e,
+	0x5e, 0xc1, 0xd6, 0x2a, 0x55, 0xcc, 0x75, 0xa9, 0x4c, 0x79, 0x8c, 0x57, 0xc6, 0x6b, 0x2f, 0xb0,
+	0x41, 0x99, 0x45, 0x29, 0x85, 0xac, 0xce, 0xd5, 0x06, 0x93, 0x0b, 0xd8, 0xad, 0xc4, 0xa7, 0x5a,
+	0x22, 0xcb, 0xea, 0xaa, 0x64, 0x04, 0x03, 0x16, 0x45, 0x98, 0x6b, 0x8c, 0xab, 0x3a, 0x4d, 0x4c,
+	0x8e, 0x60, 0x20, 0xf1, 0x27, 0x46, 0x25, 0xd6, 0x31, 0x97, 0xb0, 0xbf, 0x9a, 0xe7, 0x9a, 0x97,
+	0xa0, 0x21, 0xfa, 0x7f, 0x1c, 0x18, 0x9c, 0x54, 0x24, 0xf2, 0x1a, 0xfa, 0x15, 0x8f, 0xec, 0xdd,
+	0x7c, 0x44, 0xa3, 0xfb, 0x37, 0x95, 0xb4, 0xde, 0x3e, 0xc2, 0xd6, 0x9a, 0xe9, 0x5b, 0x6b, 0x3c,
+	0xbc, 0x56, 0x63, 0xbd, 0xcb, 0xa9, 0xf3, 0xf6, 0xf1, 0xf7, 0xc3, 0x24, 0xd5, 0x17, 0x45, 0xe8,
+	0x45, 0x22, 0x9b, 0x1d, 0x0b, 0xae, 0xf1, 0x4a, 0x7f, 0x12, 0x49, 0x1a, 0xcd, 0x6a, 0x6d, 0xf3,
+	0xc8, 0xc3, 0x70, 0xd3, 0x6c, 0xef, 0xe8, 0xef, 0x00, 0x78, 0x8c, 0x4f, 0xae, 0x66, 0x04, 0x00,
+	0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// EventsumClient is the client API for Eventsum service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type EventsumClient interface {
+	// Captures a single event
+	Capture(ctx context.Context, in *UnaddedEvent, opts ...grpc.CallOption) (*CaptureResponse, error)
+	// Captures every event of the stream, and replies once the client closes it
+	CaptureStream(ctx context.Context, opts ...grpc.CallOption) (Eventsum_CaptureStreamClient, error)
+}
+
+type eventsumClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewEventsumClient(cc grpc.ClientConnInterface) EventsumClient {
+	return &eventsumClient{cc}
+}
+
+func (c *eventsumClient) Capture(ctx context.Context, in *UnaddedEvent, opts ...grpc.CallOption) (*CaptureResponse, error) {
+	out := new(CaptureResponse)
+	err := c.cc.Invoke(ctx, "/eventsum.Eventsum/Capture", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *eventsumClient) CaptureStream(ctx context.Context, opts ...grpc.CallOption) (Eventsum_CaptureStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Eventsum_serviceDesc.Streams[0], "/eventsum.Eventsum/CaptureStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &eventsumCaptureStreamClient{stream}
+	return x, nil
+}
+
+type Eventsum_CaptureStreamClient interface {
+	Send(*UnaddedEvent) error
+	CloseAndRecv() (*CaptureStreamResponse, error)
+	grpc.ClientStream
+}
+
+type eventsumCaptureStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *eventsumCaptureStreamClient) Send(m *UnaddedEvent) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *eventsumCaptureStreamClient) CloseAndRecv() (*CaptureStreamResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(CaptureStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EventsumServer is the server API for Eventsum service.
+type EventsumServer interface {
+	// Captures a single event
+	Capture(context.Context, *UnaddedEvent) (*CaptureResponse, error)
+	// Captures every event of the stream, and replies once the client closes it
+	CaptureStream(Eventsum_CaptureStreamServer) error
+}
+
+// UnimplementedEventsumServer can be embedded to have forward compatible implementations.
+type UnimplementedEventsumServer struct {
+}
+
+func (*UnimplementedEventsumServer) Capture(ctx context.Context, req *UnaddedEvent) (*CaptureResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capture not implemented")
+}
+func (*UnimplementedEventsumServer) CaptureStream(srv Eventsum_CaptureStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method CaptureStream not implemented")
+}
+
+func RegisterEventsumServer(s *grpc.Server, srv EventsumServer) {
+	s.RegisterService(&_Eventsum_serviceDesc, srv)
+}
+
+func _Eventsum_Capture_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnaddedEvent)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EventsumServer).Capture(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/eventsum.Eventsum/Capture",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EventsumServer).Capture(ctx, req.(*UnaddedEvent))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Eventsum_CaptureStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EventsumServer).CaptureStream(&eventsumCaptureStreamServer{stream})
+}
+
+type Eventsum_CaptureStreamServer interface {
+	SendAndClose(*CaptureStreamResponse) error
+	Recv() (*UnaddedEvent, error)
+	grpc.ServerStream
+}
+
+type eventsumCaptureStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *eventsumCaptureStreamServer) SendAndClose(m *CaptureStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *eventsumCaptureStreamServer) Recv() (*UnaddedEvent, error) {
+	m := new(UnaddedEvent)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Eventsum_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "eventsum.Eventsum",
+	HandlerType: (*EventsumServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Capture",
+			Handler:    _Eventsum_Capture_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CaptureStream",
+			Handler:       _Eventsum_CaptureStream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "eventsum.proto",
+}
@@ -3,12 +3,14 @@ module github.com/ContextLogic/eventsum
 go 1.12
 
 require (
+	github.com/Shopify/sarama v1.26.4
 	github.com/armon/go-radix v0.0.0-20170727155443-1fca145dffbc
 	github.com/beorn7/perks v0.0.0-20160804104726-4c0e84591b9a
-	github.com/golang/protobuf v0.0.0-20180122221610-c65a0412e71e
+	github.com/golang/protobuf v1.3.3
 	github.com/jacksontj/dataman v0.0.0-20180119022431-f102db846822
 	github.com/jessevdk/go-flags v1.3.0
 	github.com/julienschmidt/httprouter v1.1.0
+	github.com/klauspost/compress v1.9.8
 	github.com/lib/pq v0.0.0-20180123210206-19c8e9ad0095
 	github.com/matttproud/golang_protobuf_extensions v1.0.0
 	github.com/mitchellh/mapstructure v0.0.0-20180111000720-b4575eea38cc
@@ -16,20 +18,19 @@ require (
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/pkg/errors v0.8.0
 	github.com/prometheus/client_golang v0.8.0
-	github.com/prometheus/client_model v0.0.0-20171117100541-99fa1f4be8e5
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/prometheus/common v0.0.0-20180110214958-89604d197083
 	github.com/prometheus/procfs v0.0.0-20180123162055-85fadb6e8990
-	github.com/rcrowley/go-metrics v0.0.0-20171128170426-e181e095bae9
+	github.com/rcrowley/go-metrics v0.0.0-20190826022208-cac0b30c2563
 	github.com/renstrom/go-jump-consistent-hash v1.0.0
 	github.com/segmentio/ksuid v1.0.1
 	github.com/sirupsen/logrus v1.0.4
-	golang.org/x/crypto v0.0.0-20191108234033-bd318be0434a
+	golang.org/x/crypto v0.0.0-20200204104054-c9f3fb736b72
 	golang.org/x/lint v0.0.0-20190930215403-16217165b5de // indirect
-	golang.org/x/net v0.0.0-20191109021931-daa7c04131f5 // indirect
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
 	golang.org/x/sys v0.0.0-20191110163157-d32e6e3b99c4
 	golang.org/x/text v0.3.2 // indirect
 	golang.org/x/tools v0.0.0-20191111182352-50fa39b762bc // indirect
-	golang.org/x/xerrors v0.0.0-20191011141410-1b5146add898 // indirect
-	gopkg.in/yaml.v2 v2.0.0
+	google.golang.org/grpc v1.29.1
+	gopkg.in/yaml.v2 v2.2.8
 )
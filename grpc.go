@@ -0,0 +1,216 @@
+package eventsum
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/ContextLogic/eventsum/eventsumpb"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Metadata carrying the key of a gRPC call. Keys are also accepted as bearer
+// tokens of the authorization metadata.
+const grpcAPIKeyMetadata = "x-eventsum-key"
+
+// grpcHandler implements the gRPC capture service. Events are validated by the
+// http handler and sent to the same batching channel as the HTTP endpoints.
+type grpcHandler struct {
+	h         *httpHandler
+	isStopped func() bool
+}
+
+func (g *grpcHandler) Capture(ctx context.Context, pe *eventsumpb.UnaddedEvent) (*eventsumpb.CaptureResponse, error) {
+	if g.isStopped() {
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	evt, err := g.toUnaddedEvent(pe)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := g.h.authorizeEvent(ctx, &evt); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := g.h.es.Send(evt); err != nil {
+		return nil, sendStatus(err)
+	}
+	return &eventsumpb.CaptureResponse{}, nil
+}
+
+// Captures the events of a client stream. Invalid events do not end the
+// stream, they are reported by their index once the client closes it.
+func (g *grpcHandler) CaptureStream(stream eventsumpb.Eventsum_CaptureStreamServer) error {
+	resp := &eventsumpb.CaptureStreamResponse{}
+	for index := 0; ; index++ {
+		pe, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(resp)
+		} else if err != nil {
+			return err
+		}
+
+		if g.isStopped() {
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+		evt, err := g.toUnaddedEvent(pe)
+		if err == nil {
+			err = g.h.authorizeEvent(stream.Context(), &evt)
+		}
+		if err != nil {
+			resp.Rejected = append(resp.Rejected, &eventsumpb.CaptureResult{Index: int32(index), Error: err.Error()})
+			continue
+		}
+		if err := g.h.es.Send(evt); err == errStopped {
+			return sendStatus(err)
+		} else if err != nil {
+			resp.Rejected = append(resp.Rejected, &eventsumpb.CaptureResult{Index: int32(index), Error: err.Error()})
+			continue
+		}
+		resp.Accepted++
+	}
+}
+
+// Maps an error of Send onto the status of a call: clients retry the calls
+// rejected because the queue is full, and other servers the calls rejected
+// because this one is stopping.
+func sendStatus(err error) error {
+	switch err {
+	case errQueueFull, errPayloadTooLarge:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errStopped:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Returns the key of a call, from any of the metadata keys are accepted in
+func grpcAPIKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if keys := md.Get(grpcAPIKeyMetadata); len(keys) > 0 && keys[0] != "" {
+		return keys[0]
+	}
+	if auth := md.Get("authorization"); len(auth) > 0 && strings.HasPrefix(auth[0], "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth[0], "Bearer "))
+	}
+	return ""
+}
+
+// Checks that the key of a call may ingest events, like the ingest routes of
+// the http handler, and adds the key to the context of the call. Keys scoped to
+// a service are accepted, the service of every event being checked.
+func (g *grpcHandler) authorize(ctx context.Context) (context.Context, error) {
+	if g.h.auth == nil {
+		return ctx, nil
+	}
+	key, err := g.h.auth.authenticate(grpcAPIKey(ctx))
+	switch err {
+	case nil:
+	case errMissingAPIKey, errInvalidAPIKey, errRevokedAPIKey:
+		metrics.AuthRejected(err.Error())
+		return ctx, status.Error(codes.Unauthenticated, err.Error())
+	default:
+		g.h.log.App().Errorf("Error checking API key: %v", err)
+		return ctx, status.Error(codes.Internal, "error checking API key")
+	}
+	if !hasCapability(key, capabilityIngest) {
+		metrics.AuthRejected("missing capability")
+		return ctx, status.Errorf(codes.PermissionDenied, "API key cannot %s", capabilityIngest)
+	}
+	return context.WithValue(ctx, apiKeyContextKey{}, key), nil
+}
+
+func (g *grpcHandler) unaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := g.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *grpcHandler) streamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := g.authorize(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ss, ctx})
+}
+
+// authorizedStream is a server stream whose context holds the key of the call
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// Converts the protobuf event into a validated UnaddedEvent
+func (g *grpcHandler) toUnaddedEvent(pe *eventsumpb.UnaddedEvent) (UnaddedEvent, error) {
+	evt, err := fromProtoEvent(pe)
+	if err != nil {
+		return evt, err
+	}
+	err = g.h.validateEvent(&evt)
+	return evt, err
+}
+
+func fromProtoEvent(pe *eventsumpb.UnaddedEvent) (UnaddedEvent, error) {
+	evt := UnaddedEvent{
+		Service:               pe.GetService(),
+		Environment:           pe.GetEnvironment(),
+		Name:                  pe.GetEventName(),
+		Type:                  pe.GetEventType(),
+		Timestamp:             pe.GetTimestamp(),
+		ConfigurableGroupings: pe.GetConfigurableGroupings(),
+	}
+
+	if len(pe.GetConfigurableFilters()) > 0 {
+		evt.ConfigurableFilters = make(map[string][]string)
+		for k, v := range pe.GetConfigurableFilters() {
+			evt.ConfigurableFilters[k] = v.GetNames()
+		}
+	}
+
+	var err error
+	if msg := pe.GetEventData().GetMessage(); msg != nil {
+		if evt.Data.RawMessage, err = protoToGenericJSON(msg); err != nil {
+			return evt, err
+		}
+	}
+	if raw := pe.GetEventData().GetRawData(); raw != nil {
+		if evt.Data.Raw, err = protoToGenericJSON(raw); err != nil {
+			return evt, err
+		}
+	}
+	if extraArgs := pe.GetExtraArgs(); extraArgs != nil {
+		args, err := protoToGenericJSON(extraArgs)
+		if err != nil {
+			return evt, err
+		}
+		evt.ExtraArgs, _ = args.(map[string]interface{})
+	}
+
+	return evt, nil
+}
+
+// Converts a google.protobuf.Value or Struct into the generic JSON value
+// the HTTP endpoints would have decoded
+func protoToGenericJSON(pb proto.Message) (interface{}, error) {
+	s, err := (&jsonpb.Marshaler{}).MarshalToString(pb)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	err = json.Unmarshal([]byte(s), &res)
+	return res, err
+}
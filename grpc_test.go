@@ -0,0 +1,166 @@
+package eventsum
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	_struct "github.com/golang/protobuf/ptypes/struct"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/eventsumpb"
+)
+
+// Serves the gRPC capture service of the handler in memory, with the same
+// interceptors as the server
+func newGrpcTestClient(t *testing.T, h *httpHandler) (eventsumpb.EventsumClient, func()) {
+	lis := bufconn.Listen(1 << 20)
+	g := &grpcHandler{h: h, isStopped: func() bool { return false }}
+	server := grpc.NewServer(grpc.UnaryInterceptor(g.unaryInterceptor), grpc.StreamInterceptor(g.streamInterceptor))
+	eventsumpb.RegisterEventsumServer(server, g)
+	go server.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return eventsumpb.NewEventsumClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestGrpcCaptureStream(t *testing.T) {
+	es := newTestEventStore(10)
+	h := newHTTPHandler(es, nil, conf.DefaultConfig())
+	client, stop := newGrpcTestClient(t, &h)
+	defer stop()
+
+	stream, err := client.CaptureStream(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	valid := &eventsumpb.UnaddedEvent{
+		Service:     "wish_be",
+		Environment: "prod",
+		EventName:   "KeyError",
+		EventType:   "python",
+		Timestamp:   "2020-01-26 00:53:20",
+		EventData: &eventsumpb.EventData{
+			Message: &_struct.Value{Kind: &_struct.Value_StringValue{StringValue: "'a'"}},
+		},
+		ExtraArgs: &_struct.Struct{Fields: map[string]*_struct.Value{
+			"user_id": {Kind: &_struct.Value_NumberValue{NumberValue: 4}},
+		}},
+		ConfigurableFilters: map[string]*eventsumpb.FilterNames{"base": {Names: []string{"exception_python_remove_line_no"}}},
+	}
+	invalid := &eventsumpb.UnaddedEvent{Service: "wish_be", Timestamp: "yesterday"}
+	for _, evt := range []*eventsumpb.UnaddedEvent{valid, invalid, valid} {
+		if err := stream.Send(evt); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resp.Accepted != 2 || len(resp.Rejected) != 1 || resp.Rejected[0].Index != 1 {
+		t.Errorf("unexpected response %v", resp)
+	}
+	if len(es.channel.queue) != 2 {
+		t.Fatalf("expected 2 queued events, got %d", len(es.channel.queue))
+	}
+	evt := <-es.channel.queue
+	if evt.Data.Message != "'a'" || evt.ExtraArgs["user_id"] != 4.0 || evt.ConfigurableFilters["base"][0] != "exception_python_remove_line_no" {
+		t.Errorf("unexpected event %+v", evt)
+	}
+}
+
+func TestGrpcAuth(t *testing.T) {
+	es := newTestEventStore(10)
+	h, _ := newAuthHandler(t, es, false)
+	client, stop := newGrpcTestClient(t, &h)
+	defer stop()
+
+	ingest := issueTestKey(t, &h, `{"capabilities": ["ingest"]}`)
+	read := issueTestKey(t, &h, `{"capabilities": ["read"]}`)
+	scoped := issueTestKey(t, &h, `{"service": "merchant_be", "capabilities": ["ingest"]}`)
+	evt := &eventsumpb.UnaddedEvent{
+		Service:     "wish_be",
+		Environment: "prod",
+		EventName:   "KeyError",
+		EventType:   "python",
+		Timestamp:   "2020-01-26 00:53:20",
+	}
+	withKey := func(md ...string) context.Context {
+		return metadata.NewOutgoingContext(context.Background(), metadata.Pairs(md...))
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"no key", context.Background(), codes.Unauthenticated},
+		{"invalid key", withKey("x-eventsum-key", "esk_nope"), codes.Unauthenticated},
+		{"read key", withKey("x-eventsum-key", read.Key), codes.PermissionDenied},
+		{"key of another service", withKey("x-eventsum-key", scoped.Key), codes.PermissionDenied},
+		{"ingest key", withKey("x-eventsum-key", ingest.Key), codes.OK},
+		{"bearer token", withKey("authorization", "Bearer "+ingest.Key), codes.OK},
+	}
+	for _, test := range tests {
+		_, err := client.Capture(test.ctx, evt)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("%s: expected %v, got %v", test.name, test.code, err)
+		}
+	}
+
+	// streams are checked once, and the service of every event
+	stream, err := client.CaptureStream(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream.Send(evt)
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a stream without key to be rejected, got %v", err)
+	}
+	stream, err = client.CaptureStream(withKey("x-eventsum-key", scoped.Key))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream.Send(evt)
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Accepted != 0 || len(resp.Rejected) != 1 {
+		t.Errorf("expected the event of another service to be rejected, got %v", resp)
+	}
+}
+
+func TestGrpcCaptureStopped(t *testing.T) {
+	es := newTestEventStore(10)
+	h := newHTTPHandler(es, nil, conf.DefaultConfig())
+	client, stop := newGrpcTestClient(t, &h)
+	defer stop()
+
+	es.channel.closed = true
+	_, err := client.Capture(context.Background(), &eventsumpb.UnaddedEvent{
+		Service:     "wish_be",
+		Environment: "prod",
+		EventName:   "KeyError",
+		EventType:   "python",
+		Timestamp:   "2020-01-26 00:53:20",
+	})
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("expected a stopped server to be unavailable, got %v", err)
+	}
+}
@@ -1,15 +1,20 @@
 package eventsum
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
+	"unicode"
 
 	"github.com/julienschmidt/httprouter"
 
+	conf "github.com/ContextLogic/eventsum/config"
 	"github.com/ContextLogic/eventsum/log"
 	"github.com/ContextLogic/eventsum/metrics"
 	. "github.com/ContextLogic/eventsum/models"
@@ -21,7 +26,12 @@ type httpHandler struct {
 	es  *eventStore
 	log *log.Logger
 
-	timeFormat string
+	timeFormat     string
+	sentryProjects map[string]conf.SentryProject
+	otlp           conf.OTLPConfig
+	retryAfter     int // in seconds
+	timestamps     conf.TimestampConfig
+	auth           *authenticator // nil when API keys are not required
 }
 
 // statusRecorder is a simple http status recorder
@@ -49,12 +59,17 @@ func (sr *statusRecorder) WriteHeader(status int) {
 	sr.ResponseWriter.WriteHeader(status)
 }
 
-// Initializes a new httpHandler given configs (currently timeFormat)
-func newHTTPHandler(es *eventStore, logger *log.Logger, timeFormat string) httpHandler {
+// Initializes a new httpHandler given configs
+func newHTTPHandler(es *eventStore, logger *log.Logger, config conf.EventsumConfig) httpHandler {
 	return httpHandler{
-		es:         es,
-		log:        logger,
-		timeFormat: timeFormat,
+		es:             es,
+		log:            logger,
+		timeFormat:     config.TimeFormat,
+		sentryProjects: config.SentryProjects,
+		otlp:           config.OTLP,
+		retryAfter:     config.RetryAfter,
+		timestamps:     config.Timestamps,
+		auth:           newAuthenticator(config.Auth, es.ds),
 	}
 }
 
@@ -80,6 +95,17 @@ func (h *httpHandler) sendError(w http.ResponseWriter, code int, err error, mess
 	w.Write([]byte(errMsg))
 }
 
+// Rejects a capture because the ingest buffer is full, and tells the client
+// when to retry
+func (h *httpHandler) sendQueueFull(w http.ResponseWriter, err error) {
+	if err == errPayloadTooLarge {
+		h.sendError(w, http.StatusRequestEntityTooLarge, err, "Events not captured")
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(h.retryAfter))
+	h.sendError(w, http.StatusTooManyRequests, err, "Event not captured")
+}
+
 func (h *httpHandler) sendResp(w http.ResponseWriter, key string, val interface{}) {
 	var response []byte
 	if key == "" {
@@ -112,6 +138,9 @@ func (h *httpHandler) searchEventsHandler(w http.ResponseWriter, r *http.Request
 	keywords := ""
 	sort := ""
 
+	if service := keyService(r); service != "" {
+		serviceId = h.es.ds.GetServicesMap()[service].Id
+	}
 	if str := query.Get("service_id"); str != "" {
 		id, err := strconv.Atoi(str)
 		if err != nil {
@@ -120,6 +149,10 @@ func (h *httpHandler) searchEventsHandler(w http.ResponseWriter, r *http.Request
 		}
 		serviceId = id
 	}
+	if err := h.authorizeServiceId(r, serviceId); err != nil {
+		h.sendError(w, http.StatusForbidden, err, "Forbidden")
+		return
+	}
 	serviceIdMap[serviceId] = true
 
 	if str := query.Get("end_time"); str != "" {
@@ -279,25 +312,193 @@ func (h *httpHandler) captureEventsHandler(w http.ResponseWriter, r *http.Reques
 	defer r.Body.Close()
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&evt); err != nil {
-		h.sendError(w, http.StatusBadRequest, err, "Error decoding JSON event")
+		h.sendError(w, decodeErrorStatus(err), err, "Error decoding JSON event")
 		return
 	}
+	h.recordBodySize(r, evt.Service)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		evt.EventId = key
+	}
 
-	util.ProcessEventRawMessage(&evt)
+	if err := h.authorizeEvent(r.Context(), &evt); err != nil {
+		h.sendError(w, http.StatusForbidden, err, "Forbidden")
+		return
+	}
+	if err := h.validateEvent(&evt); err != nil {
+		h.sendError(w, validationStatus(err), err, "Invalid event")
+		return
+	}
+
+	// Send to batching channel
+	if err := h.es.Send(evt); err != nil {
+		h.sendQueueFull(w, err)
+	}
+}
 
-	// Validate the unadded event
-	if _, err := time.Parse(h.timeFormat, evt.Timestamp); err != nil {
-		h.sendError(w, http.StatusBadRequest, err, fmt.Sprintf("Ensure timestamp is in correct format: '%v'", h.timeFormat))
+// Accepts either a JSON array of events or newline delimited JSON, one event
+// per line. Every valid event is sent to the batching channel, and the response
+// lists the result of each item by its index in the request. Once the batching
+// channel is full, the remaining events are rejected, and the whole request is
+// rejected with a 429 if none of its events were accepted.
+func (h *httpHandler) captureBatchEventsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+	items, err := splitBatchBody(r.Body)
+	if err != nil {
+		h.sendError(w, decodeErrorStatus(err), err, "Error decoding JSON batch")
 		return
 	}
 
+	// body sizes are reported under the service of the batch, or under
+	// "mixed" if the batch contains events from more than one service
+	service := ""
+	accepted := 0
+	var queueErr error
+	results := make([]CaptureResult, len(items))
+	for i, item := range items {
+		results[i] = CaptureResult{Index: i, Accepted: true}
+
+		var evt UnaddedEvent
+		if err := json.Unmarshal(item, &evt); err != nil {
+			results[i].Accepted = false
+			results[i].Error = fmt.Sprintf("Error decoding JSON event: %v", err)
+			continue
+		}
+		if service == "" {
+			service = evt.Service
+		} else if service != evt.Service {
+			service = mixedServices
+		}
+
+		if err := h.authorizeEvent(r.Context(), &evt); err != nil {
+			results[i].Accepted = false
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := h.validateEvent(&evt); err != nil {
+			results[i].Accepted = false
+			results[i].Error = err.Error()
+			continue
+		}
+
+		if queueErr == nil {
+			queueErr = h.es.Send(evt)
+		}
+		if queueErr != nil {
+			results[i].Accepted = false
+			results[i].Error = queueErr.Error()
+			results[i].Retry = true
+			continue
+		}
+		accepted++
+	}
+	h.recordBodySize(r, service)
+	if queueErr != nil {
+		if accepted == 0 {
+			h.sendQueueFull(w, queueErr)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(h.retryAfter))
+	}
+	h.sendResp(w, "results", results)
+}
+
+// Processes the raw message of an event and checks that it contains the
+// fields required to be summarized, and that its service and environment are
+// known. The error of an unknown service or environment, or of a timestamp
+// rejected by the timestamp policy, is an unprocessableError. The timestamp is
+// normalized to the configured time format in UTC, the receive time is set, and
+// valid events are scrubbed then truncated.
+func (h *httpHandler) validateEvent(evt *UnaddedEvent) error {
+	util.ProcessEventRawMessage(evt)
+
+	now := time.Now().UTC()
+	t, err := util.ParseTimestamp(evt.Timestamp, h.timeFormat)
+	if err != nil {
+		return err
+	}
+	if t, err = h.applyTimestampPolicy(t, now); err != nil {
+		return err
+	}
+	evt.Timestamp = t.Format(h.timeFormat)
+	// fields set by the server only, whatever the client sent
+	evt.ReceivedAt = now.Format(time.RFC3339Nano)
+	evt.SampleWeight = 0
+
 	if evt.Name == "" || evt.Type == "" {
-		h.sendError(w, http.StatusBadRequest, errors.New("event_name and event_type cannot be empty"), "")
-		return
+		return errors.New("event_name and event_type cannot be empty")
 	}
 
-	// Send to batching channel
-	h.es.Send(evt)
+	if _, _, _, err = h.es.findServiceEnvironment(*evt); err != nil {
+		return err
+	}
+	h.es.scrub(evt)
+	h.es.truncate(evt)
+	return nil
+}
+
+// Applies the timestamp policy to an event time too far in the future or in
+// the past of the receive time
+func (h *httpHandler) applyTimestampPolicy(t, now time.Time) (time.Time, error) {
+	maxFuture := time.Duration(h.timestamps.MaxFuture) * time.Second
+	maxPast := time.Duration(h.timestamps.MaxPast) * time.Second
+	if (maxFuture <= 0 || !t.After(now.Add(maxFuture))) && (maxPast <= 0 || !t.Before(now.Add(-maxPast))) {
+		return t, nil
+	}
+
+	switch h.timestamps.Policy {
+	case conf.TimestampClamp:
+		return now, nil
+	case conf.TimestampReject:
+		return t, &unprocessableError{reasonTimestampOutOfRange,
+			fmt.Errorf("timestamp %s is too far from the receive time %s", t.Format(time.RFC3339), now.Format(time.RFC3339))}
+	}
+	return t, nil
+}
+
+// Splits a batch request body into its raw events. A body starting with '['
+// is decoded as a JSON array, anything else is read as newline delimited JSON
+// where blank lines are skipped.
+func splitBatchBody(body io.Reader) ([]json.RawMessage, error) {
+	reader := bufio.NewReader(body)
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, errors.New("empty batch")
+		} else if err != nil {
+			return nil, err
+		}
+		if !unicode.IsSpace(rune(b[0])) {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	var items []json.RawMessage
+	if b, _ := reader.Peek(1); b[0] == '[' {
+		decoder := json.NewDecoder(reader)
+		if err := decoder.Decode(&items); err != nil {
+			return nil, err
+		}
+		// a body is a single array, e.g. not arrays concatenated
+		if _, err := decoder.Token(); err == errBodyTooLarge {
+			return nil, err
+		} else if err != io.EOF {
+			return nil, errors.New("unexpected data after the batch array")
+		}
+		return items, nil
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			items = append(items, json.RawMessage(trimmed))
+		}
+		if err == io.EOF {
+			return items, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
 }
 
 func (h *httpHandler) searchGroupHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -401,6 +602,10 @@ func (h *httpHandler) opsdbEventsHandler(w http.ResponseWriter, r *http.Request,
 		h.sendError(w, http.StatusBadRequest, errors.New("wrong service query"), "Error")
 		return
 	}
+	if err := h.authorizeService(r, service); err != nil {
+		h.sendError(w, http.StatusForbidden, err, "Forbidden")
+		return
+	}
 	env := query.Get("environment")
 	if env == "" {
 		h.sendError(w, http.StatusBadRequest, errors.New("environment is missing"), "Error")
@@ -489,6 +694,7 @@ func (h *httpHandler) cpuAlertHandler(w http.ResponseWriter, r *http.Request, _
 	} else if s.S == "off" {
 		h.log.App().Info("DB CPU alert resolved, stop dropping to disk")
 		h.es.dropToDisk.TurnOff()
+		h.es.BackFillToDB()
 	} else {
 		h.log.App().Info("the switch should either be turned on or off.")
 	}
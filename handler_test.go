@@ -0,0 +1,379 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/datastore"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/rules"
+	"github.com/ContextLogic/eventsum/truncate"
+)
+
+func TestMain(m *testing.M) {
+	// handlers record prometheus metrics
+	if err := metrics.RegisterPromMetrics("eventsum_test"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// stubDataStore knows a few services and environments. Its other methods are
+// not implemented.
+type stubDataStore struct {
+	datastore.DataStore
+}
+
+func (stubDataStore) GetServicesMap() map[string]EventService {
+	return map[string]EventService{
+		"wish_be":         {Id: 1, Name: "wish_be"},
+		"merchant_be":     {Id: 2, Name: "merchant_be"},
+		"merchant_be_rpc": {Id: 3, Name: "merchant_be_rpc"},
+		"crond":           {Id: 4, Name: "crond"},
+	}
+}
+
+func (stubDataStore) GetServicesAggMap() map[string]string {
+	return map[string]string{"merchant_be": "merchant_be_rpc"}
+}
+
+func (stubDataStore) GetEnvironmentsMap() map[string]EventEnvironment {
+	return map[string]EventEnvironment{
+		"default": {Id: 1, Name: "default"},
+		"prod":    {Id: 2, Name: "prod"},
+	}
+}
+
+// Returns an event store backed by a stubDataStore, whose queue holds up to
+// size events
+func newTestEventStore(size int) *eventStore {
+	return &eventStore{
+		ds: stubDataStore{},
+		channel: &eventChannel{
+			queue:     make(chan UnaddedEvent, size),
+			BatchSize: size,
+			full:      make(chan struct{}, 1),
+			wait:      10 * time.Millisecond,
+		},
+		discarded: newDiscardLog(3),
+	}
+}
+func TestSplitBatchBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		count int
+		err   bool
+	}{
+		{"json array", `[{"event_name": "a"}, {"event_name": "b"}]`, 2, false},
+		{"json array with leading space", "\n  [{\"event_name\": \"a\"}]", 1, false},
+		{"ndjson", "{\"event_name\": \"a\"}\n\n{\"event_name\": \"b\"}\n", 2, false},
+		{"ndjson without trailing newline", "{\"event_name\": \"a\"}\n{\"event_name\": \"b\"}", 2, false},
+		{"ndjson with bad line", "{\"event_name\": \"a\"}\nnot json\n", 2, false},
+		{"malformed array", `[{"event_name": "a"}`, 0, true},
+		{"data after array", `[{"event_name": "a"}] {"event_name": "b"}`, 0, true},
+		{"concatenated arrays", `[{"event_name": "a"}][{"event_name": "b"}]`, 0, true},
+		{"array with trailing space", "[{\"event_name\": \"a\"}]\n ", 1, false},
+		{"empty", "  \n", 0, true},
+	}
+
+	for _, test := range tests {
+		items, err := splitBatchBody(strings.NewReader(test.body))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if len(items) != test.count {
+			t.Errorf("%s: expected %d items, got %d", test.name, test.count, len(items))
+		}
+	}
+}
+
+func TestCaptureUnknownServiceOrEnvironment(t *testing.T) {
+	es := newTestEventStore(10)
+	h := newHTTPHandler(es, nil, conf.DefaultConfig())
+	h.log = newTestLogger(t)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"known", `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`, http.StatusOK},
+		{"rpc exception", `{"service":"merchant_be","environment":"prod","event_name":"RPCException","event_type":"python","timestamp":"2020-01-26 00:53:20"}`, http.StatusOK},
+		{"unknown service", `{"service":"wish_fe","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`, http.StatusUnprocessableEntity},
+		{"unknown environment", `{"service":"wish_be","environment":"staging","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`, http.StatusUnprocessableEntity},
+		{"rpc exception without aggregation", `{"service":"wish_be","environment":"prod","event_name":"RPCException","event_type":"python","timestamp":"2020-01-26 00:53:20"}`, http.StatusUnprocessableEntity},
+		{"missing name", `{"service":"wish_be","environment":"prod","event_type":"python","timestamp":"2020-01-26 00:53:20"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(test.body)), nil)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body)
+		}
+	}
+	if len(es.channel.queue) != 2 {
+		t.Errorf("expected 2 queued events, got %d", len(es.channel.queue))
+	}
+}
+
+func TestDiscardLog(t *testing.T) {
+	d := newDiscardLog(3)
+	if evts := d.last(0); len(evts) != 0 {
+		t.Errorf("expected no events, got %+v", evts)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		d.add(DiscardedEvent{Event: UnaddedEvent{Name: name}, Reason: reasonUnknownService})
+	}
+
+	var names []string
+	for _, evt := range d.last(0) {
+		names = append(names, evt.Event.Name)
+	}
+	if strings.Join(names, "") != "edc" {
+		t.Errorf("expected the last 3 events, newest first, got %v", names)
+	}
+	if evts := d.last(1); len(evts) != 1 || evts[0].Event.Name != "e" {
+		t.Errorf("expected the last event, got %+v", evts)
+	}
+}
+
+func TestDiscardReason(t *testing.T) {
+	if reason := discardReason(&unprocessableError{reasonUnknownService, errors.New("unknown service")}); reason != reasonUnknownService {
+		t.Errorf("expected the reason of the error, got %s", reason)
+	}
+	if reason := discardReason(errors.New("registry is down")); reason != reasonUnprocessable {
+		t.Errorf("expected a generic reason, got %s", reason)
+	}
+}
+
+func TestCaptureQueueFull(t *testing.T) {
+	es := newTestEventStore(2)
+	h := newHTTPHandler(es, nil, conf.DefaultConfig())
+	h.log = newTestLogger(t)
+	evt := `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`
+
+	// the batch fills the queue, its last event is rejected
+	w := httptest.NewRecorder()
+	h.captureBatchEventsHandler(w, httptest.NewRequest("POST", "/capture/batch", strings.NewReader(evt+"\n"+evt+"\n"+evt)), nil)
+	var resp struct {
+		Results []CaptureResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	if len(resp.Results) != 3 || !resp.Results[1].Accepted || resp.Results[2].Accepted || !resp.Results[2].Retry || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected the last event to be rejected, got %+v", resp.Results)
+	}
+
+	for _, test := range []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		{"capture", func(w http.ResponseWriter, r *http.Request) { h.captureEventsHandler(w, r, nil) }},
+		{"batch", func(w http.ResponseWriter, r *http.Request) { h.captureBatchEventsHandler(w, r, nil) }},
+	} {
+		w := httptest.NewRecorder()
+		test.handler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(evt)))
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: expected a 429 with Retry-After, got %d %v", test.name, w.Code, w.Header())
+		}
+	}
+
+	// a batch is ready once the queue is full
+	select {
+	case <-es.channel.full:
+	default:
+		t.Errorf("expected a full batch to be signaled")
+	}
+}
+
+func TestSendAll(t *testing.T) {
+	es := newTestEventStore(3)
+	evt := UnaddedEvent{Service: "wish_be", Environment: "prod", Name: "KeyError", Type: "python"}
+	if err := es.Send(evt); err != nil {
+		t.Fatal(err)
+	}
+
+	// no event of a payload is sent without room for all of them
+	if err := es.SendAll([]UnaddedEvent{evt, evt, evt}); err != errQueueFull {
+		t.Errorf("expected the queue to be full, got %v", err)
+	}
+	if len(es.channel.queue) != 1 {
+		t.Errorf("expected no event of the payload to be sent, got %d events", len(es.channel.queue))
+	}
+	if err := es.SendAll([]UnaddedEvent{evt, evt}); err != nil || len(es.channel.queue) != 3 {
+		t.Errorf("expected the payload to be sent, got %d events, %v", len(es.channel.queue), err)
+	}
+	if err := es.SendAll([]UnaddedEvent{evt, evt, evt, evt}); err != errPayloadTooLarge {
+		t.Errorf("expected a payload larger than the queue to be rejected, got %v", err)
+	}
+}
+
+func TestCaptureAfterQueueClosed(t *testing.T) {
+	es := newTestEventStore(2)
+	h := newHTTPHandler(es, nil, conf.DefaultConfig())
+	h.log = newTestLogger(t)
+	es.closeQueue()
+
+	// late captures are rejected to be retried, instead of sent on the closed queue
+	w := httptest.NewRecorder()
+	evt := `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`
+	h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(evt)), nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429 once the queue is closed, got %d", w.Code)
+	}
+}
+
+func TestCaptureTimestamps(t *testing.T) {
+	now := time.Now().UTC()
+	future := now.Add(time.Hour)
+	tests := []struct {
+		name      string
+		timestamp string // JSON value
+		policy    string
+		status    int
+		expected  string // "now" for the receive time
+	}{
+		{"legacy format", `"2020-01-26 00:53:20"`, conf.TimestampAccept, http.StatusOK, "2020-01-26 00:53:20"},
+		{"rfc 3339 with offset", `"2020-01-26T02:53:20.5+02:00"`, conf.TimestampAccept, http.StatusOK, "2020-01-26 00:53:20"},
+		{"epoch seconds", `1580000000`, conf.TimestampAccept, http.StatusOK, "2020-01-26 00:53:20"},
+		{"epoch seconds string", `"1580000000.25"`, conf.TimestampAccept, http.StatusOK, "2020-01-26 00:53:20"},
+		{"epoch milliseconds", `1580000000123`, conf.TimestampAccept, http.StatusOK, "2020-01-26 00:53:20"},
+		{"invalid", `"yesterday"`, conf.TimestampAccept, http.StatusBadRequest, ""},
+		{"future clamped", fmt.Sprintf("%d", future.Unix()), conf.TimestampClamp, http.StatusOK, "now"},
+		{"past rejected", `"2020-01-26 00:53:20"`, conf.TimestampReject, http.StatusUnprocessableEntity, ""},
+		{"recent kept", fmt.Sprintf("%q", now.Format(time.RFC3339)), conf.TimestampReject, http.StatusOK, "now"},
+	}
+	for _, test := range tests {
+		es := newTestEventStore(1)
+		config := conf.DefaultConfig()
+		config.Timestamps.Policy = test.policy
+		h := newHTTPHandler(es, newTestLogger(t), config)
+
+		body := fmt.Sprintf(`{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":%s}`, test.timestamp)
+		w := httptest.NewRecorder()
+		h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(body)), nil)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		evt := <-es.channel.queue
+		if test.expected == "now" {
+			if ts, err := time.Parse(config.TimeFormat, evt.Timestamp); err != nil || ts.Sub(now) < -time.Second || ts.Sub(now) > 5*time.Second {
+				t.Errorf("%s: expected the receive time, got %s", test.name, evt.Timestamp)
+			}
+		} else if evt.Timestamp != test.expected {
+			t.Errorf("%s: expected timestamp %s, got %s", test.name, test.expected, evt.Timestamp)
+		}
+		if receivedAt, err := time.Parse(time.RFC3339Nano, evt.ReceivedAt); err != nil || receivedAt.Before(now) {
+			t.Errorf("%s: unexpected receive time %q", test.name, evt.ReceivedAt)
+		}
+	}
+}
+
+// countingDataStore counts the base ids looked up
+type countingDataStore struct {
+	periodDataStore
+	bases *int
+}
+
+func (c countingDataStore) FindEventBaseId(evt EventBase) (int64, error) {
+	*c.bases++
+	return c.periodDataStore.FindEventBaseId(evt)
+}
+
+func TestSaveInvalidTimestamp(t *testing.T) {
+	globalRule = rules.NewRule()
+	bases := 0
+	es := newTestEventStore(1)
+	es.ds = countingDataStore{periodDataStore{periods: map[int]EventInstancePeriod{}}, &bases}
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+
+	// no row is added for an event discarded for its timestamp
+	evt := UnaddedEvent{Service: "wish_be", Environment: "prod", Name: "KeyError", Type: "python", Timestamp: "yesterday"}
+	if err := es.SaveToDB([]UnaddedEvent{evt}); err != nil {
+		t.Fatal(err)
+	}
+	if discarded := es.discarded.last(0); len(discarded) != 1 || discarded[0].Reason != reasonInvalidTimestamp {
+		t.Errorf("expected the event to be discarded, got %+v", discarded)
+	}
+	if bases != 0 {
+		t.Errorf("expected no base to be looked up, got %d", bases)
+	}
+}
+
+// baseDataStore keeps the bases looked up
+type baseDataStore struct {
+	periodDataStore
+	bases *[]EventBase
+}
+
+func (b baseDataStore) FindEventBaseId(evt EventBase) (int64, error) {
+	*b.bases = append(*b.bases, evt)
+	return b.periodDataStore.FindEventBaseId(evt)
+}
+
+func TestSaveTruncatesFilteredEvents(t *testing.T) {
+	globalRule = rules.NewRule()
+	globalRule.AddFilter("expand", func(data EventData) (EventData, error) {
+		data.Raw = strings.Repeat("x", 100)
+		return data, nil
+	})
+	var bases []EventBase
+	es := newTestEventStore(1)
+	es.ds = baseDataStore{periodDataStore{periods: map[int]EventInstancePeriod{}}, &bases}
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	es.truncator = truncate.New(conf.LimitsConfig{StringLength: 8})
+
+	// the output of a filter is truncated before being hashed
+	evt := UnaddedEvent{Service: "wish_be", Environment: "prod", Name: "KeyError", Type: "python", Timestamp: "2020-01-26 00:53:20",
+		ConfigurableFilters: map[string][]string{"base": {"expand"}}}
+	if err := es.SaveToDB([]UnaddedEvent{evt}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 1 || bases[0].ProcessedData.Raw != "xxxxxxxx...[truncated 92 bytes]" {
+		t.Errorf("expected the filtered data to be truncated, got %+v", bases)
+	}
+}
+
+func TestCaptureIgnoresServerFields(t *testing.T) {
+	es := newTestEventStore(1)
+	h := newHTTPHandler(es, newTestLogger(t), conf.DefaultConfig())
+
+	body := `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20",
+		"sample_weight":1000,"received_at":"2000-01-01T00:00:00Z"}`
+	w := httptest.NewRecorder()
+	h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(body)), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	evt := <-es.channel.queue
+	if evt.SampleWeight != 0 || strings.HasPrefix(evt.ReceivedAt, "2000") {
+		t.Errorf("expected the fields set by the server not to be sent by clients, got %+v", evt)
+	}
+}
@@ -0,0 +1,218 @@
+package eventsum
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// idCache maps the hashes of rows to their ids, evicting the least recently
+// used ids once full, and the ids older than the TTL if any
+type idCache struct {
+	sync.Mutex
+	name    string // of the cache in metrics
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+
+	hits    int64
+	lookups int64
+}
+
+type idEntry struct {
+	key       string
+	id        int64
+	baseId    int64 // of the instances, to be invalidated with their base
+	expiresAt time.Time
+}
+
+func newIDCache(name string, config conf.IDCacheConfig) *idCache {
+	return &idCache{
+		name:    name,
+		size:    config.Size,
+		ttl:     time.Duration(config.TTL) * time.Second,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Returns the id cached for a key, if any and not expired
+func (c *idCache) get(key string, now time.Time) (int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lookups++
+	e, ok := c.entries[key]
+	if ok && c.ttl > 0 && now.After(e.Value.(*idEntry).expiresAt) {
+		c.remove(e)
+		ok = false
+	}
+	if ok {
+		c.hits++
+		c.order.MoveToFront(e)
+	}
+	metrics.IDCacheLookup(c.name, ok, float64(c.hits)/float64(c.lookups))
+	if !ok {
+		return 0, false
+	}
+	return e.Value.(*idEntry).id, true
+}
+
+func (c *idCache) add(key string, id, baseId int64, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&idEntry{key, id, baseId, now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	metrics.IDCacheSize(c.name, len(c.entries))
+}
+
+func (c *idCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*idEntry).key)
+}
+
+// Removes the ids of the rows of the given bases, or every id if bases is
+// empty. Ids of bases are matched by id, ids of instances by base id.
+func (c *idCache) invalidate(bases map[int64]bool, byBase bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*idEntry)
+		id := entry.id
+		if byBase {
+			id = entry.baseId
+		}
+		if len(bases) == 0 || bases[id] {
+			c.remove(e)
+		}
+		e = next
+	}
+	metrics.IDCacheSize(c.name, len(c.entries))
+}
+
+// idCaches sit in front of the lookups of the ids of event bases, details and
+// instances, which are made for every event saved. Ids are looked up by the
+// columns of the unique rows they identify.
+type idCaches struct {
+	bases     *idCache
+	details   *idCache
+	instances *idCache
+}
+
+// Returns nil if the caches are disabled
+func newIDCaches(config conf.IDCacheConfig) *idCaches {
+	if config.Size <= 0 {
+		return nil
+	}
+	return &idCaches{
+		bases:     newIDCache("event_base", config),
+		details:   newIDCache("event_detail", config),
+		instances: newIDCache("event_instance", config),
+	}
+}
+
+func (es *eventStore) findEventBaseId(evt EventBase) (int64, error) {
+	if es.ids == nil {
+		return es.ds.FindEventBaseId(evt)
+	}
+	now := time.Now()
+	key := fmt.Sprintf("%d/%d/%s/%s", evt.ServiceId, evt.EventEnvironmentId, evt.EventType, evt.ProcessedDataHash)
+	if id, ok := es.ids.bases.get(key, now); ok {
+		return id, nil
+	}
+	id, err := es.ds.FindEventBaseId(evt)
+	if err == nil {
+		es.ids.bases.add(key, id, id, now)
+	}
+	return id, err
+}
+
+func (es *eventStore) findEventDetailId(evt EventDetail) (int64, error) {
+	if es.ids == nil {
+		return es.ds.FindEventDetailId(evt)
+	}
+	now := time.Now()
+	if id, ok := es.ids.details.get(evt.ProcessedDetailHash, now); ok {
+		return id, nil
+	}
+	id, err := es.ds.FindEventDetailId(evt)
+	if err == nil {
+		es.ids.details.add(evt.ProcessedDetailHash, id, 0, now)
+	}
+	return id, err
+}
+
+// An instance failing to be added may refer to a base merged or deleted since
+// its id was cached, so the id of the base is then invalidated.
+func (es *eventStore) findEventInstanceId(evt EventInstance) (int64, error) {
+	if es.ids == nil {
+		return es.ds.FindEventInstanceId(evt)
+	}
+	now := time.Now()
+	key := fmt.Sprintf("%d/%s", evt.EventEnvironmentId, evt.GenericDataHash)
+	if id, ok := es.ids.instances.get(key, now); ok {
+		return id, nil
+	}
+	id, err := es.ds.FindEventInstanceId(evt)
+	if err != nil {
+		es.invalidateEventBases([]int64{int64(evt.EventBaseId)})
+		return id, err
+	}
+	es.ids.instances.add(key, id, int64(evt.EventBaseId), now)
+	return id, nil
+}
+
+// Removes the cached ids of the given bases and of their instances, or every
+// cached id if ids is empty. Bases are only merged or deleted outside of
+// eventsum, e.g. by hand in the DB, so this is not called when they are: it is
+// up to operators to call the invalidate endpoint on every server then.
+func (es *eventStore) invalidateEventBases(ids []int64) {
+	if es.ids == nil {
+		return
+	}
+	bases := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		bases[id] = true
+	}
+	es.ids.bases.invalidate(bases, false)
+	es.ids.instances.invalidate(bases, true)
+	if len(ids) == 0 {
+		es.ids.details.invalidate(nil, false)
+	}
+}
+
+type invalidateIDCacheRequest struct {
+	EventBaseIds []int64 `json:"event_base_ids"`
+}
+
+// Invalidates the cached ids of event bases merged or deleted, along with the
+// ids of their instances. Every cached id is invalidated if no base is given.
+func (h *httpHandler) invalidateIDCacheHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+	var req invalidateIDCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.sendError(w, http.StatusBadRequest, err, "Error decoding JSON request")
+		return
+	}
+	h.es.invalidateEventBases(req.EventBaseIds)
+	h.sendResp(w, "event_base_ids", req.EventBaseIds)
+}
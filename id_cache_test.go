@@ -0,0 +1,99 @@
+package eventsum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/rules"
+)
+
+// lookupDataStore counts the lookups of ids reaching the datastore
+type lookupDataStore struct {
+	periodDataStore
+	lookups *int
+}
+
+func (l lookupDataStore) FindEventBaseId(evt EventBase) (int64, error) {
+	*l.lookups++
+	return l.periodDataStore.FindEventBaseId(evt)
+}
+
+func (l lookupDataStore) FindEventDetailId(evt EventDetail) (int64, error) {
+	*l.lookups++
+	return l.periodDataStore.FindEventDetailId(evt)
+}
+
+func (l lookupDataStore) FindEventInstanceId(evt EventInstance) (int64, error) {
+	*l.lookups++
+	return l.periodDataStore.FindEventInstanceId(evt)
+}
+
+func TestIDCacheLRU(t *testing.T) {
+	now := time.Now()
+	c := newIDCache("test", conf.IDCacheConfig{Size: 2, TTL: 60})
+	c.add("a", 1, 0, now)
+	c.add("b", 2, 0, now)
+	c.get("a", now)
+	c.add("c", 3, 0, now)
+	if _, ok := c.get("b", now); ok {
+		t.Errorf("expected the least recently used id to be evicted")
+	}
+	if id, ok := c.get("a", now); !ok || id != 1 {
+		t.Errorf("expected id 1 to be cached, got %d, %v", id, ok)
+	}
+	if _, ok := c.get("c", now.Add(61*time.Second)); ok {
+		t.Errorf("expected the id to expire after the TTL")
+	}
+	if c.hits != 2 || c.lookups != 4 {
+		t.Errorf("expected 2 hits out of 4 lookups, got %d out of %d", c.hits, c.lookups)
+	}
+}
+
+func TestIDCacheSaveAndInvalidate(t *testing.T) {
+	globalRule = rules.NewRule()
+	lookups := 0
+	ds := lookupDataStore{periodDataStore{periods: map[int]EventInstancePeriod{}}, &lookups}
+	es := newTestEventStore(5)
+	es.ds = ds
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	es.ids = newIDCaches(conf.IDCacheConfig{Size: 10})
+	h := newHTTPHandler(es, es.log, conf.DefaultConfig())
+
+	evts := []UnaddedEvent{{
+		Service:     "wish_be",
+		Environment: "prod",
+		Name:        "KeyError",
+		Type:        "python",
+		Data:        EventData{Message: "a", Raw: "a"},
+		Timestamp:   "2020-01-26 00:53:20",
+	}}
+	for i := 0; i < 3; i++ {
+		if err := es.SaveToDB(evts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("expected the ids to be looked up once, got %d lookups", lookups)
+	}
+
+	// the base and its instances are looked up again once invalidated
+	w := httptest.NewRecorder()
+	h.invalidateIDCacheHandler(w, httptest.NewRequest("POST", "/admin/id_cache/invalidate", strings.NewReader(`{"event_base_ids": [1]}`)), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if err := es.SaveToDB(evts); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 5 {
+		t.Errorf("expected the base and instance ids to be looked up again, got %d lookups", lookups)
+	}
+}
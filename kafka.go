@@ -0,0 +1,249 @@
+package eventsum
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/log"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Bounds of the backoff between two attempts at saving a batch, or at
+// rejoining the consumer group
+const (
+	kafkaMinBackoff = 500 * time.Millisecond
+	kafkaMaxBackoff = 30 * time.Second
+)
+
+// kafkaConsumer consumes UnaddedEvent JSON messages from a kafka topic. Events
+// go through the same dedupe, sampling rules and quotas as the events sent
+// over HTTP. The messages of a partition are batched and saved synchronously,
+// and an offset is only marked, hence committed, once the periods of the batch
+// holding it are saved, i.e. after the next flush when periods are aggregated.
+// Events consumed after the last commit are replayed after a crash.
+type kafkaConsumer struct {
+	groups  []sarama.ConsumerGroup // one per group member run by this server
+	topic   string
+	handler *kafkaHandler
+	log     *log.Logger
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// kafkaHandler implements sarama.ConsumerGroupHandler
+type kafkaHandler struct {
+	batchSize int
+	timeLimit time.Duration
+	validate  func(*UnaddedEvent) error
+	admit     func(*UnaddedEvent) bool   // false for events acknowledged but not saved
+	forget    func([]UnaddedEvent)       // events admitted but not saved
+	save      func([]UnaddedEvent) error // saves the periods, or adds them to the aggregator
+	commit    func(func())               // runs a commit once the periods saved are flushed
+	flush     func() error               // flushes the periods aggregated
+	log       *log.Logger
+}
+
+// Creates the members of the consumer group described by the config
+func newKafkaConsumer(config conf.EventsumConfig, h *httpHandler, logger *log.Logger) (*kafkaConsumer, error) {
+	version, err := sarama.ParseKafkaVersion(config.Kafka.Version)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing kafka version")
+	}
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = version
+	saramaConfig.ClientID = "eventsum"
+	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	handler := &kafkaHandler{
+		batchSize: config.BatchSize,
+		timeLimit: time.Duration(config.TimeLimit) * time.Second,
+		validate:  h.validateEvent,
+		admit:     h.es.admit,
+		forget:    h.es.forget,
+		save:      h.es.SaveToDB,
+		commit:    h.es.afterFlush,
+		flush:     h.es.flushPeriods,
+		log:       logger,
+	}
+	return newKafkaConsumerFromConfig(config.Kafka, saramaConfig, handler, logger)
+}
+
+func newKafkaConsumerFromConfig(kafkaConfig conf.KafkaConfig, saramaConfig *sarama.Config, handler *kafkaHandler, logger *log.Logger) (*kafkaConsumer, error) {
+	kc := &kafkaConsumer{topic: kafkaConfig.Topic, handler: handler, log: logger}
+	parallelism := kafkaConfig.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	for i := 0; i < parallelism; i++ {
+		group, err := sarama.NewConsumerGroup(kafkaConfig.Brokers, kafkaConfig.Group, saramaConfig)
+		if err != nil {
+			kc.close()
+			return nil, errors.Wrap(err, "creating kafka consumer group")
+		}
+		kc.groups = append(kc.groups, group)
+	}
+	return kc, nil
+}
+
+// Starts consuming the topic. A new session is joined every time the group
+// rebalances, until Stop is called.
+func (kc *kafkaConsumer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	kc.cancel = cancel
+	for _, group := range kc.groups {
+		kc.wg.Add(1)
+		go func(group sarama.ConsumerGroup) {
+			defer kc.wg.Done()
+			backoff := kafkaMinBackoff
+			for ctx.Err() == nil {
+				err := group.Consume(ctx, []string{kc.topic}, kc.handler)
+				if err == nil {
+					backoff = kafkaMinBackoff
+					continue
+				}
+				kc.log.App().Errorf("Error consuming kafka topic %s: %v", kc.topic, err)
+				if !sleepContext(ctx, backoff) {
+					return
+				}
+				backoff = nextBackoff(backoff)
+			}
+		}(group)
+	}
+	kc.log.App().Printf("Consuming kafka topic %s with %d consumers", kc.topic, len(kc.groups))
+}
+
+// Stops consuming once the batches being saved are done, committing their
+// offsets, and leaves the group
+func (kc *kafkaConsumer) Stop() {
+	if kc.cancel != nil {
+		kc.cancel()
+	}
+	kc.wg.Wait()
+	kc.close()
+}
+
+func (kc *kafkaConsumer) close() {
+	for _, group := range kc.groups {
+		if err := group.Close(); err != nil {
+			kc.log.App().Errorf("Error closing kafka consumer group: %v", err)
+		}
+	}
+}
+
+func (kh *kafkaHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (kh *kafkaHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+// Batches the messages of a partition until the batch is full or the time
+// limit is reached, then saves it. Messages that are not valid events, or not
+// admitted, are skipped, but still marked along with the rest of their batch.
+// Offsets are committed when the session ends, so the periods aggregated are
+// then flushed for the marks waiting for them, once per session rather than
+// once per batch.
+func (kh *kafkaHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ticker := time.NewTicker(kh.timeLimit)
+	defer ticker.Stop()
+
+	var evts []UnaddedEvent
+	var last *sarama.ConsumerMessage
+	defer func() {
+		// the events not saved are consumed again by the next owner of the
+		// partition, and must not be taken for duplicates then
+		kh.forget(evts)
+		if err := kh.flush(); err != nil {
+			kh.log.App().Errorf("Error flushing the periods of kafka batches, their offsets are not committed: %v", err)
+		}
+	}()
+	flush := func() bool {
+		if last == nil {
+			return true
+		}
+		if evts = kh.saveBatch(session.Context(), evts); len(evts) > 0 {
+			return false
+		}
+		msg := last
+		kh.commit(func() { session.MarkMessage(msg, "") })
+		last = nil
+		return true
+	}
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				flush()
+				return nil
+			}
+			last = msg
+			if evt, err := kh.decode(msg.Value); err != nil {
+				kh.log.App().Infof("Skipping invalid kafka event at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			} else if kh.admit(&evt) {
+				evts = append(evts, evt)
+			}
+			if len(evts) >= kh.batchSize && !flush() {
+				return nil
+			}
+		case <-ticker.C:
+			if !flush() {
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (kh *kafkaHandler) decode(b []byte) (UnaddedEvent, error) {
+	var evt UnaddedEvent
+	if err := json.Unmarshal(b, &evt); err != nil {
+		return evt, err
+	}
+	err := kh.validate(&evt)
+	return evt, err
+}
+
+// Saves the batch, retrying the events not saved with a backoff until they
+// are. Returns the events left if the session ended first, in which case the
+// batch will be consumed again by the next owner of the partition.
+func (kh *kafkaHandler) saveBatch(ctx context.Context, evts []UnaddedEvent) []UnaddedEvent {
+	if len(evts) == 0 {
+		return nil
+	}
+	backoff := kafkaMinBackoff
+	for {
+		err := kh.save(evts)
+		if err == nil {
+			return nil
+		}
+		_, evts = splitSaved(evts, err)
+		kh.log.App().Errorf("Error saving kafka batch, retrying %d events in %v: %v", len(evts), backoff, err)
+		if !sleepContext(ctx, backoff) {
+			return evts
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > kafkaMaxBackoff {
+		return kafkaMaxBackoff
+	}
+	return backoff
+}
+
+// Sleeps for d, returns false if the context was done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
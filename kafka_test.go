@@ -0,0 +1,177 @@
+package eventsum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/log"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+func TestKafkaConsumer(t *testing.T) {
+	const topic, group = "events", "eventsum"
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, group, broker),
+		"JoinGroupRequest": sarama.NewMockWrapper(&sarama.JoinGroupResponse{
+			Version:       1,
+			GenerationId:  1,
+			GroupProtocol: sarama.BalanceStrategyRange.Name(),
+			LeaderId:      "leader",
+			MemberId:      "member",
+		}),
+		"SyncGroupRequest": sarama.NewMockWrapper(&sarama.SyncGroupResponse{
+			MemberAssignment: memberAssignment(topic, 0),
+		}),
+		"HeartbeatRequest":  sarama.NewMockWrapper(&sarama.HeartbeatResponse{}),
+		"LeaveGroupRequest": sarama.NewMockWrapper(&sarama.LeaveGroupResponse{}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(group, topic, 0, -1, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 4),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 4).
+			SetVersion(3).
+			SetMessage(topic, 0, 0, sarama.StringEncoder(`{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20","event_id":"a1"}`)).
+			SetMessage(topic, 0, 1, sarama.StringEncoder(`not an event`)).
+			SetMessage(topic, 0, 2, sarama.StringEncoder(`{"service":"wish_be","environment":"prod","event_name":"ValueError","event_type":"python","timestamp":"2020-01-26 00:53:21"}`)).
+			// a retry of the first event, which is deduplicated
+			SetMessage(topic, 0, 3, sarama.StringEncoder(`{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20","event_id":"a1"}`)).
+			SetHighWaterMark(topic, 0, 4),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+
+	es := newTestEventStore(0)
+	es.log = newTestLogger(t)
+	es.dedupe = newDedupeStore(conf.DedupeConfig{TTL: 60, MaxKeys: 10}, nil, es.log)
+	// offsets are only committed once the periods are flushed, here when the
+	// session ends
+	var upserts [][]EventInstancePeriod
+	var upsertErr error
+	es.ds = upsertDataStore{periodDataStore{periods: map[int]EventInstancePeriod{}}, &upserts, &upsertErr}
+	es.aggregator = newAggregator(conf.AggregationConfig{FlushInterval: 60, MaxPeriods: 10, Shards: 1})
+	h := newHTTPHandler(es, nil, conf.DefaultConfig())
+	saved := make(chan []UnaddedEvent, 10)
+	commits := make(chan struct{}, 10)
+	failures := 1
+	var mu sync.Mutex
+	handler := &kafkaHandler{
+		batchSize: 2,
+		timeLimit: 50 * time.Millisecond,
+		validate:  h.validateEvent,
+		admit:     es.admit,
+		forget:    es.forget,
+		commit: func(commit func()) {
+			es.afterFlush(commit)
+			commits <- struct{}{}
+		},
+		flush: es.flushPeriods,
+		save: func(evts []UnaddedEvent) error {
+			mu.Lock()
+			defer mu.Unlock()
+			// the first attempt fails, and must be retried before committing
+			if failures > 0 {
+				failures--
+				return errors.New("database is down")
+			}
+			saved <- evts
+			return nil
+		},
+		log: newTestLogger(t),
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Version = sarama.V0_10_2_0
+	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	saramaConfig.Consumer.Offsets.AutoCommit.Interval = 10 * time.Millisecond
+	kafkaConfig := conf.KafkaConfig{Brokers: []string{broker.Addr()}, Topic: topic, Group: group, Parallelism: 1}
+	kc, err := newKafkaConsumerFromConfig(kafkaConfig, saramaConfig, handler, handler.log)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kc.Start()
+
+	select {
+	case evts := <-saved:
+		if len(evts) != 2 || evts[0].Name != "KeyError" || evts[1].Name != "ValueError" {
+			t.Fatalf("unexpected batch: %+v", evts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the batch to be saved")
+	}
+	// the batch, then the deduplicated event
+	for i := 0; i < 2; i++ {
+		select {
+		case <-commits:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the offsets to be marked")
+		}
+	}
+	kc.Stop()
+
+	var committed int64 = -1
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			if offset, _, err := req.Offset(topic, 0); err == nil {
+				committed = offset
+			}
+		}
+	}
+	if committed != 4 {
+		t.Errorf("expected offset 4 to be committed, got %d", committed)
+	}
+	if len(saved) != 0 {
+		t.Errorf("expected the retried event to be deduplicated, got %+v", <-saved)
+	}
+}
+
+func TestKafkaConfigEnabled(t *testing.T) {
+	if conf.DefaultConfig().Kafka.Enabled() {
+		t.Error("expected kafka to be disabled by default")
+	}
+	if !(conf.KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "events"}).Enabled() {
+		t.Error("expected kafka to be enabled")
+	}
+}
+
+// Encodes the assignment of the given partitions, as sent by the group leader
+func memberAssignment(topic string, partitions ...int32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, int16(0)) // version
+	binary.Write(&buf, binary.BigEndian, int32(1)) // number of topics
+	binary.Write(&buf, binary.BigEndian, int16(len(topic)))
+	buf.WriteString(topic)
+	binary.Write(&buf, binary.BigEndian, int32(len(partitions)))
+	for _, p := range partitions {
+		binary.Write(&buf, binary.BigEndian, p)
+	}
+	binary.Write(&buf, binary.BigEndian, int32(-1)) // no user data
+	return buf.Bytes()
+}
+
+func newTestLogger(t *testing.T) *log.Logger {
+	f, err := ioutil.TempFile("", "logconfig")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"log_save_data_interval": 60, "log_data_period_check_interval": 60}`)
+	f.Close()
+	return log.NewLogger(f.Name(), nil)
+}
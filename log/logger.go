@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -72,26 +74,84 @@ func (l *Logger) Start(c config) {
 	}
 }
 
-func (l *Logger) DropEventToDiskLog(evts []UnaddedEvent) {
+// Suffix of the files events are dropped to
+const eventLogSuffix = "-events-buffers.log"
 
-	filename := fmt.Sprintf("%d-events-buffers", time.Now().Unix())
-
-	evtFile, err := open(filepath.Join(l.eventDir, filename))
-	defer evtFile.Close()
+// Writes events to a new file of the event dir, one JSON event per line
+func (l *Logger) DropEventToDiskLog(evts []UnaddedEvent) error {
+	if err := os.MkdirAll(l.eventDir, 0755); err != nil {
+		return err
+	}
+	filename := filepath.Join(l.eventDir, fmt.Sprintf("%d%s", time.Now().UnixNano(), eventLogSuffix))
+	return WriteEventLog(filename, evts)
+}
 
+// Writes events to a file, one JSON event per line, replacing the file if it
+// exists. The file is written under a temporary name, so that the files listed
+// by EventLogFiles are complete.
+func WriteEventLog(filename string, evts []UnaddedEvent) error {
+	evtFile, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		//drop the event directly
-		return
+		return err
 	}
+
+	w := bufio.NewWriter(evtFile)
 	for _, evt := range evts {
-		jsonData, err := json.Marshal(evt)
+		jsonData, err := json.Marshal(NewStoredEvent(evt))
 		if err != nil {
 			//drop the event directly
 			continue
 		}
+		w.Write(jsonData)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err == nil {
+		err = evtFile.Sync()
+	}
+	if cerr := evtFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+	}
+	return err
+}
 
-		evtFile.WriteString(string(jsonData))
-		evtFile.WriteString("\n")
+// Lists the files events were dropped to, oldest first
+func (l *Logger) EventLogFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(l.eventDir, "*"+eventLogSuffix))
+	sort.Strings(files)
+	return files, err
+}
+
+// Reads the events of a file written by DropEventToDiskLog
+func ReadEventLog(filename string) ([]UnaddedEvent, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var evts []UnaddedEvent
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			evt, jerr := DecodeStoredEvent(line)
+			if jerr != nil {
+				return evts, jerr
+			}
+			evts = append(evts, evt)
+		}
+		if err == io.EOF {
+			return evts, nil
+		} else if err != nil {
+			return evts, err
+		}
 	}
 }
 
@@ -321,6 +381,7 @@ func NewLogger(configFile string, ds datastore.DataStore) *Logger {
 		},
 		appDir:      config.AppDir,
 		dataDir:     config.DataDir,
+		eventDir:    config.EventDir,
 		endOfDay:    endOfDay,
 		tickerDump:  time.NewTicker(time.Duration(config.LogSaveDataInterval) * time.Second),
 		tickerCheck: time.NewTicker(time.Duration(config.LogDataPeriodCheckInterval) * time.Second),
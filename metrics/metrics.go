@@ -28,3 +28,124 @@ func HTTPStatus(path string, status int) {
 func bucketHTTPStatus(i int) int {
 	return i - i%100
 }
+
+// EventDiscarded counts an event accepted at capture but discarded before being saved.
+func EventDiscarded(reason string) {
+	discardedEvents.WithLabelValues(reason).Inc()
+}
+
+// IngestQueue records the number of events waiting in the ingest buffer, out of its capacity.
+func IngestQueue(length, capacity int) {
+	ingestQueueLength.Set(float64(length))
+	ingestQueueCapacity.Set(float64(capacity))
+}
+
+// IngestWait records the time a capture waited for room in the ingest buffer.
+func IngestWait(start time.Time) {
+	ingestWait.Observe(msSince(start))
+}
+
+// IngestRejected counts a capture rejected because the ingest buffer stayed full.
+func IngestRejected() {
+	ingestRejected.Inc()
+}
+
+// DedupeHit counts a retried event found in the given dedupe store.
+func DedupeHit(store string) {
+	dedupeHits.WithLabelValues(store).Inc()
+}
+
+// QuotaDropped counts an event dropped because its service was over the given limit.
+func QuotaDropped(service, environment, limit string) {
+	quotaDroppedEvents.WithLabelValues(service, environment, limit).Inc()
+}
+
+// SampledOut counts an event of a service not kept by a sampling rule.
+func SampledOut(service string) {
+	sampledOutEvents.WithLabelValues(service).Inc()
+}
+
+// Scrubbed counts an event with values replaced by the given scrub rule.
+func Scrubbed(rule string) {
+	scrubbedEvents.WithLabelValues(rule).Inc()
+}
+
+// AuthRejected counts a request or an event rejected for its API key.
+func AuthRejected(reason string) {
+	authRejected.WithLabelValues(reason).Inc()
+}
+
+// Truncated counts an event truncated to a limit, or a request body over the
+// body size limit.
+func Truncated(limit string) {
+	truncatedEvents.WithLabelValues(limit).Inc()
+}
+
+// DroppedToDisk counts events dropped to disk instead of being saved.
+func DroppedToDisk(n int) {
+	droppedToDiskEvents.Add(float64(n))
+}
+
+// Backfilled counts events dropped to disk, then saved.
+func Backfilled(n int) {
+	backfilledEvents.Add(float64(n))
+}
+
+// SavePoolCapacity records the number of save workers and the size of their queue.
+func SavePoolCapacity(workers, size int) {
+	savePoolWorkers.Set(float64(workers))
+	savePoolQueueCapacity.Set(float64(size))
+}
+
+// SavePool records the number of busy save workers and of batches queued.
+func SavePool(busy, queued int) {
+	savePoolBusyWorkers.Set(float64(busy))
+	savePoolQueuedBatches.Set(float64(queued))
+}
+
+// SavePoolWait records the time spent waiting for room in a full save queue.
+func SavePoolWait(start time.Time) {
+	savePoolWait.Observe(msSince(start))
+}
+
+// AggregatedPeriods records the number of event instance periods counted in memory.
+func AggregatedPeriods(n int) {
+	aggregatedPeriods.Set(float64(n))
+}
+
+// PeriodsFlushed counts event instance periods saved by a flush of the aggregator.
+func PeriodsFlushed(n int) {
+	flushedPeriods.Add(float64(n))
+}
+
+// AggregationOverflow counts an event instance period saved directly because the aggregator was full.
+func AggregationOverflow() {
+	aggregationOverflow.Inc()
+}
+
+// IDCacheLookup counts an id lookup in a cache, and records the hit ratio of the cache.
+func IDCacheLookup(cache string, hit bool, ratio float64) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	idCacheLookups.WithLabelValues(cache, result).Inc()
+	idCacheHitRatio.WithLabelValues(cache).Set(ratio)
+}
+
+// IDCacheSize records the number of ids held by a cache.
+func IDCacheSize(cache string, n int) {
+	idCacheSize.WithLabelValues(cache).Set(float64(n))
+}
+
+// WALSegments records the number of write-ahead log segments on disk, and their total size.
+func WALSegments(segments int, bytes int64) {
+	walSegments.Set(float64(segments))
+	walBytes.Set(float64(bytes))
+}
+
+// RequestBodyBytes records the size of a request body on the wire and after decompression.
+func RequestBodyBytes(service, encoding string, compressed, decompressed int64) {
+	requestCompressedBytes.WithLabelValues(service, encoding).Add(float64(compressed))
+	requestDecompressedBytes.WithLabelValues(service, encoding).Add(float64(decompressed))
+}
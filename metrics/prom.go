@@ -12,6 +12,44 @@ var (
 	httpStatus             *prometheus.CounterVec
 	eventStoreDbErrCounter *prometheus.CounterVec
 	eventStoreTimer        *prometheus.HistogramVec
+
+	requestCompressedBytes   *prometheus.CounterVec
+	requestDecompressedBytes *prometheus.CounterVec
+
+	discardedEvents *prometheus.CounterVec
+
+	ingestQueueLength   prometheus.Gauge
+	ingestQueueCapacity prometheus.Gauge
+	ingestWait          prometheus.Histogram
+	ingestRejected      prometheus.Counter
+
+	dedupeHits *prometheus.CounterVec
+
+	quotaDroppedEvents *prometheus.CounterVec
+	sampledOutEvents   *prometheus.CounterVec
+	scrubbedEvents     *prometheus.CounterVec
+	authRejected       *prometheus.CounterVec
+	truncatedEvents    *prometheus.CounterVec
+
+	walSegments prometheus.Gauge
+	walBytes    prometheus.Gauge
+
+	droppedToDiskEvents prometheus.Counter
+	backfilledEvents    prometheus.Counter
+
+	savePoolWorkers       prometheus.Gauge
+	savePoolQueueCapacity prometheus.Gauge
+	savePoolBusyWorkers   prometheus.Gauge
+	savePoolQueuedBatches prometheus.Gauge
+	savePoolWait          prometheus.Histogram
+
+	aggregatedPeriods   prometheus.Gauge
+	flushedPeriods      prometheus.Counter
+	aggregationOverflow prometheus.Counter
+
+	idCacheLookups  *prometheus.CounterVec
+	idCacheHitRatio *prometheus.GaugeVec
+	idCacheSize     *prometheus.GaugeVec
 )
 
 // RegisterPromMetrics registers all the metrics that eventsum uses.
@@ -46,6 +84,204 @@ func RegisterPromMetrics(dbname string) error {
 		Buckets:   buckets(),
 	}, []string{"method"})
 
+	requestCompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "http_server",
+		Name:      "request_compressed_bytes",
+		Help:      "The number of request body bytes received on the wire by service and content encoding",
+	}, []string{"service", "encoding"})
+
+	requestDecompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "http_server",
+		Name:      "request_decompressed_bytes",
+		Help:      "The number of request body bytes after decompression by service and content encoding",
+	}, []string{"service", "encoding"})
+
+	discardedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "discarded_events",
+		Help:      "The count of events accepted at capture but discarded before being saved, by reason",
+	}, []string{"reason"})
+
+	ingestQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "ingest_queue_length",
+		Help:      "The number of events waiting in the ingest buffer",
+	})
+
+	ingestQueueCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "ingest_queue_capacity",
+		Help:      "The number of events the ingest buffer can hold",
+	})
+
+	ingestWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "ingest_wait_ms",
+		Help:      "Time in ms captures waited for room in the ingest buffer",
+		Buckets:   buckets(),
+	})
+
+	ingestRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "ingest_rejected",
+		Help:      "The count of captures rejected because the ingest buffer stayed full",
+	})
+
+	dedupeHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "dedupe_hits",
+		Help:      "The count of retried events acknowledged but not counted, by the dedupe store that found them",
+	}, []string{"store"})
+
+	quotaDroppedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "quota_dropped_events",
+		Help:      "The count of events acknowledged but dropped because their service was over a rate limit or daily quota",
+	}, []string{"service", "environment", "limit"})
+
+	sampledOutEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "sampled_out_events",
+		Help:      "The count of events acknowledged but not kept by a sampling rule",
+	}, []string{"service"})
+
+	scrubbedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "scrubbed_events",
+		Help:      "The count of events with values replaced by a scrub rule, by rule",
+	}, []string{"rule"})
+
+	authRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "http_server",
+		Name:      "auth_rejected",
+		Help:      "The count of requests or events rejected for their API key, by reason",
+	}, []string{"reason"})
+
+	truncatedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "truncated_events",
+		Help:      "The count of events truncated to a size limit, or of requests rejected for their body size, by limit",
+	}, []string{"limit"})
+
+	walSegments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "wal_segments",
+		Help:      "The number of write-ahead log segments on disk, not yet fully saved",
+	})
+
+	walBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "wal_bytes",
+		Help:      "The total size in bytes of the write-ahead log segments on disk",
+	})
+
+	droppedToDiskEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "dropped_to_disk_events",
+		Help:      "The count of events dropped to disk instead of being saved, while the DB is overloaded",
+	})
+
+	backfilledEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "backfilled_events",
+		Help:      "The count of events dropped to disk, then saved by a backfill",
+	})
+
+	savePoolWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "save_pool_workers",
+		Help:      "The number of workers saving batches of events",
+	})
+
+	savePoolQueueCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "save_pool_queue_capacity",
+		Help:      "The most batches waiting for a save worker",
+	})
+
+	savePoolBusyWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "save_pool_busy_workers",
+		Help:      "The number of workers currently saving a batch",
+	})
+
+	savePoolQueuedBatches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "save_pool_queued_batches",
+		Help:      "The number of batches waiting for a save worker",
+	})
+
+	savePoolWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "save_pool_wait_ms",
+		Help:      "The time spent in ms waiting for room in a full save queue",
+		Buckets:   buckets(),
+	})
+
+	aggregatedPeriods = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "aggregated_periods",
+		Help:      "The number of event instance periods counted in memory, not saved yet",
+	})
+
+	flushedPeriods = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "flushed_periods",
+		Help:      "The count of event instance periods saved by the flushes of the aggregator",
+	})
+
+	aggregationOverflow = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "aggregation_overflow",
+		Help:      "The count of event instance periods saved directly because the aggregator was full",
+	})
+
+	idCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "id_cache_lookups",
+		Help:      "The count of id lookups classified by cache and result, hit or miss",
+	}, []string{"cache", "result"})
+
+	idCacheHitRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "id_cache_hit_ratio",
+		Help:      "The ratio of id lookups found in the cache since the start, by cache",
+	}, []string{"cache"})
+
+	idCacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: dbname,
+		Subsystem: "event_store",
+		Name:      "id_cache_size",
+		Help:      "The number of ids held, by cache",
+	}, []string{"cache"})
+
 	if err := prometheus.Register(httpReqLatencies); err != nil {
 		return errors.Wrap(err, "registering http request latency")
 	}
@@ -62,6 +298,78 @@ func RegisterPromMetrics(dbname string) error {
 		return errors.Wrap(err, "registering event store timer errors")
 	}
 
+	if err := prometheus.Register(requestCompressedBytes); err != nil {
+		return errors.Wrap(err, "registering request compressed bytes")
+	}
+
+	if err := prometheus.Register(requestDecompressedBytes); err != nil {
+		return errors.Wrap(err, "registering request decompressed bytes")
+	}
+
+	if err := prometheus.Register(discardedEvents); err != nil {
+		return errors.Wrap(err, "registering discarded events")
+	}
+
+	if err := prometheus.Register(dedupeHits); err != nil {
+		return errors.Wrap(err, "registering dedupe hits")
+	}
+
+	if err := prometheus.Register(quotaDroppedEvents); err != nil {
+		return errors.Wrap(err, "registering quota dropped events")
+	}
+
+	if err := prometheus.Register(sampledOutEvents); err != nil {
+		return errors.Wrap(err, "registering sampled out events")
+	}
+
+	if err := prometheus.Register(scrubbedEvents); err != nil {
+		return errors.Wrap(err, "registering scrubbed events")
+	}
+
+	if err := prometheus.Register(authRejected); err != nil {
+		return errors.Wrap(err, "registering auth rejections")
+	}
+
+	if err := prometheus.Register(truncatedEvents); err != nil {
+		return errors.Wrap(err, "registering truncated events")
+	}
+
+	for _, c := range []prometheus.Collector{walSegments, walBytes} {
+		if err := prometheus.Register(c); err != nil {
+			return errors.Wrap(err, "registering wal metrics")
+		}
+	}
+
+	for _, c := range []prometheus.Collector{droppedToDiskEvents, backfilledEvents} {
+		if err := prometheus.Register(c); err != nil {
+			return errors.Wrap(err, "registering backfill metrics")
+		}
+	}
+
+	for _, c := range []prometheus.Collector{savePoolWorkers, savePoolQueueCapacity, savePoolBusyWorkers, savePoolQueuedBatches, savePoolWait} {
+		if err := prometheus.Register(c); err != nil {
+			return errors.Wrap(err, "registering save pool metrics")
+		}
+	}
+
+	for _, c := range []prometheus.Collector{aggregatedPeriods, flushedPeriods, aggregationOverflow} {
+		if err := prometheus.Register(c); err != nil {
+			return errors.Wrap(err, "registering aggregation metrics")
+		}
+	}
+
+	for _, c := range []prometheus.Collector{idCacheLookups, idCacheHitRatio, idCacheSize} {
+		if err := prometheus.Register(c); err != nil {
+			return errors.Wrap(err, "registering id cache metrics")
+		}
+	}
+
+	for _, c := range []prometheus.Collector{ingestQueueLength, ingestQueueCapacity, ingestWait, ingestRejected} {
+		if err := prometheus.Register(c); err != nil {
+			return errors.Wrap(err, "registering ingest buffer metrics")
+		}
+	}
+
 	return nil
 }
 
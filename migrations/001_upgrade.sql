@@ -0,0 +1,65 @@
+-- Upgrades a DB created by an earlier script.sql to the schema of script.sql,
+-- without dropping any data. Every statement is idempotent, so the script can
+-- be run again, e.g. after a failure. Requires Postgres 9.6 or later.
+--
+--   psql <DBNAME> -a -f migrations/001_upgrade.sql
+--
+-- Regenerate schema.json afterwards, so that dataman knows the new columns.
+
+BEGIN;
+
+ALTER TABLE event_instance ADD COLUMN IF NOT EXISTS created_at timestamp;
+ALTER TABLE event_instance ADD COLUMN IF NOT EXISTS received_at timestamp;
+ALTER TABLE event_instance ADD COLUMN IF NOT EXISTS scrubbed jsonb; -- names of the scrub rules that replaced values
+
+ALTER TABLE event_instance_period ADD COLUMN IF NOT EXISTS extrapolated boolean DEFAULT false; -- count estimated from sampled events
+ALTER TABLE event_instance_period ADD COLUMN IF NOT EXISTS region_id int8;
+
+-- the periods of an instance are unique by region, which is the conflict target
+-- of the bulk upserts of the periods aggregated. The former key, without the
+-- region, would reject the periods of a second region.
+ALTER TABLE event_instance_period DROP CONSTRAINT IF EXISTS event_instance_period_event_instance_id_start_time_end_time_key;
+CREATE UNIQUE INDEX IF NOT EXISTS event_instance_period_event_instance_id_start_time_end_time_region_id_key
+  ON event_instance_period (event_instance_id, start_time, end_time, region_id);
+
+-- ids of the events captured recently, to count retried events once
+CREATE TABLE IF NOT EXISTS event_dedupe (
+  key varchar(512) PRIMARY KEY,
+  expires_at timestamp
+);
+
+-- registry of the services, environments and regions, seeded from the config
+CREATE TABLE IF NOT EXISTS service (
+  _id serial8 PRIMARY KEY,
+  name varchar(256) UNIQUE NOT NULL,
+  created_at timestamp DEFAULT now(),
+  retired_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS environment (
+  _id serial8 PRIMARY KEY,
+  name varchar(256) UNIQUE NOT NULL,
+  created_at timestamp DEFAULT now(),
+  retired_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS region (
+  _id serial8 PRIMARY KEY,
+  name varchar(256) UNIQUE NOT NULL,
+  created_at timestamp DEFAULT now(),
+  retired_at timestamp
+);
+
+-- API keys, only their SHA-256 is stored
+CREATE TABLE IF NOT EXISTS api_key (
+  _id serial8 PRIMARY KEY,
+  key_hash varchar(64) UNIQUE NOT NULL,
+  prefix varchar(16),
+  service varchar(256), -- NULL for keys of every service
+  capabilities jsonb,
+  description text,
+  created_at timestamp DEFAULT now(),
+  revoked_at timestamp
+);
+
+COMMIT;
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"bytes"
+	"encoding/json"
 	"time"
 
 	"github.com/mohae/deepcopy"
@@ -23,9 +25,93 @@ type UnaddedEvent struct {
 	Type                  string                 `json:"event_type"`
 	Data                  EventData              `json:"event_data"`
 	ExtraArgs             map[string]interface{} `json:"extra_args"`
-	Timestamp             string                 `json:"timestamp"`
+	Timestamp             string                 `json:"timestamp"` // any format accepted by util.ParseTimestamp, normalized at capture
 	ConfigurableFilters   map[string][]string    `json:"configurable_filters"`
 	ConfigurableGroupings []string               `json:"configurable_groupings"`
+	EventId               string                 `json:"event_id,omitempty"` // optional, events retried with the same id are counted once
+	ReceivedAt            string                 `json:"-"`                  // set by the server at capture, RFC 3339 in UTC
+	SampleWeight          float64                `json:"-"`                  // set by the server at capture, 1/rate of the sampling rule applied
+	Scrubbed              []string               `json:"-"`                  // set by the server at capture, names of the scrub rules that replaced values
+	WALSegment            uint64                 `json:"-"`                  // segment of the write-ahead log the event was appended to, 0 if none
+}
+
+// StoredEvent is an event persisted by the server until it is saved, e.g. in
+// the write-ahead log, along with the fields set by the server. Those fields
+// are not part of UnaddedEvent in JSON, so that clients cannot set them.
+type StoredEvent struct {
+	Event        UnaddedEvent `json:"event"`
+	ReceivedAt   string       `json:"received_at,omitempty"`
+	SampleWeight float64      `json:"sample_weight,omitempty"`
+	Scrubbed     []string     `json:"scrubbed,omitempty"`
+}
+
+func NewStoredEvent(e UnaddedEvent) StoredEvent {
+	return StoredEvent{
+		Event:        e,
+		ReceivedAt:   e.ReceivedAt,
+		SampleWeight: e.SampleWeight,
+		Scrubbed:     e.Scrubbed,
+	}
+}
+
+// Decodes a StoredEvent into its event. Events persisted by the previous
+// versions, as plain UnaddedEvents along with the fields set by the server,
+// are decoded too.
+func DecodeStoredEvent(b []byte) (UnaddedEvent, error) {
+	var stored struct {
+		Event        json.RawMessage `json:"event"`
+		ReceivedAt   string          `json:"received_at"`
+		SampleWeight float64         `json:"sample_weight"`
+		Scrubbed     []string        `json:"scrubbed"`
+	}
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return UnaddedEvent{}, err
+	}
+	event := []byte(stored.Event)
+	if stored.Event == nil {
+		event = b
+	}
+	var e UnaddedEvent
+	if err := json.Unmarshal(event, &e); err != nil {
+		return e, err
+	}
+	e.ReceivedAt = stored.ReceivedAt
+	e.SampleWeight = stored.SampleWeight
+	e.Scrubbed = stored.Scrubbed
+	return e, nil
+}
+
+// Number of events an event stands for once sampled
+func (e *UnaddedEvent) Weight() float64 {
+	if e.SampleWeight <= 0 {
+		return 1
+	}
+	return e.SampleWeight
+}
+
+// Decodes an event whose timestamp may also be a JSON number, e.g. epoch
+// seconds, into its string representation
+func (e *UnaddedEvent) UnmarshalJSON(b []byte) error {
+	type event UnaddedEvent
+	aux := struct {
+		*event
+		Timestamp json.RawMessage `json:"timestamp"`
+	}{event: (*event)(e)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	e.Timestamp = ""
+	if ts := bytes.TrimSpace(aux.Timestamp); len(ts) > 0 && ts[0] == '"' {
+		return json.Unmarshal(ts, &e.Timestamp)
+	} else if len(ts) > 0 && !bytes.Equal(ts, []byte("null")) {
+		var n json.Number
+		if err := json.Unmarshal(ts, &n); err != nil {
+			return err
+		}
+		e.Timestamp = n.String()
+	}
+	return nil
 }
 
 // Data object, payload of UnaddedEvent
@@ -44,6 +130,38 @@ func (e *EventData) Copy() EventData {
 	}
 }
 
+// Result of a single event sent to the batch capture endpoint
+type CaptureResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+	Retry    bool   `json:"retry,omitempty"` // rejected as the server is overloaded, to send again after Retry-After
+}
+
+// Event accepted at capture, but discarded before being saved
+type DiscardedEvent struct {
+	Event       UnaddedEvent `json:"event"`
+	Reason      string       `json:"reason"`
+	Error       string       `json:"error"`
+	DiscardedAt time.Time    `json:"discarded_at"`
+}
+
+// Usage of the rate limit and daily quota of a service and environment, for
+// the current UTC day
+type QuotaUsage struct {
+	Service      string  `json:"service"`
+	Environment  string  `json:"environment"`
+	Quota        string  `json:"quota"` // key of the quota applied in the config
+	Rate         float64 `json:"rate"`
+	Burst        int     `json:"burst"`
+	Daily        int64   `json:"daily"`
+	Tokens       float64 `json:"tokens"` // events that can be captured right away
+	Day          string  `json:"day"`
+	Accepted     int64   `json:"accepted"`
+	RateDropped  int64   `json:"rate_dropped"`
+	DailyDropped int64   `json:"daily_dropped"`
+}
+
 type KeyEventPeriod struct {
 	RawDataHash string
 	StartTime   time.Time
@@ -83,7 +201,9 @@ type EventInstance struct {
 	GenericData        EventData `mapstructure:"generic_data"`
 	GenericDataHash    string    `mapstructure:"generic_data_hash"`
 	EventMessage       string    `mapstructure: "event_message"`
-	CreatedAt          time.Time `mapstructure: "created_at"`
+	CreatedAt          time.Time `mapstructure: "created_at"` // time of the event
+	ReceivedAt         time.Time `mapstructure:"received_at"` // time the server received the event
+	Scrubbed           []string  `mapstructure:"scrubbed"`    // names of the scrub rules that replaced values, nil if not scrubbed
 
 	// ignored fields, used internally
 	ProcessedDataHash   string
@@ -99,6 +219,7 @@ type EventInstancePeriod struct {
 	Count           int                    `mapstructure:"count"`
 	CounterJson     map[string]interface{} `mapstructure:"counter_json"`
 	CAS             int                    `json:"cas_value" mapstructure:"cas_value"`
+	Extrapolated    bool                   `json:"extrapolated" mapstructure:"extrapolated"` // count estimated from sampled events
 
 	// ignored fields, used internally
 	RawDataHash string
@@ -127,6 +248,42 @@ type EventEnvironment struct {
 	Name string
 }
 
+// Service, environment or region of the registry. Retired entries are kept, so
+// that the events saved under them can still be searched.
+type RegistryEntry struct {
+	Id        int        `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// Progress of the replay of the events dropped to disk while the DB was
+// overloaded
+type BackfillProgress struct {
+	Running      bool       `json:"running"`
+	DropToDisk   bool       `json:"drop_to_disk"`  // events are being dropped to disk
+	PendingFiles int        `json:"pending_files"` // files left on disk
+	Files        int        `json:"files"`         // files to replay when the backfill started
+	FilesDone    int        `json:"files_done"`
+	Events       int        `json:"events"` // events replayed
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	Error        string     `json:"error,omitempty"` // why the backfill stopped before replaying every file
+}
+
+// API key, scoped to the events of a service if Service is set, and to
+// capabilities, e.g. "ingest". Only the hash of the key is stored.
+type APIKey struct {
+	Id           int        `json:"id"`
+	Key          string     `json:"key,omitempty"` // only returned when the key is issued
+	Prefix       string     `json:"prefix"`        // first characters of the key, to tell keys apart
+	Service      string     `json:"service,omitempty"`
+	Capabilities []string   `json:"capabilities"`
+	Description  string     `json:"description,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
 type CountStat struct {
 	Count       int
 	CountPerMin float64
@@ -166,7 +323,8 @@ type DataPointArrays struct {
 }
 
 type StackTrace struct {
-	Frames []Frame `json:"frames" mapstructure:"frames"`
+	Frames          []Frame `json:"frames" mapstructure:"frames"`
+	TruncatedFrames int     `json:"_truncated_frames,omitempty" mapstructure:"_truncated_frames"` // frames dropped from the middle
 }
 
 type Frame struct {
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+)
+
+/////////////////////////////////////////////////////////
+/* MODELS CORRESPONDING TO THE OPENTELEMETRY PROTOCOL */
+/////////////////////////////////////////////////////////
+
+// Only the fields eventsum needs are kept. The json tags follow the OTLP/JSON
+// encoding, where trace and span ids are hex strings and 64 bit integers may
+// be sent as strings.
+
+type OtlpTracesRequest struct {
+	ResourceSpans []OtlpResourceSpans `json:"resourceSpans"`
+}
+
+type OtlpResourceSpans struct {
+	Resource   OtlpResource     `json:"resource"`
+	ScopeSpans []OtlpScopeSpans `json:"scopeSpans"`
+}
+
+type OtlpScopeSpans struct {
+	Spans []OtlpSpan `json:"spans"`
+}
+
+type OtlpSpan struct {
+	TraceId string          `json:"traceId"`
+	SpanId  string          `json:"spanId"`
+	Name    string          `json:"name"`
+	Events  []OtlpSpanEvent `json:"events"`
+}
+
+type OtlpSpanEvent struct {
+	TimeUnixNano OtlpUint64     `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []OtlpKeyValue `json:"attributes"`
+}
+
+type OtlpLogsRequest struct {
+	ResourceLogs []OtlpResourceLogs `json:"resourceLogs"`
+}
+
+type OtlpResourceLogs struct {
+	Resource  OtlpResource    `json:"resource"`
+	ScopeLogs []OtlpScopeLogs `json:"scopeLogs"`
+}
+
+type OtlpScopeLogs struct {
+	Scope      OtlpScope       `json:"scope"`
+	LogRecords []OtlpLogRecord `json:"logRecords"`
+}
+
+type OtlpScope struct {
+	Name string `json:"name"`
+}
+
+type OtlpLogRecord struct {
+	TimeUnixNano         OtlpUint64     `json:"timeUnixNano"`
+	ObservedTimeUnixNano OtlpUint64     `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 OtlpAnyValue   `json:"body"`
+	Attributes           []OtlpKeyValue `json:"attributes"`
+	TraceId              string         `json:"traceId"`
+	SpanId               string         `json:"spanId"`
+}
+
+type OtlpResource struct {
+	Attributes []OtlpKeyValue `json:"attributes"`
+}
+
+type OtlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value OtlpAnyValue `json:"value"`
+}
+
+type OtlpAnyValue struct {
+	StringValue *string           `json:"stringValue,omitempty"`
+	BoolValue   *bool             `json:"boolValue,omitempty"`
+	IntValue    *OtlpInt64        `json:"intValue,omitempty"`
+	DoubleValue *float64          `json:"doubleValue,omitempty"`
+	ArrayValue  *OtlpArrayValue   `json:"arrayValue,omitempty"`
+	KvlistValue *OtlpKeyValueList `json:"kvlistValue,omitempty"`
+	BytesValue  []byte            `json:"bytesValue,omitempty"`
+}
+
+type OtlpArrayValue struct {
+	Values []OtlpAnyValue `json:"values"`
+}
+
+type OtlpKeyValueList struct {
+	Values []OtlpKeyValue `json:"values"`
+}
+
+// Returns the value held by the AnyValue as a generic JSON value
+func (v OtlpAnyValue) Interface() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i, value := range v.ArrayValue.Values {
+			values[i] = value.Interface()
+		}
+		return values
+	case v.KvlistValue != nil:
+		return OtlpAttributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	return nil
+}
+
+// Returns the value held by the AnyValue as a string
+func (v OtlpAnyValue) String() string {
+	switch value := v.Interface().(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
+
+// Converts a list of attributes into a map
+func OtlpAttributes(kvs []OtlpKeyValue) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.Key] = kv.Value.Interface()
+	}
+	return attrs
+}
+
+// OtlpUint64 accepts both JSON numbers and strings
+type OtlpUint64 uint64
+
+func (u *OtlpUint64) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n uint64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*u = OtlpUint64(n)
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	*u = OtlpUint64(n)
+	return err
+}
+
+// OtlpInt64 accepts both JSON numbers and strings
+type OtlpInt64 int64
+
+func (i *OtlpInt64) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*i = OtlpInt64(n)
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	*i = OtlpInt64(n)
+	return err
+}
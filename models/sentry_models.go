@@ -0,0 +1,87 @@
+package models
+
+import (
+	"encoding/json"
+)
+
+//////////////////////////////////////////////////
+/* MODELS CORRESPONDING TO THE SENTRY PROTOCOL */
+//////////////////////////////////////////////////
+
+// SentryEvent is the subset of a Sentry event payload used by eventsum
+type SentryEvent struct {
+	EventId     string                 `json:"event_id"`
+	Timestamp   interface{}            `json:"timestamp"` // RFC 3339 string or epoch seconds
+	Platform    string                 `json:"platform"`
+	Level       string                 `json:"level"`
+	Logger      string                 `json:"logger"`
+	Message     interface{}            `json:"message"` // string or SentryLogEntry
+	LogEntry    *SentryLogEntry        `json:"logentry"`
+	Exception   SentryExceptions       `json:"exception"`
+	Stacktrace  *StackTrace            `json:"stacktrace"`
+	Environment string                 `json:"environment"`
+	Release     string                 `json:"release"`
+	ServerName  string                 `json:"server_name"`
+	Tags        SentryTags             `json:"tags"`
+	Extra       map[string]interface{} `json:"extra"`
+}
+
+type SentryLogEntry struct {
+	Message   string `json:"message"`
+	Formatted string `json:"formatted"`
+}
+
+type SentryException struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Module     string      `json:"module"`
+	Stacktrace *StackTrace `json:"stacktrace"`
+}
+
+// SentryExceptions accepts both `{"values": [...]}` and the older plain list
+type SentryExceptions []SentryException
+
+func (s *SentryExceptions) UnmarshalJSON(b []byte) error {
+	var list []SentryException
+	if err := json.Unmarshal(b, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var values struct {
+		Values []SentryException `json:"values"`
+	}
+	if err := json.Unmarshal(b, &values); err != nil {
+		return err
+	}
+	*s = values.Values
+	return nil
+}
+
+// SentryTags accepts both a map of tags and a list of key-value pairs
+type SentryTags map[string]string
+
+func (s *SentryTags) UnmarshalJSON(b []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err == nil {
+		*s = m
+		return nil
+	}
+	var pairs [][]string
+	if err := json.Unmarshal(b, &pairs); err != nil {
+		return err
+	}
+	m = make(map[string]string)
+	for _, pair := range pairs {
+		if len(pair) == 2 {
+			m[pair[0]] = pair[1]
+		}
+	}
+	*s = m
+	return nil
+}
+
+// SentryEnvelopeItemHeader precedes every item of a Sentry envelope
+type SentryEnvelopeItemHeader struct {
+	Type   string `json:"type"`
+	Length int    `json:"length"`
+}
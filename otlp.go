@@ -0,0 +1,243 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Lowest severity number of the ERROR range of OTLP log records
+const otlpSeverityError = 17
+
+// Receives OTLP/HTTP trace exports, and captures every exception span event
+func (h *httpHandler) otlpTracesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		h.sendError(w, decodeErrorStatus(err), err, "Error reading OTLP request")
+		return
+	}
+
+	var req OtlpTracesRequest
+	isJSON := isOtlpJSON(r)
+	if isJSON {
+		err = json.Unmarshal(body, &req)
+	} else {
+		req, err = decodeOtlpTracesRequest(body)
+	}
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Error decoding OTLP traces")
+		return
+	}
+
+	if err := h.sendOtlpEvents(r, otlpTracesToUnaddedEvents(req, h.otlp, h.timeFormat)); err != nil {
+		h.sendQueueFull(w, err)
+		return
+	}
+	h.sendOtlpResp(w, isJSON)
+}
+
+// Receives OTLP/HTTP log exports, and captures every log record with a
+// severity of ERROR or above
+func (h *httpHandler) otlpLogsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		h.sendError(w, decodeErrorStatus(err), err, "Error reading OTLP request")
+		return
+	}
+
+	var req OtlpLogsRequest
+	isJSON := isOtlpJSON(r)
+	if isJSON {
+		err = json.Unmarshal(body, &req)
+	} else {
+		req, err = decodeOtlpLogsRequest(body)
+	}
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Error decoding OTLP logs")
+		return
+	}
+
+	if err := h.sendOtlpEvents(r, otlpLogsToUnaddedEvents(req, h.otlp, h.timeFormat)); err != nil {
+		h.sendQueueFull(w, err)
+		return
+	}
+	h.sendOtlpResp(w, isJSON)
+}
+
+// Validates and sends the translated events to the batching channel. An export
+// can hold events from many services, so invalid events are logged and skipped
+// rather than failing the whole export. Returns an error if the batching channel
+// has no room for every valid event, in which case none is sent: OTLP events
+// have no id, so an export retried after some of its events were sent would
+// count them twice.
+func (h *httpHandler) sendOtlpEvents(r *http.Request, evts []UnaddedEvent) error {
+	service := ""
+	valid := make([]UnaddedEvent, 0, len(evts))
+	for _, evt := range evts {
+		if service == "" {
+			service = evt.Service
+		} else if service != evt.Service {
+			service = mixedServices
+		}
+
+		if err := h.authorizeEvent(r.Context(), &evt); err != nil {
+			h.log.App().Infof("Skipping unauthorized OTLP event: %v", err)
+			continue
+		}
+		if err := h.validateEvent(&evt); err != nil {
+			h.log.App().Infof("Skipping invalid OTLP event: %v", err)
+			continue
+		}
+		valid = append(valid, evt)
+	}
+	h.recordBodySize(r, service)
+	return h.es.SendAll(valid)
+}
+
+// Writes an empty export response, encoded the same way as the request
+func (h *httpHandler) sendOtlpResp(w http.ResponseWriter, isJSON bool) {
+	if isJSON {
+		h.sendResp(w, "", struct{}{})
+		return
+	}
+	// an empty protobuf message has no bytes
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+func isOtlpJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// Translates every `exception` span event into an UnaddedEvent. The trace and
+// span ids are kept in the extra args.
+func otlpTracesToUnaddedEvents(req OtlpTracesRequest, config conf.OTLPConfig, timeFormat string) []UnaddedEvent {
+	var evts []UnaddedEvent
+	for _, rs := range req.ResourceSpans {
+		service, env, typ := otlpResourceInfo(rs.Resource, config)
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				for _, spanEvent := range span.Events {
+					if spanEvent.Name != "exception" {
+						continue
+					}
+					attrs := OtlpAttributes(spanEvent.Attributes)
+					evts = append(evts, UnaddedEvent{
+						Service:     service,
+						Environment: env,
+						Name:        otlpString(attrs, "exception.type", "exception"),
+						Type:        typ,
+						Data: EventData{
+							RawMessage: otlpString(attrs, "exception.message", ""),
+							Raw:        otlpString(attrs, "exception.stacktrace", ""),
+						},
+						ExtraArgs: otlpIds(span.TraceId, span.SpanId),
+						Timestamp: otlpTime(spanEvent.TimeUnixNano, 0).Format(timeFormat),
+					})
+				}
+			}
+		}
+	}
+	return evts
+}
+
+// Translates every log record of ERROR severity or above into an UnaddedEvent.
+// The trace and span ids are kept in the extra args.
+func otlpLogsToUnaddedEvents(req OtlpLogsRequest, config conf.OTLPConfig, timeFormat string) []UnaddedEvent {
+	var evts []UnaddedEvent
+	for _, rl := range req.ResourceLogs {
+		service, env, typ := otlpResourceInfo(rl.Resource, config)
+		for _, sl := range rl.ScopeLogs {
+			defaultName := sl.Scope.Name
+			if defaultName == "" {
+				defaultName = "log"
+			}
+			for _, record := range sl.LogRecords {
+				if !otlpIsError(record) {
+					continue
+				}
+				attrs := OtlpAttributes(record.Attributes)
+				evts = append(evts, UnaddedEvent{
+					Service:     service,
+					Environment: env,
+					Name:        otlpString(attrs, "exception.type", defaultName),
+					Type:        typ,
+					Data: EventData{
+						RawMessage: otlpString(attrs, "exception.message", record.Body.String()),
+						Raw:        otlpString(attrs, "exception.stacktrace", ""),
+					},
+					ExtraArgs: otlpIds(record.TraceId, record.SpanId),
+					Timestamp: otlpTime(record.TimeUnixNano, record.ObservedTimeUnixNano).Format(timeFormat),
+				})
+			}
+		}
+	}
+	return evts
+}
+
+// Returns the service, environment and event type of a resource. The service
+// and environment names are mapped through the otlp config, and used as is
+// when unmapped.
+func otlpResourceInfo(resource OtlpResource, config conf.OTLPConfig) (string, string, string) {
+	attrs := OtlpAttributes(resource.Attributes)
+	service := otlpString(attrs, "service.name", "default")
+	if mapped := config.Services[service]; mapped != "" {
+		service = mapped
+	}
+	env := otlpString(attrs, "deployment.environment", "")
+	if env == "" {
+		env = otlpString(attrs, "deployment.environment.name", "default")
+	}
+	if mapped := config.Environments[env]; mapped != "" {
+		env = mapped
+	}
+	return service, env, otlpString(attrs, "telemetry.sdk.language", "otlp")
+}
+
+func otlpIsError(record OtlpLogRecord) bool {
+	if record.SeverityNumber != 0 {
+		return record.SeverityNumber >= otlpSeverityError
+	}
+	switch strings.ToUpper(record.SeverityText) {
+	case "ERROR", "FATAL", "CRITICAL":
+		return true
+	}
+	return false
+}
+
+func otlpIds(traceId, spanId string) map[string]interface{} {
+	ids := make(map[string]interface{})
+	if traceId != "" {
+		ids["trace_id"] = traceId
+	}
+	if spanId != "" {
+		ids["span_id"] = spanId
+	}
+	return ids
+}
+
+// Returns the string attribute at key, or def if missing or empty
+func otlpString(attrs map[string]interface{}, key, def string) string {
+	if s, ok := attrs[key].(string); ok && s != "" {
+		return s
+	}
+	return def
+}
+
+// Returns the first non zero timestamp in UTC, or the current time
+func otlpTime(nanos ...OtlpUint64) time.Time {
+	for _, n := range nanos {
+		if n != 0 {
+			return time.Unix(0, int64(n)).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,170 @@
+package eventsum
+
+import (
+	"encoding/hex"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/otlppb"
+)
+
+// Deepest nesting of arrays and key-value lists accepted in attribute values,
+// so that a crafted payload cannot exhaust the stack
+const maxOtlpValueDepth = 32
+
+var errOtlpTooDeep = errors.Errorf("OTLP value nested deeper than %d levels", maxOtlpValueDepth)
+
+// Decodes an OTLP/protobuf traces export into the models of OTLP/JSON
+func decodeOtlpTracesRequest(b []byte) (OtlpTracesRequest, error) {
+	var pb otlppb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(b, &pb); err != nil {
+		return OtlpTracesRequest{}, err
+	}
+	var req OtlpTracesRequest
+	for _, rs := range pb.ResourceSpans {
+		resource, err := otlpResource(rs.GetResource())
+		if err != nil {
+			return req, err
+		}
+		resourceSpans := OtlpResourceSpans{Resource: resource}
+		for _, ss := range rs.ScopeSpans {
+			var scopeSpans OtlpScopeSpans
+			for _, span := range ss.Spans {
+				s := OtlpSpan{
+					TraceId: hex.EncodeToString(span.TraceId),
+					SpanId:  hex.EncodeToString(span.SpanId),
+					Name:    span.Name,
+				}
+				for _, evt := range span.Events {
+					attrs, err := otlpKeyValues(evt.Attributes, 1)
+					if err != nil {
+						return req, err
+					}
+					s.Events = append(s.Events, OtlpSpanEvent{
+						TimeUnixNano: OtlpUint64(evt.TimeUnixNano),
+						Name:         evt.Name,
+						Attributes:   attrs,
+					})
+				}
+				scopeSpans.Spans = append(scopeSpans.Spans, s)
+			}
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+		}
+		req.ResourceSpans = append(req.ResourceSpans, resourceSpans)
+	}
+	return req, nil
+}
+
+// Decodes an OTLP/protobuf logs export into the models of OTLP/JSON
+func decodeOtlpLogsRequest(b []byte) (OtlpLogsRequest, error) {
+	var pb otlppb.ExportLogsServiceRequest
+	if err := proto.Unmarshal(b, &pb); err != nil {
+		return OtlpLogsRequest{}, err
+	}
+	var req OtlpLogsRequest
+	for _, rl := range pb.ResourceLogs {
+		resource, err := otlpResource(rl.GetResource())
+		if err != nil {
+			return req, err
+		}
+		resourceLogs := OtlpResourceLogs{Resource: resource}
+		for _, sl := range rl.ScopeLogs {
+			scopeLogs := OtlpScopeLogs{Scope: OtlpScope{Name: sl.GetScope().GetName()}}
+			for _, record := range sl.LogRecords {
+				body, err := otlpAnyValue(record.Body, 1)
+				if err != nil {
+					return req, err
+				}
+				attrs, err := otlpKeyValues(record.Attributes, 1)
+				if err != nil {
+					return req, err
+				}
+				scopeLogs.LogRecords = append(scopeLogs.LogRecords, OtlpLogRecord{
+					TimeUnixNano:         OtlpUint64(record.TimeUnixNano),
+					ObservedTimeUnixNano: OtlpUint64(record.ObservedTimeUnixNano),
+					SeverityNumber:       int(record.SeverityNumber),
+					SeverityText:         record.SeverityText,
+					Body:                 body,
+					Attributes:           attrs,
+					TraceId:              hex.EncodeToString(record.TraceId),
+					SpanId:               hex.EncodeToString(record.SpanId),
+				})
+			}
+			resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scopeLogs)
+		}
+		req.ResourceLogs = append(req.ResourceLogs, resourceLogs)
+	}
+	return req, nil
+}
+
+func otlpResource(resource *otlppb.Resource) (OtlpResource, error) {
+	attrs, err := otlpKeyValues(resource.GetAttributes(), 1)
+	return OtlpResource{Attributes: attrs}, err
+}
+
+// Converts key-values found at the given depth of nesting
+func otlpKeyValues(kvs []*otlppb.KeyValue, depth int) ([]OtlpKeyValue, error) {
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	values := make([]OtlpKeyValue, len(kvs))
+	for i, kv := range kvs {
+		value, err := otlpAnyValue(kv.GetValue(), depth)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = OtlpKeyValue{Key: kv.GetKey(), Value: value}
+	}
+	return values, nil
+}
+
+// Converts a value found at the given depth of nesting. The values nested in
+// it are still encoded, and only decoded once their depth is checked.
+func otlpAnyValue(value *otlppb.AnyValue, depth int) (OtlpAnyValue, error) {
+	var v OtlpAnyValue
+	if depth > maxOtlpValueDepth {
+		return v, errOtlpTooDeep
+	}
+	switch value := value.GetValue().(type) {
+	case *otlppb.AnyValue_StringValue:
+		v.StringValue = &value.StringValue
+	case *otlppb.AnyValue_BoolValue:
+		v.BoolValue = &value.BoolValue
+	case *otlppb.AnyValue_IntValue:
+		i := OtlpInt64(value.IntValue)
+		v.IntValue = &i
+	case *otlppb.AnyValue_DoubleValue:
+		v.DoubleValue = &value.DoubleValue
+	case *otlppb.AnyValue_ArrayValue:
+		v.ArrayValue = &OtlpArrayValue{}
+		for _, b := range value.ArrayValue.GetValues() {
+			var item otlppb.AnyValue
+			if err := proto.Unmarshal(b, &item); err != nil {
+				return v, err
+			}
+			converted, err := otlpAnyValue(&item, depth+1)
+			if err != nil {
+				return v, err
+			}
+			v.ArrayValue.Values = append(v.ArrayValue.Values, converted)
+		}
+	case *otlppb.AnyValue_KvlistValue:
+		kvs := make([]*otlppb.KeyValue, len(value.KvlistValue.GetValues()))
+		for i, b := range value.KvlistValue.GetValues() {
+			kvs[i] = &otlppb.KeyValue{}
+			if err := proto.Unmarshal(b, kvs[i]); err != nil {
+				return v, err
+			}
+		}
+		values, err := otlpKeyValues(kvs, depth+1)
+		if err != nil {
+			return v, err
+		}
+		v.KvlistValue = &OtlpKeyValueList{Values: values}
+	case *otlppb.AnyValue_BytesValue:
+		v.BytesValue = value.BytesValue
+	}
+	return v, nil
+}
@@ -0,0 +1,143 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/otlppb"
+)
+
+func otlpStringAttr(key, value string) *otlppb.KeyValue {
+	return &otlppb.KeyValue{Key: key, Value: &otlppb.AnyValue{Value: &otlppb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func marshalOtlp(t *testing.T, msg proto.Message) []byte {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
+
+func TestOtlpTracesProtobuf(t *testing.T) {
+	body := marshalOtlp(t, &otlppb.ExportTraceServiceRequest{
+		ResourceSpans: []*otlppb.ResourceSpans{{
+			Resource: &otlppb.Resource{Attributes: []*otlppb.KeyValue{
+				otlpStringAttr("service.name", "wish_be"),
+				otlpStringAttr("deployment.environment", "prod"),
+				otlpStringAttr("telemetry.sdk.language", "go"),
+			}},
+			ScopeSpans: []*otlppb.ScopeSpans{{
+				Spans: []*otlppb.Span{{
+					TraceId: []byte{0x5b, 0x8e, 0xff, 0xf7},
+					SpanId:  []byte{0x05, 0x1f},
+					Name:    "GET /",
+					Events: []*otlppb.Span_Event{{
+						TimeUnixNano: 1580000000000000000,
+						Name:         "exception",
+						Attributes: []*otlppb.KeyValue{
+							otlpStringAttr("exception.type", "*errors.errorString"),
+							otlpStringAttr("exception.message", "boom"),
+						},
+					}},
+				}},
+			}},
+		}},
+	})
+
+	req, err := decodeOtlpTracesRequest(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	evts := otlpTracesToUnaddedEvents(req, conf.OTLPConfig{}, "2006-01-02 15:04:05")
+	if len(evts) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evts))
+	}
+	evt := evts[0]
+	if evt.Service != "wish_be" || evt.Environment != "prod" || evt.Type != "go" || evt.Name != "*errors.errorString" {
+		t.Errorf("unexpected event %+v", evt)
+	}
+	if evt.Timestamp != "2020-01-26 00:53:20" || evt.Data.RawMessage != "boom" {
+		t.Errorf("unexpected event %+v", evt)
+	}
+	if evt.ExtraArgs["trace_id"] != "5b8efff7" || evt.ExtraArgs["span_id"] != "051f" {
+		t.Errorf("unexpected extra args %v", evt.ExtraArgs)
+	}
+}
+
+func TestOtlpProtobufNestedValues(t *testing.T) {
+	item := marshalOtlp(t, &otlppb.AnyValue{Value: &otlppb.AnyValue_IntValue{IntValue: 3}})
+	kv := marshalOtlp(t, &otlppb.KeyValue{
+		Key:   "retries",
+		Value: &otlppb.AnyValue{Value: &otlppb.AnyValue_ArrayValue{ArrayValue: &otlppb.ArrayValue{Values: [][]byte{item}}}},
+	})
+	body := marshalOtlp(t, &otlppb.ExportLogsServiceRequest{
+		ResourceLogs: []*otlppb.ResourceLogs{{
+			ScopeLogs: []*otlppb.ScopeLogs{{
+				LogRecords: []*otlppb.LogRecord{{
+					Body: &otlppb.AnyValue{Value: &otlppb.AnyValue_KvlistValue{KvlistValue: &otlppb.KeyValueList{Values: [][]byte{kv}}}},
+				}},
+			}},
+		}},
+	})
+
+	req, err := decodeOtlpLogsRequest(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0].Body.String(); value != `{"retries":[3]}` {
+		t.Errorf("unexpected body %s", value)
+	}
+}
+
+func TestOtlpLogsJSON(t *testing.T) {
+	body := `{"resourceLogs": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "merchant-backend"}},
+			{"key": "deployment.environment", "value": {"stringValue": "production"}}]},
+		"scopeLogs": [{"scope": {"name": "app.logger"}, "logRecords": [
+			{"timeUnixNano": "1580000000000000000", "severityNumber": 9, "body": {"stringValue": "all good"}},
+			{"timeUnixNano": "1580000000000000000", "severityNumber": 17, "body": {"stringValue": "failed"},
+			 "traceId": "5b8efff798038103d269b633813fc60c", "spanId": "eee19b7ec3c1b174",
+			 "attributes": [{"key": "retries", "value": {"intValue": "3"}}]}
+		]}]
+	}]}`
+	var req OtlpLogsRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	config := conf.OTLPConfig{
+		Services:     map[string]string{"merchant-backend": "merchant_be"},
+		Environments: map[string]string{"production": "prod"},
+	}
+	evts := otlpLogsToUnaddedEvents(req, config, "2006-01-02 15:04:05")
+	if len(evts) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(evts))
+	}
+	evt := evts[0]
+	if evt.Service != "merchant_be" || evt.Environment != "prod" || evt.Name != "app.logger" || evt.Data.RawMessage != "failed" {
+		t.Errorf("unexpected event %+v", evt)
+	}
+	if evt.ExtraArgs["trace_id"] != "5b8efff798038103d269b633813fc60c" {
+		t.Errorf("unexpected extra args %v", evt.ExtraArgs)
+	}
+}
+
+func TestOtlpProtobufTooDeep(t *testing.T) {
+	value := &otlppb.AnyValue{Value: &otlppb.AnyValue_StringValue{StringValue: "leaf"}}
+	for i := 0; i < maxOtlpValueDepth; i++ {
+		array := &otlppb.ArrayValue{Values: [][]byte{marshalOtlp(t, value)}}
+		value = &otlppb.AnyValue{Value: &otlppb.AnyValue_ArrayValue{ArrayValue: array}}
+	}
+	body := marshalOtlp(t, &otlppb.ExportLogsServiceRequest{
+		ResourceLogs: []*otlppb.ResourceLogs{{
+			ScopeLogs: []*otlppb.ScopeLogs{{LogRecords: []*otlppb.LogRecord{{Body: value}}}},
+		}},
+	})
+	if _, err := decodeOtlpLogsRequest(body); err != errOtlpTooDeep {
+		t.Errorf("expected values nested too deep to be rejected, got %v", err)
+	}
+}
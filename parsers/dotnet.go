@@ -0,0 +1,35 @@
+package parsers
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Frame of a .NET stack trace, e.g.
+// `   at Shop.Orders.Load(Int32 id) in C:\src\Orders.cs:line 42`
+var dotnetFrame = regexp.MustCompile(`^\s*at\s+([^\s(]+)\((.*?)\)(?:\s+in\s+(.+):line\s+(\d+))?\s*$`)
+
+// Parses a .NET stack trace, including the traces of its inner exceptions,
+// e.g.
+//
+//	System.InvalidOperationException: could not load order ---> System.TimeoutException: timeout
+//	   at Shop.Db.Query(String sql) in C:\src\Db.cs:line 7
+//	   --- End of inner exception stack trace ---
+//	   at Shop.Orders.Load(Int32 id) in C:\src\Orders.cs:line 42
+func ParseDotNet(s string) (models.StackTrace, error) {
+	var frames []models.Frame
+	for _, l := range lines(s) {
+		m := dotnetFrame.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		lineNo, _ := strconv.Atoi(m[4])
+		module, function := splitLastDot(m[1])
+		frames = append(frames, newFrame(module, function, m[3], lineNo))
+	}
+	// inner exceptions are printed first, and each trace from its innermost
+	// call, so the whole list is reversed
+	return result(reverse(frames))
+}
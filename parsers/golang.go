@@ -0,0 +1,81 @@
+package parsers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Location of a call in a goroutine trace, e.g. `	/app/main.go:12 +0x1d`
+var goLocation = regexp.MustCompile(`^\t(.+):(\d+)(?: \+0x[0-9a-f]+)?$`)
+
+// Parses the trace of the first goroutine printed by a panic, e.g.
+//
+//	panic: runtime error: index out of range
+//
+//	goroutine 1 [running]:
+//	main.(*T).get(...)
+//		/app/main.go:8
+//	main.main()
+//		/app/main.go:12 +0x1d
+func ParseGo(s string) (models.StackTrace, error) {
+	var frames []models.Frame
+	inGoroutine := false
+	function := ""
+	for _, l := range lines(s) {
+		switch {
+		case !inGoroutine:
+			inGoroutine = strings.HasPrefix(l, "goroutine ") && strings.HasSuffix(l, ":")
+		case strings.TrimSpace(l) == "":
+			// only the goroutine that panicked is kept
+			if len(frames) > 0 {
+				return result(reverse(frames))
+			}
+		case strings.HasPrefix(l, "\t"):
+			m := goLocation.FindStringSubmatch(l)
+			if m == nil || function == "" {
+				continue
+			}
+			lineNo, _ := strconv.Atoi(m[2])
+			module, name := splitGoFunction(function)
+			frames = append(frames, newFrame(module, name, m[1], lineNo))
+			function = ""
+		default:
+			function = goFunction(l)
+		}
+	}
+	return result(reverse(frames))
+}
+
+// Returns the function called on a line of a goroutine trace, without its
+// arguments, e.g. `main.(*T).get` for `main.(*T).get(0xc000010000, 0x3)`
+func goFunction(l string) string {
+	if strings.HasPrefix(l, "created by ") {
+		l = strings.TrimPrefix(l, "created by ")
+		if i := strings.Index(l, " in goroutine "); i >= 0 {
+			l = l[:i]
+		}
+		return l
+	}
+	if !strings.HasSuffix(l, ")") {
+		return ""
+	}
+	if i := strings.LastIndex(l, "("); i > 0 {
+		return l[:i]
+	}
+	return ""
+}
+
+// Splits a function name, e.g. `github.com/a/b.(*T).Method`, into its package
+// path and function name
+func splitGoFunction(name string) (string, string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	dot += slash + 1
+	return name[:dot], name[dot+1:]
+}
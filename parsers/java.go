@@ -0,0 +1,40 @@
+package parsers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Frame of a JVM stack trace, e.g. `	at com.example.Foo.bar(Foo.java:10)`,
+// optionally prefixed with the class loader and module of the class
+var javaFrame = regexp.MustCompile(`^\s*at\s+(?:\S*/)?([\w$.<>]+)\.([\w$<>\-]+)\((?:Native Method|Unknown Source|([^():\s]+?)(?::(\d+))?)\)\s*$`)
+
+// Parses a JVM stack trace, including the traces of the exceptions that
+// caused it or were suppressed by it, e.g.
+//
+//	java.lang.IllegalStateException: could not load order
+//		at com.example.Orders.load(Orders.java:42)
+//		at com.example.Main.main(Main.java:10)
+//	Caused by: java.sql.SQLException: timeout
+//		at com.example.Db.query(Db.java:7)
+//		... 2 more
+func ParseJava(s string) (models.StackTrace, error) {
+	var frames, exception []models.Frame
+	for _, l := range lines(s) {
+		if t := strings.TrimSpace(l); strings.HasPrefix(t, "Caused by:") || strings.HasPrefix(t, "Suppressed:") {
+			frames = append(frames, reverse(exception)...)
+			exception = nil
+			continue
+		}
+		m := javaFrame.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		lineNo, _ := strconv.Atoi(m[4])
+		exception = append(exception, newFrame(m[1], m[2], m[3], lineNo))
+	}
+	return result(append(frames, reverse(exception)...))
+}
@@ -0,0 +1,39 @@
+package parsers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Frame of a V8 stack trace, either `    at Foo.bar (/app/foo.js:10:15)` or,
+// for anonymous functions, `    at /app/foo.js:10:15`
+var nodeFrame = regexp.MustCompile(`^\s*at\s+(?:(.*?)\s+\()?(.+?):(\d+):\d+\)?\s*$`)
+
+// Parses a Node.js or V8 stack trace, e.g.
+//
+//	TypeError: Cannot read property 'id' of undefined
+//	    at Orders.load (/app/orders.js:10:15)
+//	    at /app/server.js:5:3
+func ParseNode(s string) (models.StackTrace, error) {
+	var frames []models.Frame
+	for _, l := range lines(s) {
+		m := nodeFrame.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		lineNo, _ := strconv.Atoi(m[3])
+		function := strings.TrimPrefix(m[1], "async ")
+		module := ""
+		if !strings.HasPrefix(function, "new ") {
+			module, function = splitLastDot(function)
+		}
+		if function == "" {
+			function = "<anonymous>"
+		}
+		frames = append(frames, newFrame(module, function, m[2], lineNo))
+	}
+	return result(reverse(frames))
+}
@@ -0,0 +1,138 @@
+// Package parsers turns textual stack traces into models.StackTrace values.
+//
+// Every parser is also available as a filter, so clients can send a stack
+// trace as a plain string in raw_data and configure e.g.
+//
+//	"configurable_filters": {"instance": ["parse_java_stack"]}
+//
+// to have events grouped by the frames of the stack trace. Frames are ordered
+// like Python tracebacks, from the outermost call to the innermost one. When a
+// trace holds a chain of exceptions, the frames of each exception follow the
+// frames of the exception it caused.
+package parsers
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/util"
+)
+
+// Parser parses a textual stack trace into its frames
+type Parser func(string) (models.StackTrace, error)
+
+var errNoFrames = errors.New("no stack frames found")
+
+// Parsers by language. Parse tries them in this order.
+var parsers = []struct {
+	name   string
+	parser Parser
+}{
+	{"python", ParsePython},
+	{"go", ParseGo},
+	{"java", ParseJava},
+	{"node", ParseNode},
+	{"dotnet", ParseDotNet},
+}
+
+// Parses a stack trace of any of the supported languages, by keeping the
+// parser that finds the most frames
+func Parse(s string) (models.StackTrace, error) {
+	best := models.StackTrace{}
+	for _, p := range parsers {
+		if stacktrace, err := p.parser(s); err == nil && len(stacktrace.Frames) > len(best.Frames) {
+			best = stacktrace
+		}
+	}
+	if len(best.Frames) == 0 {
+		return best, errNoFrames
+	}
+	return best, nil
+}
+
+// Filters to register on the server, by name
+func Filters() map[string]func(models.EventData) (models.EventData, error) {
+	filters := map[string]func(models.EventData) (models.EventData, error){
+		"parse_stack": filter(Parse),
+	}
+	for _, p := range parsers {
+		filters["parse_"+p.name+"_stack"] = filter(p.parser)
+	}
+	return filters
+}
+
+// Returns a filter replacing a string raw data by the stack trace parsed from
+// it. Raw data that is not a string is assumed to be structured already. The
+// stack trace is converted to generic JSON, like the raw data sent by clients,
+// so that the filters decoding it with mapstructure can follow.
+func filter(parse Parser) func(models.EventData) (models.EventData, error) {
+	return func(data models.EventData) (models.EventData, error) {
+		s, ok := data.Raw.(string)
+		if !ok {
+			return data, nil
+		}
+		stacktrace, err := parse(s)
+		if err != nil {
+			return data, err
+		}
+		raw, err := util.ToGenericJSON(stacktrace)
+		if err != nil {
+			return data, err
+		}
+		data.Raw = raw
+		return data, nil
+	}
+}
+
+func lines(s string) []string {
+	return strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+}
+
+// Builds a frame, keeping the absolute path apart from the file name
+func newFrame(module, function, path string, lineNo int) models.Frame {
+	frame := models.Frame{
+		Module:   module,
+		Function: function,
+		Filename: path,
+		LineNo:   lineNo,
+	}
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") || (len(path) > 2 && path[1] == ':' && path[2] == '\\') {
+		frame.AbsPath = path
+		frame.Filename = baseName(path)
+	}
+	return frame
+}
+
+// Returns the last element of a unix or windows path
+func baseName(path string) string {
+	if i := strings.LastIndexAny(path, `/\`); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
+// Splits a qualified name, e.g. `com.example.Foo.bar`, at its last dot
+func splitLastDot(name string) (string, string) {
+	if i := strings.LastIndex(name, "."); i > 0 && i < len(name)-1 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// Reverses frames listed from the innermost call
+func reverse(frames []models.Frame) []models.Frame {
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+func result(frames []models.Frame) (models.StackTrace, error) {
+	if len(frames) == 0 {
+		return models.StackTrace{}, errNoFrames
+	}
+	return models.StackTrace{Frames: frames}, nil
+}
@@ -0,0 +1,143 @@
+package parsers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mitchellh/mapstructure"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+const goTrace = `panic: runtime error: index out of range [5] with length 3
+
+goroutine 1 [running]:
+main.(*cart).item(...)
+	/app/cart.go:8
+main.main()
+	/app/main.go:12 +0x1d
+exit status 2`
+
+const javaTrace = `java.lang.IllegalStateException: could not load order
+	at com.example.Orders.load(Orders.java:42)
+	at java.base/java.lang.Thread.run(Thread.java:834)
+Caused by: java.sql.SQLException: timeout
+	at com.example.Db.query(Db.java:7)
+	at sun.reflect.NativeMethodAccessorImpl.invoke0(Native Method)
+	... 2 more`
+
+const nodeTrace = `TypeError: Cannot read property 'id' of undefined
+    at Orders.load (/app/orders.js:10:15)
+    at async Promise.all (index 0)
+    at /app/server.js:5:3`
+
+const pythonTrace = `Traceback (most recent call last):
+  File "/app/db.py", line 3, in query
+    raise TimeoutError()
+TimeoutError
+
+During handling of the above exception, another exception occurred:
+
+Traceback (most recent call last):
+  File "/app/main.py", line 10, in <module>
+    main()
+  File "/app/main.py", line 6, in main
+    load()
+ValueError: could not load order`
+
+const dotnetTrace = `System.InvalidOperationException: could not load order ---> System.TimeoutException: timeout
+   at Shop.Db.Query(String sql) in C:\src\Db.cs:line 7
+   --- End of inner exception stack trace ---
+   at Shop.Orders.Load(Int32 id) in C:\src\Orders.cs:line 42
+   at Shop.Program.Main(String[] args)`
+
+// Frames as `module function filename:lineno`
+func describe(stacktrace models.StackTrace) []string {
+	var frames []string
+	for _, f := range stacktrace.Frames {
+		frames = append(frames, fmt.Sprintf("%s %s %s:%d", f.Module, f.Function, f.Filename, f.LineNo))
+	}
+	return frames
+}
+
+func TestParsers(t *testing.T) {
+	tests := []struct {
+		name     string
+		parser   Parser
+		trace    string
+		expected []string
+	}{
+		{"go", ParseGo, goTrace, []string{
+			"main main main.go:12",
+			"main (*cart).item cart.go:8",
+		}},
+		{"java", ParseJava, javaTrace, []string{
+			"java.lang.Thread run Thread.java:834",
+			"com.example.Orders load Orders.java:42",
+			"sun.reflect.NativeMethodAccessorImpl invoke0 :0",
+			"com.example.Db query Db.java:7",
+		}},
+		{"node", ParseNode, nodeTrace, []string{
+			" <anonymous> server.js:5",
+			"Orders load orders.js:10",
+		}},
+		{"python", ParsePython, pythonTrace, []string{
+			"main <module> main.py:10",
+			"main main main.py:6",
+			"db query db.py:3",
+		}},
+		{"dotnet", ParseDotNet, dotnetTrace, []string{
+			"Shop.Program Main :0",
+			"Shop.Orders Load Orders.cs:42",
+			"Shop.Db Query Db.cs:7",
+		}},
+	}
+	for _, test := range tests {
+		for parser, parse := range map[string]Parser{test.name: test.parser, "any": Parse} {
+			stacktrace, err := parse(test.trace)
+			if err != nil {
+				t.Errorf("%s trace with %s parser: unexpected error: %v", test.name, parser, err)
+				continue
+			}
+			if frames := describe(stacktrace); fmt.Sprint(frames) != fmt.Sprint(test.expected) {
+				t.Errorf("%s trace with %s parser: expected frames %q, got %q", test.name, parser, test.expected, frames)
+			}
+		}
+	}
+}
+
+func TestParsePythonContextLine(t *testing.T) {
+	stacktrace, _ := ParsePython(pythonTrace)
+	if frame := stacktrace.Frames[0]; frame.ContextLine != "main()" || frame.AbsPath != "/app/main.py" {
+		t.Errorf("unexpected frame %+v", frame)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	filters := Filters()
+	for _, name := range []string{"parse_stack", "parse_go_stack", "parse_java_stack", "parse_node_stack", "parse_python_stack", "parse_dotnet_stack"} {
+		if filters[name] == nil {
+			t.Errorf("missing filter %s", name)
+		}
+	}
+
+	data, err := filters["parse_stack"](models.EventData{Raw: nodeTrace, RawMessage: "TypeError"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the stack trace can be decoded by the filters that follow
+	var stacktrace models.StackTrace
+	if err := mapstructure.Decode(data.Raw, &stacktrace); err != nil || len(stacktrace.Frames) != 2 || data.RawMessage != "TypeError" {
+		t.Errorf("unexpected event data %+v: %v", data, err)
+	}
+
+	// structured stack traces are left as is
+	raw := map[string]interface{}{"frames": []interface{}{}}
+	if data, err := filters["parse_java_stack"](models.EventData{Raw: raw}); err != nil || data.Raw == nil {
+		t.Errorf("unexpected result %+v, %v", data, err)
+	}
+
+	if _, err := filters["parse_go_stack"](models.EventData{Raw: "not a stack trace"}); err == nil {
+		t.Errorf("expected an error for a string without frames")
+	}
+}
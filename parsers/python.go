@@ -0,0 +1,47 @@
+package parsers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Frame of a Python traceback, e.g. `  File "/app/main.py", line 10, in main`
+var pythonFrame = regexp.MustCompile(`^\s*File "(.+)", line (\d+)(?:, in (.+))?$`)
+
+// Parses a Python traceback, including the tracebacks of the exceptions that
+// caused it, which Python prints first, e.g.
+//
+//	Traceback (most recent call last):
+//	  File "/app/main.py", line 10, in <module>
+//	    main()
+//	  File "/app/main.py", line 6, in main
+//	    1 / 0
+//	ZeroDivisionError: division by zero
+func ParsePython(s string) (models.StackTrace, error) {
+	var frames, exception []models.Frame
+	for _, l := range lines(s) {
+		if strings.HasPrefix(l, "Traceback (most recent call last):") {
+			frames = append(exception, frames...)
+			exception = nil
+			continue
+		}
+		if m := pythonFrame.FindStringSubmatch(l); m != nil {
+			lineNo, _ := strconv.Atoi(m[2])
+			exception = append(exception, newFrame(pythonModule(m[1]), m[3], m[1], lineNo))
+			continue
+		}
+		// the line following a frame is its source, when available
+		if n := len(exception); n > 0 && exception[n-1].ContextLine == "" && strings.HasPrefix(l, "    ") {
+			exception[n-1].ContextLine = strings.TrimSpace(l)
+		}
+	}
+	return result(append(exception, frames...))
+}
+
+// Returns the module of a source file, e.g. `main` for `/app/main.py`
+func pythonModule(path string) string {
+	return strings.TrimSuffix(baseName(path), ".py")
+}
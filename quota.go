@@ -0,0 +1,176 @@
+package eventsum
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Limits an event can be dropped for
+const (
+	limitRate  = "rate"
+	limitDaily = "daily"
+)
+
+// Key of the quota applied to services without a quota of their own
+const defaultQuota = "*"
+
+type quotaKey struct {
+	service     string
+	environment string
+}
+
+// Token bucket and daily counters of a service and environment
+type quotaUsage struct {
+	quota        string
+	tokens       float64
+	last         time.Time // time tokens were last refilled
+	day          string
+	accepted     int64
+	rateDropped  int64
+	dailyDropped int64
+}
+
+// quotaLimiter enforces the rate limits and daily quotas of the config. Every
+// service and environment gets its own token bucket and daily counter, even
+// when the quota applied is shared, e.g. the default one.
+type quotaLimiter struct {
+	sync.Mutex
+	quotas map[string]conf.QuotaConfig
+	usage  map[quotaKey]*quotaUsage
+}
+
+// Returns nil when no quota is configured
+func newQuotaLimiter(quotas map[string]conf.QuotaConfig) *quotaLimiter {
+	if len(quotas) == 0 {
+		return nil
+	}
+	return &quotaLimiter{
+		quotas: quotas,
+		usage:  make(map[quotaKey]*quotaUsage),
+	}
+}
+
+// Finds the quota of a service and environment, the most specific one first
+func (q *quotaLimiter) find(service, environment string) (string, conf.QuotaConfig, bool) {
+	for _, key := range []string{service + "/" + environment, service, defaultQuota} {
+		if quota, ok := q.quotas[key]; ok {
+			return key, quota, true
+		}
+	}
+	return "", conf.QuotaConfig{}, false
+}
+
+// Most tokens held by the bucket of a quota
+func burst(quota conf.QuotaConfig) float64 {
+	if quota.Burst > 0 {
+		return float64(quota.Burst)
+	}
+	return math.Max(1, math.Ceil(quota.Rate))
+}
+
+// Refills the bucket for the time elapsed since the last refill, and resets
+// the daily counters on a new UTC day
+func (u *quotaUsage) refill(quota conf.QuotaConfig, now time.Time) {
+	if elapsed := now.Sub(u.last).Seconds(); elapsed > 0 {
+		u.tokens = math.Min(burst(quota), u.tokens+elapsed*quota.Rate)
+		u.last = now
+	}
+	if day := now.UTC().Format("2006-01-02"); day > u.day {
+		u.day = day
+		u.accepted, u.rateDropped, u.dailyDropped = 0, 0, 0
+	}
+}
+
+// Counts an event of a service and environment against its quota. Returns
+// false, along with the limit exceeded, when the event must be dropped.
+func (q *quotaLimiter) allow(service, environment string, now time.Time) (bool, string) {
+	name, quota, ok := q.find(service, environment)
+	if !ok {
+		return true, ""
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	key := quotaKey{service, environment}
+	u, ok := q.usage[key]
+	if !ok {
+		u = &quotaUsage{quota: name, tokens: burst(quota), last: now}
+		q.usage[key] = u
+	}
+	u.refill(quota, now)
+
+	if quota.Daily > 0 && u.accepted >= quota.Daily {
+		u.dailyDropped++
+		return false, limitDaily
+	}
+	if quota.Rate > 0 {
+		if u.tokens < 1 {
+			u.rateDropped++
+			return false, limitRate
+		}
+		u.tokens--
+	}
+	u.accepted++
+	return true, ""
+}
+
+// Lists the usage of every service and environment that captured events, by
+// service then environment
+func (q *quotaLimiter) list(now time.Time) []QuotaUsage {
+	q.Lock()
+	defer q.Unlock()
+
+	usage := make([]QuotaUsage, 0, len(q.usage))
+	for key, u := range q.usage {
+		quota := q.quotas[u.quota]
+		u.refill(quota, now)
+		usage = append(usage, QuotaUsage{
+			Service:      key.service,
+			Environment:  key.environment,
+			Quota:        u.quota,
+			Rate:         quota.Rate,
+			Burst:        int(burst(quota)),
+			Daily:        quota.Daily,
+			Tokens:       u.tokens,
+			Day:          u.day,
+			Accepted:     u.accepted,
+			RateDropped:  u.rateDropped,
+			DailyDropped: u.dailyDropped,
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Service != usage[j].Service {
+			return usage[i].Service < usage[j].Service
+		}
+		return usage[i].Environment < usage[j].Environment
+	})
+	return usage
+}
+
+// Lists the current usage of the quotas, of a single service if the `service`
+// query parameter is set
+func (h *httpHandler) quotasHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	usage := []QuotaUsage{}
+	if h.es.quotas != nil {
+		usage = h.es.quotas.list(time.Now())
+	}
+	if service := r.URL.Query().Get("service"); service != "" {
+		filtered := []QuotaUsage{}
+		for _, u := range usage {
+			if u.Service == service {
+				filtered = append(filtered, u)
+			}
+		}
+		usage = filtered
+	}
+	h.sendResp(w, "quotas", usage)
+}
@@ -0,0 +1,94 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+func TestQuotaLimiter(t *testing.T) {
+	q := newQuotaLimiter(map[string]conf.QuotaConfig{
+		"wish_be":      {Rate: 1, Burst: 2},
+		"wish_be/prod": {Daily: 3},
+		"*":            {Rate: 10},
+	})
+	now := time.Date(2020, 1, 26, 23, 59, 0, 0, time.UTC)
+
+	// the burst is captured at once, then one event per second
+	for i, expected := range []bool{true, true, false} {
+		if ok, _ := q.allow("wish_be", "default", now); ok != expected {
+			t.Errorf("event %d: expected allowed to be %v", i, expected)
+		}
+	}
+	if ok, limit := q.allow("wish_be", "default", now); ok || limit != limitRate {
+		t.Errorf("expected the rate limit to be exceeded, got %v %q", ok, limit)
+	}
+	if ok, _ := q.allow("wish_be", "default", now.Add(time.Second)); !ok {
+		t.Errorf("expected a token to be refilled after a second")
+	}
+
+	// the quota of the environment overrides the one of the service
+	for i := 0; i < 3; i++ {
+		q.allow("wish_be", "prod", now)
+	}
+	if ok, limit := q.allow("wish_be", "prod", now); ok || limit != limitDaily {
+		t.Errorf("expected the daily quota to be exceeded, got %v %q", ok, limit)
+	}
+	if ok, _ := q.allow("wish_be", "prod", now.Add(time.Minute)); !ok {
+		t.Errorf("expected the daily quota to be reset on a new day")
+	}
+
+	// each service gets its own bucket for the default quota
+	q.allow("crond", "prod", now)
+	q.allow("merchant_be", "prod", now)
+
+	usage := q.list(now.Add(time.Second))
+	if len(usage) != 4 {
+		t.Fatalf("expected the usage of 4 services and environments, got %d", len(usage))
+	}
+	if u := usage[0]; u.Service != "crond" || u.Quota != "*" || u.Accepted != 1 || u.Tokens != 10 {
+		t.Errorf("unexpected usage of crond: %+v", u)
+	}
+	if u := usage[2]; u.Environment != "default" || u.Day != "2020-01-26" || u.Accepted != 3 || u.RateDropped != 2 {
+		t.Errorf("unexpected usage of wish_be/default: %+v", u)
+	}
+	if u := usage[3]; u.Environment != "prod" || u.Day != "2020-01-27" || u.Accepted != 1 || u.DailyDropped != 0 {
+		t.Errorf("unexpected usage of wish_be/prod: %+v", u)
+	}
+
+	if newQuotaLimiter(nil) != nil {
+		t.Errorf("expected no limiter without quotas")
+	}
+}
+
+func TestSendOverQuota(t *testing.T) {
+	es := newTestEventStore(5)
+	es.quotas = newQuotaLimiter(map[string]conf.QuotaConfig{"wish_be": {Daily: 2}})
+	h := newHTTPHandler(es, newTestLogger(t), conf.DefaultConfig())
+
+	for i := 0; i < 3; i++ {
+		if err := es.Send(UnaddedEvent{Service: "wish_be", Environment: "prod"}); err != nil {
+			t.Fatalf("expected events over quota to be acknowledged, got %v", err)
+		}
+	}
+	es.Send(UnaddedEvent{Service: "crond", Environment: "prod"})
+	if len(es.channel.queue) != 3 {
+		t.Errorf("expected the event over quota to be dropped, got %d events", len(es.channel.queue))
+	}
+
+	w := httptest.NewRecorder()
+	h.quotasHandler(w, httptest.NewRequest("GET", "/admin/quotas?service=wish_be", nil), nil)
+	var resp struct {
+		Quotas []QuotaUsage `json:"quotas"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Quotas) != 1 || resp.Quotas[0].Accepted != 2 || resp.Quotas[0].DailyDropped != 1 {
+		t.Errorf("unexpected quotas: %+v", resp.Quotas)
+	}
+}
@@ -0,0 +1,165 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/datastore"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Longest name of a service, environment or region
+const maxRegistryName = 256
+
+// Body of the requests creating or renaming a registry entry
+type registryRequest struct {
+	Name string `json:"name"`
+}
+
+// Adds an unknown service or environment of a captured event to the registry.
+// Returns the id of the entry, unless it is retired or cannot be added.
+func (es *eventStore) register(kind, name string) (int, bool) {
+	if err := validateRegistryName(name); err != nil {
+		return 0, false
+	}
+	entry, err := es.ds.AddRegistryEntry(kind, name)
+	if err == nil {
+		es.log.App().Infof("Registered %s '%s'", strings.TrimSuffix(kind, "s"), name)
+		return entry.Id, true
+	} else if err != datastore.ErrRegistryEntryExists {
+		es.log.App().Errorf("Error registering %s '%s': %v", strings.TrimSuffix(kind, "s"), name, err)
+		return 0, false
+	}
+
+	// added in the meantime, e.g. by another server, or retired
+	es.ds.RefreshRegistry()
+	if kind == datastore.RegistryServices {
+		service, ok := es.ds.GetServicesMap()[name]
+		return service.Id, ok
+	}
+	environment, ok := es.ds.GetEnvironmentsMap()[name]
+	return environment.Id, ok
+}
+
+func validateRegistryName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name cannot be empty")
+	} else if len(name) > maxRegistryName {
+		return errors.Errorf("name cannot be longer than %d bytes", maxRegistryName)
+	}
+	return nil
+}
+
+// Returns the kind of registry entries of a request, or sends a 404
+func (h *httpHandler) registryKind(w http.ResponseWriter, ps httprouter.Params) (string, bool) {
+	switch kind := ps.ByName("kind"); kind {
+	case datastore.RegistryServices, datastore.RegistryEnvironments, datastore.RegistryRegions:
+		return kind, true
+	default:
+		h.sendError(w, http.StatusNotFound, datastore.ErrUnknownRegistryKind, "Error")
+		return "", false
+	}
+}
+
+// Returns the id of the registry entry of a request, or sends a 400
+func (h *httpHandler) registryId(w http.ResponseWriter, ps httprouter.Params) (int, bool) {
+	id, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, errors.New("id must be an int"), "Error")
+		return 0, false
+	}
+	return id, true
+}
+
+// Returns the name of the body of a request, or sends a 400
+func (h *httpHandler) registryName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	defer r.Body.Close()
+	var req registryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Error decoding JSON entry")
+		return "", false
+	}
+	if err := validateRegistryName(req.Name); err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Invalid entry")
+		return "", false
+	}
+	return req.Name, true
+}
+
+// Sends the registry entry created or changed by a request
+func (h *httpHandler) sendRegistryEntry(w http.ResponseWriter, entry RegistryEntry, err error) {
+	switch err {
+	case nil:
+		h.sendResp(w, "entry", entry)
+	case datastore.ErrRegistryEntryExists:
+		h.sendError(w, http.StatusConflict, err, "Error")
+	case datastore.ErrRegistryEntryNotFound:
+		h.sendError(w, http.StatusNotFound, err, "Error")
+	default:
+		h.sendError(w, http.StatusInternalServerError, err, "Error changing the registry")
+	}
+}
+
+// Lists the services, environments or regions, retired ones included
+func (h *httpHandler) listRegistryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	kind, ok := h.registryKind(w, ps)
+	if !ok {
+		return
+	}
+	entries, err := h.es.ds.ListRegistryEntries(kind)
+	if err != nil {
+		h.sendError(w, http.StatusInternalServerError, err, "Error listing the registry")
+		return
+	}
+	h.sendResp(w, kind, entries)
+}
+
+func (h *httpHandler) createRegistryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	kind, ok := h.registryKind(w, ps)
+	if !ok {
+		return
+	}
+	name, ok := h.registryName(w, r)
+	if !ok {
+		return
+	}
+	entry, err := h.es.ds.AddRegistryEntry(kind, name)
+	h.sendRegistryEntry(w, entry, err)
+}
+
+func (h *httpHandler) renameRegistryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	kind, ok := h.registryKind(w, ps)
+	if !ok {
+		return
+	}
+	id, ok := h.registryId(w, ps)
+	if !ok {
+		return
+	}
+	name, ok := h.registryName(w, r)
+	if !ok {
+		return
+	}
+	entry, err := h.es.ds.RenameRegistryEntry(kind, id, name)
+	h.sendRegistryEntry(w, entry, err)
+}
+
+// Retires an entry. Events are no longer captured under a retired service or
+// environment, but the events already saved are kept.
+func (h *httpHandler) retireRegistryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	kind, ok := h.registryKind(w, ps)
+	if !ok {
+		return
+	}
+	id, ok := h.registryId(w, ps)
+	if !ok {
+		return
+	}
+	entry, err := h.es.ds.RetireRegistryEntry(kind, id)
+	h.sendRegistryEntry(w, entry, err)
+}
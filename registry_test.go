@@ -0,0 +1,173 @@
+package eventsum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/datastore"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// registryDataStore keeps its registry in memory
+type registryDataStore struct {
+	stubDataStore
+	entries map[string][]RegistryEntry
+}
+
+func newRegistryDataStore() *registryDataStore {
+	return &registryDataStore{entries: map[string][]RegistryEntry{
+		datastore.RegistryServices:     {{Id: 1, Name: "wish_be"}},
+		datastore.RegistryEnvironments: {{Id: 1, Name: "prod"}},
+		datastore.RegistryRegions:      {},
+	}}
+}
+
+func (d *registryDataStore) GetServicesMap() map[string]EventService {
+	services := make(map[string]EventService)
+	for _, e := range d.entries[datastore.RegistryServices] {
+		if e.RetiredAt == nil {
+			services[e.Name] = EventService{Id: e.Id, Name: e.Name}
+		}
+	}
+	return services
+}
+
+func (d *registryDataStore) GetEnvironmentsMap() map[string]EventEnvironment {
+	environments := make(map[string]EventEnvironment)
+	for _, e := range d.entries[datastore.RegistryEnvironments] {
+		if e.RetiredAt == nil {
+			environments[e.Name] = EventEnvironment{Id: e.Id, Name: e.Name}
+		}
+	}
+	return environments
+}
+
+func (d *registryDataStore) RefreshRegistry() error { return nil }
+
+func (d *registryDataStore) ListRegistryEntries(kind string) ([]RegistryEntry, error) {
+	return d.entries[kind], nil
+}
+
+func (d *registryDataStore) AddRegistryEntry(kind string, name string) (RegistryEntry, error) {
+	for _, e := range d.entries[kind] {
+		if e.Name == name {
+			return RegistryEntry{}, datastore.ErrRegistryEntryExists
+		}
+	}
+	e := RegistryEntry{Id: len(d.entries[kind]) + 1, Name: name}
+	d.entries[kind] = append(d.entries[kind], e)
+	return e, nil
+}
+
+func (d *registryDataStore) RenameRegistryEntry(kind string, id int, name string) (RegistryEntry, error) {
+	for i, e := range d.entries[kind] {
+		if e.Id == id {
+			d.entries[kind][i].Name = name
+			return d.entries[kind][i], nil
+		}
+	}
+	return RegistryEntry{}, datastore.ErrRegistryEntryNotFound
+}
+
+func (d *registryDataStore) RetireRegistryEntry(kind string, id int) (RegistryEntry, error) {
+	for i, e := range d.entries[kind] {
+		if e.Id == id {
+			now := time.Now()
+			d.entries[kind][i].RetiredAt = &now
+			return d.entries[kind][i], nil
+		}
+	}
+	return RegistryEntry{}, datastore.ErrRegistryEntryNotFound
+}
+
+func registryParams(kind, id string) httprouter.Params {
+	params := httprouter.Params{{Key: "kind", Value: kind}}
+	if id != "" {
+		params = append(params, httprouter.Param{Key: "id", Value: id})
+	}
+	return params
+}
+
+func TestRegistryHandlers(t *testing.T) {
+	ds := newRegistryDataStore()
+	es := newTestEventStore(1)
+	es.ds = ds
+	h := newHTTPHandler(es, newTestLogger(t), conf.DefaultConfig())
+
+	tests := []struct {
+		name    string
+		handler httprouter.Handle
+		params  httprouter.Params
+		body    string
+		code    int
+	}{
+		{"create", h.createRegistryHandler, registryParams("services", ""), `{"name": "crond"}`, http.StatusOK},
+		{"create existing", h.createRegistryHandler, registryParams("services", ""), `{"name": "crond"}`, http.StatusConflict},
+		{"create without name", h.createRegistryHandler, registryParams("services", ""), `{"name": " "}`, http.StatusBadRequest},
+		{"create unknown kind", h.createRegistryHandler, registryParams("tiers", ""), `{"name": "crond"}`, http.StatusNotFound},
+		{"rename", h.renameRegistryHandler, registryParams("environments", "1"), `{"name": "production"}`, http.StatusOK},
+		{"rename unknown", h.renameRegistryHandler, registryParams("environments", "9"), `{"name": "stage"}`, http.StatusNotFound},
+		{"rename bad id", h.renameRegistryHandler, registryParams("environments", "a"), `{"name": "stage"}`, http.StatusBadRequest},
+		{"retire", h.retireRegistryHandler, registryParams("services", "1"), ``, http.StatusOK},
+		{"list", h.listRegistryHandler, registryParams("services", ""), ``, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		test.handler(w, httptest.NewRequest("POST", "/registry", strings.NewReader(test.body)), test.params)
+		if w.Code != test.code {
+			t.Errorf("%s: expected a %d, got %d: %s", test.name, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	if _, ok := ds.GetServicesMap()["wish_be"]; ok {
+		t.Errorf("expected wish_be to be retired")
+	}
+	if service, ok := ds.GetServicesMap()["crond"]; !ok || service.Id != 2 {
+		t.Errorf("expected crond to be created, got %v", service)
+	}
+	if _, ok := ds.GetEnvironmentsMap()["production"]; !ok {
+		t.Errorf("expected prod to be renamed")
+	}
+}
+
+func TestCaptureAutoRegister(t *testing.T) {
+	ds := newRegistryDataStore()
+	es := newTestEventStore(5)
+	es.ds = ds
+	h := newHTTPHandler(es, newTestLogger(t), conf.DefaultConfig())
+	es.log = h.log
+
+	capture := func(service string) int {
+		evt := `{"service":"` + service + `","environment":"stage","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20"}`
+		w := httptest.NewRecorder()
+		h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(evt)), nil)
+		return w.Code
+	}
+
+	if code := capture("crond"); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected unknown services to be rejected, got %d", code)
+	}
+
+	es.autoRegister = true
+	if code := capture("crond"); code != http.StatusOK {
+		t.Errorf("expected unknown services to be registered, got %d", code)
+	}
+	if _, ok := ds.GetServicesMap()["crond"]; !ok {
+		t.Errorf("expected crond to be registered")
+	}
+	if _, ok := ds.GetEnvironmentsMap()["stage"]; !ok {
+		t.Errorf("expected stage to be registered")
+	}
+
+	// retired services are not registered again
+	ds.RetireRegistryEntry(datastore.RegistryServices, 1)
+	if code := capture("wish_be"); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected retired services to be rejected, got %d", code)
+	}
+}
@@ -0,0 +1,39 @@
+// Package retryafter handles the Retry-After delays the eventsum server sends
+// along with the requests and the events of a batch it is too loaded to take.
+// It is shared by the clients of the server.
+package retryafter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is the error of a request the server asked to retry after a delay,
+// because it is overloaded
+type Error struct {
+	error
+	Delay time.Duration
+}
+
+// Returns an error to retry after the delay of a Retry-After header
+func New(err error, header string) Error {
+	return Error{err, Parse(header)}
+}
+
+// Returns the delay the server asked to wait before retrying, if any
+func Delay(err error) time.Duration {
+	if e, ok := err.(Error); ok {
+		return e.Delay
+	}
+	return 0
+}
+
+// Parses a Retry-After header in seconds. Dates are not supported.
+func Parse(header string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,30 @@
+package retryafter
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]time.Duration{
+		"3":                             3 * time.Second,
+		" 0 ":                           0,
+		"-1":                            0,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0,
+	}
+	for header, expected := range tests {
+		if delay := Parse(header); delay != expected {
+			t.Errorf("%q: expected %v, got %v", header, expected, delay)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	if delay := Delay(New(errors.New("overloaded"), "2")); delay != 2*time.Second {
+		t.Errorf("expected a delay of 2s, got %v", delay)
+	}
+	if delay := Delay(errors.New("down")); delay != 0 {
+		t.Errorf("expected no delay, got %v", delay)
+	}
+}
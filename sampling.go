@@ -0,0 +1,63 @@
+package eventsum
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// sampler keeps a share of the events matching the sampling rules of the
+// config. The decision for an event with an id only depends on the id, so that
+// the event retried by a client, or sent to another server, is kept or not
+// alike.
+type sampler struct {
+	rules []conf.SamplingRule
+}
+
+// Returns nil when no sampling rule is configured
+func newSampler(rules []conf.SamplingRule) *sampler {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &sampler{rules}
+}
+
+// Returns the rate of the first rule matching an event, 1 if none does
+func (s *sampler) rate(evt UnaddedEvent) float64 {
+	for _, rule := range s.rules {
+		if (rule.Service == "" || rule.Service == evt.Service) &&
+			(rule.Type == "" || rule.Type == evt.Type) &&
+			(rule.Name == "" || rule.Name == evt.Name) {
+			return rule.Rate
+		}
+	}
+	return 1
+}
+
+// Returns whether an event is kept. Kept events are weighted by the inverse of
+// the sample rate, so that their counts are extrapolated when saved.
+func (s *sampler) sample(evt *UnaddedEvent) bool {
+	rate := s.rate(*evt)
+	if rate >= 1 {
+		return true
+	}
+	if sampleKey(*evt) >= rate {
+		return false
+	}
+	evt.SampleWeight = 1 / rate
+	return true
+}
+
+// Maps an event onto [0, 1), by its id if it has one, or else at random. The
+// other fields of an event do not tell it apart from a similar event, e.g.
+// the same error raised twice within a second, which must be sampled apart.
+func sampleKey(evt UnaddedEvent) float64 {
+	if evt.EventId == "" {
+		return rand.Float64()
+	}
+	sum := sha256.Sum256([]byte(evt.Service + "/" + evt.EventId))
+	return float64(binary.BigEndian.Uint64(sum[:])>>11) / (1 << 53)
+}
@@ -0,0 +1,116 @@
+package eventsum
+
+import (
+	"fmt"
+	"testing"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/rules"
+)
+
+// periodDataStore saves every event under the same base, detail and instance
+// ids, the ids of the instances being given by the event names, and records
+// the periods updated
+type periodDataStore struct {
+	stubDataStore
+	periods map[int]EventInstancePeriod
+}
+
+func (periodDataStore) FindEventBaseId(EventBase) (int64, error)     { return 1, nil }
+func (periodDataStore) FindEventDetailId(EventDetail) (int64, error) { return 1, nil }
+
+func (periodDataStore) FindEventInstanceId(evt EventInstance) (int64, error) {
+	return int64(len(evt.RawData.Message)), nil
+}
+
+func (p periodDataStore) UpdateEventInstancePeriod(evt EventInstancePeriod) error {
+	p.periods[evt.EventInstanceId] = evt
+	return nil
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler([]conf.SamplingRule{
+		{Service: "wish_be", Name: "KeyError", Rate: 1},
+		{Service: "wish_be", Rate: 0.25},
+	})
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		evt := UnaddedEvent{Service: "wish_be", Name: "ValueError", EventId: fmt.Sprint(i)}
+		if s.sample(&evt) {
+			kept++
+			if evt.SampleWeight != 4 {
+				t.Fatalf("expected kept events to weigh 4, got %v", evt.SampleWeight)
+			}
+		}
+		if retried := (UnaddedEvent{Service: "wish_be", Name: "ValueError", EventId: fmt.Sprint(i)}); s.sample(&retried) != (evt.SampleWeight > 0) {
+			t.Fatalf("expected a retried event to be sampled alike")
+		}
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("expected about a quarter of the events to be kept, got %d", kept)
+	}
+
+	// events without an id are sampled apart, even when they are alike
+	kept = 0
+	for i := 0; i < 1000; i++ {
+		evt := UnaddedEvent{Service: "wish_be", Name: "ValueError", Timestamp: "2020-01-26 00:53:20"}
+		if s.sample(&evt) {
+			kept++
+		}
+	}
+	if kept < 200 || kept > 300 {
+		t.Errorf("expected about a quarter of the events without an id to be kept, got %d", kept)
+	}
+
+	for _, evt := range []UnaddedEvent{
+		{Service: "wish_be", Name: "KeyError"},
+		{Service: "crond", Name: "ValueError"},
+	} {
+		if !s.sample(&evt) || evt.SampleWeight != 0 {
+			t.Errorf("expected %s %s to be kept unweighted", evt.Service, evt.Name)
+		}
+	}
+
+	if newSampler(nil) != nil {
+		t.Errorf("expected no sampler without rules")
+	}
+}
+
+func TestSaveSampledEvents(t *testing.T) {
+	globalRule = rules.NewRule()
+	ds := periodDataStore{periods: map[int]EventInstancePeriod{}}
+	es := newTestEventStore(1)
+	es.ds = ds
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+
+	event := func(message string, weight float64) UnaddedEvent {
+		return UnaddedEvent{
+			Service:      "wish_be",
+			Environment:  "prod",
+			Name:         "KeyError",
+			Type:         "python",
+			Data:         EventData{Message: message, Raw: message},
+			Timestamp:    "2020-01-26 00:53:20",
+			SampleWeight: weight,
+		}
+	}
+	// instance 1 is sampled at a third, instance 2 is not sampled
+	if err := es.SaveToDB([]UnaddedEvent{
+		event("a", 3), event("a", 3),
+		event("bb", 0), event("bb", 0),
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if p := ds.periods[1]; p.Count != 6 || !p.Extrapolated {
+		t.Errorf("expected an extrapolated count of 6, got %d %v", p.Count, p.Extrapolated)
+	}
+	if p := ds.periods[2]; p.Count != 2 || p.Extrapolated {
+		t.Errorf("expected an exact count of 2, got %d %v", p.Count, p.Extrapolated)
+	}
+}
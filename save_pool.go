@@ -0,0 +1,94 @@
+package eventsum
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ContextLogic/eventsum/metrics"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// savePool saves the batches taken off the event channel with a fixed number
+// of workers. Batches wait in a bounded channel, and submitting a batch blocks
+// while it is full, so that the event channel fills up and captures are
+// rejected rather than batches piling up in memory.
+type savePool struct {
+	sync.Mutex
+	batches  chan []UnaddedEvent
+	save     func(context.Context, []UnaddedEvent)
+	ctx      context.Context // canceled once stop gives up on the batches left
+	cancel   context.CancelFunc
+	inFlight sync.WaitGroup // batches queued or being saved
+	busy     int            // workers saving a batch
+}
+
+// Starts the workers of a pool
+func newSavePool(workers, size int, save func(context.Context, []UnaddedEvent)) *savePool {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &savePool{
+		batches: make(chan []UnaddedEvent, size),
+		save:    save,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	metrics.SavePoolCapacity(workers, size)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *savePool) work() {
+	for batch := range p.batches {
+		p.setBusy(1)
+		p.save(p.ctx, batch)
+		p.setBusy(-1)
+		p.inFlight.Done()
+	}
+}
+
+func (p *savePool) setBusy(delta int) {
+	p.Lock()
+	defer p.Unlock()
+	p.busy += delta
+	metrics.SavePool(p.busy, len(p.batches))
+}
+
+// Queues a batch to be saved, waiting for room if every worker is busy and the
+// queue is full
+func (p *savePool) submit(batch []UnaddedEvent) {
+	p.inFlight.Add(1)
+	start := time.Now()
+	select {
+	case p.batches <- batch:
+	default:
+		p.batches <- batch
+		metrics.SavePoolWait(start)
+	}
+	p.Lock()
+	metrics.SavePool(p.busy, len(p.batches))
+	p.Unlock()
+}
+
+// Stops taking batches, and waits for the batches queued or being saved until
+// the context is done. Returns the error of the context if some were not
+// saved in time, in which case the workers are told to give up on them.
+func (p *savePool) stop(ctx context.Context) error {
+	defer p.cancel()
+	close(p.batches)
+	done := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
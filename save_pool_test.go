@@ -0,0 +1,66 @@
+package eventsum
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+func TestSavePoolBoundsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, most, saved := 0, 0, 0
+	p := newSavePool(2, 1, func(_ context.Context, batch []UnaddedEvent) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		saved += len(batch)
+		mu.Unlock()
+	})
+
+	for i := 0; i < 6; i++ {
+		p.submit(make([]UnaddedEvent, 2))
+	}
+	if err := p.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if most != 2 {
+		t.Errorf("expected at most 2 batches saved at once, got %d", most)
+	}
+	if saved != 12 {
+		t.Errorf("expected every batch to be saved before stop returns, got %d events", saved)
+	}
+}
+
+func TestSavePoolStopDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	canceled := make(chan struct{})
+	p := newSavePool(1, 1, func(ctx context.Context, _ []UnaddedEvent) {
+		select {
+		case <-ctx.Done():
+			close(canceled)
+		case <-release:
+		}
+	})
+	p.submit(make([]UnaddedEvent, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected stop to give up on the batch still being saved, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("expected the worker to be told to give up on its batch")
+	}
+}
@@ -3,6 +3,11 @@ DROP TABLE IF EXISTS event_instance;
 DROP TABLE IF EXISTS event_base;
 DROP TABLE IF EXISTS event_detail;
 DROP TABLE IF EXISTS event_group;
+DROP TABLE IF EXISTS event_dedupe;
+DROP TABLE IF EXISTS service;
+DROP TABLE IF EXISTS environment;
+DROP TABLE IF EXISTS region;
+DROP TABLE IF EXISTS api_key;
 
 
 CREATE TABLE IF NOT EXISTS event_group (
@@ -42,6 +47,9 @@ CREATE TABLE IF NOT EXISTS event_instance (
   generic_data json,
   generic_data_hash varchar(64),
   event_message text,
+  created_at timestamp,
+  received_at timestamp,
+  scrubbed jsonb, -- names of the scrub rules that replaced values
   UNIQUE (generic_data_hash, event_environment_id)
 );
 
@@ -54,5 +62,47 @@ CREATE TABLE IF NOT EXISTS event_instance_period (
   count int8 DEFAULT 1,
   counter_json jsonb,
   cas_value int8 DEFAULT 0,
-  UNIQUE (event_instance_id, start_time, end_time)
-);
\ No newline at end of file
+  extrapolated boolean DEFAULT false, -- count estimated from sampled events
+  region_id int8,
+  UNIQUE (event_instance_id, start_time, end_time, region_id)
+);
+
+-- ids of the events captured recently, to count retried events once
+CREATE TABLE IF NOT EXISTS event_dedupe (
+  key varchar(512) PRIMARY KEY,
+  expires_at timestamp
+);
+
+-- registry of the services, environments and regions, seeded from the config
+CREATE TABLE IF NOT EXISTS service (
+  _id serial8 PRIMARY KEY,
+  name varchar(256) UNIQUE NOT NULL,
+  created_at timestamp DEFAULT now(),
+  retired_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS environment (
+  _id serial8 PRIMARY KEY,
+  name varchar(256) UNIQUE NOT NULL,
+  created_at timestamp DEFAULT now(),
+  retired_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS region (
+  _id serial8 PRIMARY KEY,
+  name varchar(256) UNIQUE NOT NULL,
+  created_at timestamp DEFAULT now(),
+  retired_at timestamp
+);
+
+-- API keys, only their SHA-256 is stored
+CREATE TABLE IF NOT EXISTS api_key (
+  _id serial8 PRIMARY KEY,
+  key_hash varchar(64) UNIQUE NOT NULL,
+  prefix varchar(16),
+  service varchar(256), -- NULL for keys of every service
+  capabilities jsonb,
+  description text,
+  created_at timestamp DEFAULT now(),
+  revoked_at timestamp
+);
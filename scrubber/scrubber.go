@@ -0,0 +1,294 @@
+// Package scrubber replaces personal data and secrets in events before they
+// are saved.
+//
+// Values are replaced either because of the key they are stored under, e.g.
+// `password`, or because they match a value rule, e.g. an email address. Both
+// apply to the raw data, message and extra args of events, and so to the
+// variables of every stack frame. The names of the rules that replaced values
+// are returned, so that they can be recorded along with the event.
+package scrubber
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Prefix of the names of rules replacing values by key, e.g. `key:password`
+const keyRulePrefix = "key:"
+
+type valueRule struct {
+	name    string
+	pattern *regexp.Regexp
+	check   func(string) bool // further checks a match, nil to accept every match
+}
+
+// Built-in value rules, by name
+var builtinRules = map[string]valueRule{
+	"email": {
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`),
+	},
+	"credit_card": {
+		pattern: regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		check:   cardNumber,
+	},
+	"jwt": {
+		pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`),
+	},
+	"aws_access_key": {
+		pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+}
+
+// Prefixes and lengths of the card numbers issued by the major networks. Other
+// numbers, e.g. ids, are left alone even if they pass the Luhn check.
+var cardIssuers = []struct {
+	low, high int // range of the prefixes, all with the digits of high
+	lengths   []int
+}{
+	{4, 4, []int{13, 16, 19}},           // Visa
+	{51, 55, []int{16}},                 // Mastercard
+	{2221, 2720, []int{16}},             // Mastercard
+	{34, 34, []int{15}},                 // American Express
+	{37, 37, []int{15}},                 // American Express
+	{36, 36, []int{14}},                 // Diners Club
+	{6011, 6011, []int{16, 17, 18, 19}}, // Discover
+	{644, 649, []int{16, 17, 18, 19}},   // Discover
+	{65, 65, []int{16, 17, 18, 19}},     // Discover
+	{3528, 3589, []int{16, 17, 18, 19}}, // JCB
+}
+
+type keyRule struct {
+	name       string
+	normalized string
+}
+
+// Scrubber replaces the values matching its rules
+type Scrubber struct {
+	keys        []keyRule
+	rules       []valueRule
+	replacement string
+}
+
+// Builds the scrubber described by the config. Returns nil if scrubbing is
+// disabled.
+func New(config conf.ScrubConfig) (*Scrubber, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+	s := &Scrubber{replacement: config.Replacement}
+	for _, key := range config.Keys {
+		if normalized := normalizeKey(key); normalized != "" {
+			s.keys = append(s.keys, keyRule{key, normalized})
+		}
+	}
+	for _, name := range config.Values {
+		rule, ok := builtinRules[name]
+		if !ok {
+			return nil, errors.Errorf("unknown scrub rule '%s'", name)
+		}
+		rule.name = name
+		s.rules = append(s.rules, rule)
+	}
+
+	// custom rules are applied in a stable order
+	names := make([]string, 0, len(config.Patterns))
+	for name := range config.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pattern, err := regexp.Compile(config.Patterns[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "compiling scrub pattern '%s'", name)
+		}
+		s.rules = append(s.rules, valueRule{name: name, pattern: pattern})
+	}
+	return s, nil
+}
+
+// Scrubs the raw data, message and extra args of an event. Returns the sorted
+// names of the rules that replaced values.
+func (s *Scrubber) Scrub(evt *models.UnaddedEvent) []string {
+	fired := make(map[string]bool)
+	evt.Data.Raw = s.value(evt.Data.Raw, fired)
+	evt.Data.RawMessage = s.value(evt.Data.RawMessage, fired)
+	evt.Data.Message = s.string(evt.Data.Message, fired)
+	if evt.ExtraArgs != nil {
+		evt.ExtraArgs = s.object(evt.ExtraArgs, fired)
+	}
+
+	rules := make([]string, 0, len(fired))
+	for rule := range fired {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// Returns a scrubbed copy of a value decoded from JSON, or of a stack trace
+func (s *Scrubber) value(v interface{}, fired map[string]bool) interface{} {
+	switch v := v.(type) {
+	case string:
+		return s.string(v, fired)
+	case map[string]interface{}:
+		return s.object(v, fired)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, value := range v {
+			values[i] = s.value(value, fired)
+		}
+		return values
+	case models.StackTrace:
+		return s.stackTrace(v, fired)
+	case *models.StackTrace:
+		if v == nil {
+			return v
+		}
+		stacktrace := s.stackTrace(*v, fired)
+		return &stacktrace
+	}
+	return v
+}
+
+func (s *Scrubber) object(m map[string]interface{}, fired map[string]bool) map[string]interface{} {
+	object := make(map[string]interface{}, len(m))
+	for k, value := range m {
+		if key, ok := s.deniedKey(k); ok && value != nil {
+			fired[keyRulePrefix+key] = true
+			object[k] = s.replacement
+			continue
+		}
+		object[k] = s.value(value, fired)
+	}
+	return object
+}
+
+func (s *Scrubber) stackTrace(stacktrace models.StackTrace, fired map[string]bool) models.StackTrace {
+	frames := make([]models.Frame, len(stacktrace.Frames))
+	for i, frame := range stacktrace.Frames {
+		if frame.Vars != nil {
+			frame.Vars = s.object(frame.Vars, fired)
+		}
+		frames[i] = frame
+	}
+	return models.StackTrace{Frames: frames}
+}
+
+// Replaces the parts of a string matching the value rules
+func (s *Scrubber) string(str string, fired map[string]bool) string {
+	for _, rule := range s.rules {
+		str = rule.pattern.ReplaceAllStringFunc(str, func(match string) string {
+			if rule.check != nil && !rule.check(match) {
+				return match
+			}
+			fired[rule.name] = true
+			return s.replacement
+		})
+	}
+	return str
+}
+
+// Returns the denied name a key ends with, if any. Names are matched as whole
+// words, so that e.g. `token` matches `access_token` and `X-Auth-Token`, but
+// not `max_tokens`, and `session` does not match `session_count`.
+func (s *Scrubber) deniedKey(k string) (string, bool) {
+	words := keyWords(k)
+	for i := len(words) - 1; i >= 0; i-- {
+		suffix := strings.Join(words[i:], "")
+		for _, key := range s.keys {
+			if suffix == key.normalized {
+				return key.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Lower cases a key name and drops its separators, so that e.g. `apiKey`,
+// `api_key` and `API-KEY` are the same
+func normalizeKey(k string) string {
+	return strings.Join(keyWords(k), "")
+}
+
+// Splits a key name into its lower cased words, at separators and at changes
+// of case, e.g. `X-APIKey` into `x`, `api` and `key`
+func keyWords(k string) []string {
+	var words []string
+	var word []rune
+	runes := []rune(k)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(word) > 0 {
+				words, word = append(words, string(word)), nil
+			}
+			continue
+		}
+		if unicode.IsUpper(r) && len(word) > 0 {
+			// a capital following a lower case letter or a digit starts a
+			// word, as does the last capital of an acronym followed by a
+			// lower case letter
+			prev := runes[i-1]
+			next := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next) {
+				words, word = append(words, string(word)), nil
+			}
+		}
+		word = append(word, unicode.ToLower(r))
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// Checks that a number is a card number of a major network, i.e. that its
+// prefix and length are those of an issuer, and that it passes the Luhn check
+func cardNumber(number string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, number)
+	for _, issuer := range cardIssuers {
+		n := len(strconv.Itoa(issuer.high))
+		prefix, _ := strconv.Atoi(digits[:n])
+		if prefix < issuer.low || prefix > issuer.high {
+			continue
+		}
+		for _, length := range issuer.lengths {
+			if len(digits) == length {
+				return luhn(digits)
+			}
+		}
+	}
+	return false
+}
+
+// Checks the digits of a card number with the Luhn algorithm
+func luhn(number string) bool {
+	sum, n := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
@@ -0,0 +1,273 @@
+package eventsum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/util"
+)
+
+// Handles the Sentry store protocol, where the body is a single event
+func (h *httpHandler) sentryStoreHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+	project, ok := h.sentryProjects[ps.ByName("project")]
+	if !ok {
+		h.sendError(w, http.StatusNotFound, errors.New("unknown sentry project"), ps.ByName("project"))
+		return
+	}
+
+	var se SentryEvent
+	if err := json.NewDecoder(r.Body).Decode(&se); err != nil {
+		h.sendError(w, decodeErrorStatus(err), err, "Error decoding sentry event")
+		return
+	}
+	h.recordBodySize(r, project.Service)
+
+	evt, err := sentryToUnaddedEvent(se, project, h.timeFormat)
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Error translating sentry event")
+		return
+	}
+	if err := h.authorizeEvent(r.Context(), &evt); err != nil {
+		h.sendError(w, http.StatusForbidden, err, "Forbidden")
+		return
+	}
+	if err := h.validateEvent(&evt); err != nil {
+		h.sendError(w, validationStatus(err), err, "Invalid event")
+		return
+	}
+
+	if err := h.es.Send(evt); err != nil {
+		h.sendQueueFull(w, err)
+		return
+	}
+	h.sendResp(w, "id", se.EventId)
+}
+
+// Handles the Sentry envelope protocol. Only the event items of the envelope
+// are captured, every other item type (sessions, transactions, ...) is ignored.
+func (h *httpHandler) sentryEnvelopeHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	defer r.Body.Close()
+	project, ok := h.sentryProjects[ps.ByName("project")]
+	if !ok {
+		h.sendError(w, http.StatusNotFound, errors.New("unknown sentry project"), ps.ByName("project"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		h.sendError(w, decodeErrorStatus(err), err, "Error reading sentry envelope")
+		return
+	}
+	h.recordBodySize(r, project.Service)
+
+	envelopeId, payloads, err := parseSentryEnvelope(body)
+	if err != nil {
+		h.sendError(w, http.StatusBadRequest, err, "Error decoding sentry envelope")
+		return
+	}
+
+	// translate every event first so that a bad item rejects the whole envelope
+	evts := make([]UnaddedEvent, 0, len(payloads))
+	for _, payload := range payloads {
+		var se SentryEvent
+		if err := json.Unmarshal(payload, &se); err != nil {
+			h.sendError(w, http.StatusBadRequest, err, "Error decoding sentry event")
+			return
+		}
+		evt, err := sentryToUnaddedEvent(se, project, h.timeFormat)
+		if err != nil {
+			h.sendError(w, http.StatusBadRequest, err, "Error translating sentry event")
+			return
+		}
+		if err := h.authorizeEvent(r.Context(), &evt); err != nil {
+			h.sendError(w, http.StatusForbidden, err, "Forbidden")
+			return
+		}
+		if err := h.validateEvent(&evt); err != nil {
+			h.sendError(w, validationStatus(err), err, "Invalid event")
+			return
+		}
+		evts = append(evts, evt)
+	}
+
+	// all or none, as SDKs send the whole envelope again after a 429
+	if err := h.es.SendAll(evts); err != nil {
+		h.sendQueueFull(w, err)
+		return
+	}
+	h.sendResp(w, "id", envelopeId)
+}
+
+// Splits a Sentry envelope into its event payloads. An envelope is a header
+// line followed by items, each made of a header line and a payload. The payload
+// is either `length` bytes long, or runs until the end of the line.
+func parseSentryEnvelope(body []byte) (string, [][]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(body))
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	var header struct {
+		EventId string `json:"event_id"`
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return "", nil, errors.Wrap(err, "envelope header")
+	}
+
+	var payloads [][]byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err == io.EOF {
+				return header.EventId, payloads, nil
+			} else if err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+
+		var item SentryEnvelopeItemHeader
+		if err := json.Unmarshal(line, &item); err != nil {
+			return "", nil, errors.Wrap(err, "envelope item header")
+		}
+
+		var payload []byte
+		if item.Length > 0 {
+			payload = make([]byte, item.Length)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return "", nil, errors.Wrap(err, "envelope item payload")
+			}
+			// the payload may be followed by a newline
+			if b, err := reader.Peek(1); err == nil && b[0] == '\n' {
+				reader.ReadByte()
+			}
+		} else {
+			payload, err = reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return "", nil, err
+			}
+		}
+
+		if item.Type == "event" {
+			payloads = append(payloads, payload)
+		}
+	}
+}
+
+// Translates a Sentry event into an UnaddedEvent of the service the project
+// is mapped to. The exception type becomes the event name, the platform the
+// event type, and tags and extra become the extra args of the event.
+func sentryToUnaddedEvent(se SentryEvent, project conf.SentryProject, timeFormat string) (UnaddedEvent, error) {
+	evt := UnaddedEvent{
+		Service:               project.Service,
+		Environment:           se.Environment,
+		Type:                  se.Platform,
+		ExtraArgs:             make(map[string]interface{}),
+		Timestamp:             sentryTimestamp(se.Timestamp).Format(timeFormat),
+		ConfigurableFilters:   project.ConfigurableFilters,
+		ConfigurableGroupings: project.ConfigurableGroupings,
+		EventId:               se.EventId, // sentry SDKs retry events with the same id
+	}
+	if evt.Environment == "" {
+		evt.Environment = project.Environment
+	}
+	if evt.Type == "" {
+		evt.Type = "other"
+	}
+
+	var message string
+	var stacktrace *StackTrace
+	if len(se.Exception) > 0 {
+		// the last exception is the one that was raised, the others are its causes
+		exc := se.Exception[len(se.Exception)-1]
+		evt.Name = exc.Type
+		message = exc.Value
+		stacktrace = exc.Stacktrace
+	} else {
+		evt.Name = se.Logger
+		if evt.Name == "" {
+			evt.Name = "message"
+		}
+		message = sentryMessage(se)
+	}
+	if stacktrace == nil {
+		stacktrace = se.Stacktrace
+	}
+	if stacktrace == nil {
+		stacktrace = &StackTrace{Frames: []Frame{}}
+	}
+
+	raw, err := util.ToGenericJSON(stacktrace)
+	if err != nil {
+		return evt, err
+	}
+	evt.Data = EventData{RawMessage: message, Raw: raw}
+
+	for k, v := range se.Extra {
+		evt.ExtraArgs[k] = v
+	}
+	if len(se.Tags) > 0 {
+		tags := make(map[string]interface{})
+		for k, v := range se.Tags {
+			tags[k] = v
+		}
+		evt.ExtraArgs["tags"] = tags
+	}
+
+	return evt, nil
+}
+
+// Returns the message of a Sentry event that did not contain an exception
+func sentryMessage(se SentryEvent) string {
+	if se.LogEntry != nil {
+		if se.LogEntry.Formatted != "" {
+			return se.LogEntry.Formatted
+		}
+		return se.LogEntry.Message
+	}
+	switch m := se.Message.(type) {
+	case string:
+		return m
+	case map[string]interface{}:
+		if formatted, ok := m["formatted"].(string); ok && formatted != "" {
+			return formatted
+		}
+		return fmt.Sprintf("%v", m["message"])
+	}
+	return ""
+}
+
+// Parses a Sentry timestamp, which is either an RFC 3339 string (with or
+// without a zone) or epoch seconds. Falls back to the current time.
+func sentryTimestamp(ts interface{}) time.Time {
+	switch t := ts.(type) {
+	case float64:
+		sec := int64(t)
+		return time.Unix(sec, int64((t-float64(sec))*1e9)).UTC()
+	case string:
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return sentryTimestamp(f)
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+			if parsed, err := time.Parse(layout, strings.TrimSpace(t)); err == nil {
+				return parsed.UTC()
+			}
+		}
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,77 @@
+package eventsum
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+func TestParseSentryEnvelope(t *testing.T) {
+	event := `{"event_id":"9ec79c33ec9942ab8353589fcb2e04dc","platform":"python"}`
+	body := `{"event_id":"9ec79c33ec9942ab8353589fcb2e04dc"}` + "\n" +
+		`{"type":"session"}` + "\n" + `{"started":"2020-02-07T14:16:00Z"}` + "\n" +
+		`{"type":"event","length":` + strconv.Itoa(len(event)) + `}` + "\n" + event + "\n"
+
+	id, payloads, err := parseSentryEnvelope([]byte(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "9ec79c33ec9942ab8353589fcb2e04dc" {
+		t.Errorf("unexpected envelope id %q", id)
+	}
+	if len(payloads) != 1 || string(payloads[0]) != event {
+		t.Errorf("unexpected payloads %q", payloads)
+	}
+}
+
+func TestSentryToUnaddedEvent(t *testing.T) {
+	payload := `{
+		"platform": "python",
+		"timestamp": 1580000000.5,
+		"exception": {"values": [
+			{"type": "KeyError", "value": "'a'"},
+			{"type": "ValueError", "value": "bad value", "stacktrace": {"frames": [
+				{"filename": "app.py", "function": "main", "module": "app", "lineno": 12}
+			]}}
+		]},
+		"tags": [["browser", "chrome"]],
+		"extra": {"user_id": 4}
+	}`
+	var se SentryEvent
+	if err := json.Unmarshal([]byte(payload), &se); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	project := conf.SentryProject{
+		Service:             "wish_be",
+		Environment:         "prod",
+		ConfigurableFilters: map[string][]string{"base": {"exception_python_remove_line_no"}},
+	}
+	evt, err := sentryToUnaddedEvent(se, project, "2006-01-02 15:04:05")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if evt.Service != "wish_be" || evt.Environment != "prod" || evt.Type != "python" || evt.Name != "ValueError" {
+		t.Errorf("unexpected event %+v", evt)
+	}
+	if evt.Timestamp != "2020-01-26 00:53:20" {
+		t.Errorf("unexpected timestamp %q", evt.Timestamp)
+	}
+	if evt.Data.RawMessage != "bad value" {
+		t.Errorf("unexpected message %v", evt.Data.RawMessage)
+	}
+	frames := evt.Data.Raw.(map[string]interface{})["frames"].([]interface{})
+	if len(frames) != 1 || frames[0].(map[string]interface{})["function"] != "main" {
+		t.Errorf("unexpected frames %v", frames)
+	}
+	if evt.ExtraArgs["user_id"] != 4.0 || evt.ExtraArgs["tags"].(map[string]interface{})["browser"] != "chrome" {
+		t.Errorf("unexpected extra args %v", evt.ExtraArgs)
+	}
+	if len(evt.ConfigurableFilters["base"]) != 1 {
+		t.Errorf("project filters were not applied: %v", evt.ConfigurableFilters)
+	}
+}
@@ -2,6 +2,7 @@ package eventsum
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,9 +16,11 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 
 	conf "github.com/ContextLogic/eventsum/config"
 	"github.com/ContextLogic/eventsum/datastore"
+	"github.com/ContextLogic/eventsum/eventsumpb"
 	"github.com/ContextLogic/eventsum/log"
 	"github.com/ContextLogic/eventsum/metrics"
 	. "github.com/ContextLogic/eventsum/models"
@@ -34,6 +37,9 @@ type EventsumServer struct {
 	logger      *log.Logger
 	route       *httprouter.Router
 	httpHandler httpHandler
+	grpcServer  *grpc.Server
+	kafka       *kafkaConsumer
+	syslog      *syslogServer
 	port        string
 	config      conf.EventsumConfig
 	stopped     IsStopped
@@ -89,6 +95,53 @@ func (s *EventsumServer) Start() {
 		}
 	}()
 
+	// run the gRPC capture service on its own port
+	if s.config.GrpcPort > 0 {
+		g := &grpcHandler{h: &s.httpHandler, isStopped: s.isStopped}
+		s.grpcServer = grpc.NewServer(grpc.UnaryInterceptor(g.unaryInterceptor), grpc.StreamInterceptor(g.streamInterceptor))
+		eventsumpb.RegisterEventsumServer(s.grpcServer, g)
+		go func() {
+			addr := ":" + strconv.Itoa(s.config.GrpcPort)
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				s.logger.App().Fatal(err)
+			}
+			s.logger.App().Printf("Listening for gRPC on 0.0.0.0%s", addr)
+			if err := s.grpcServer.Serve(lis); err != nil {
+				s.logger.App().Fatal(err)
+			}
+		}()
+	}
+
+	// receive syslog messages, when a port is configured
+	if s.config.Syslog.UdpPort > 0 || s.config.Syslog.TcpPort > 0 {
+		syslog, err := newSyslogServer(&s.httpHandler, s.config.Syslog, s.isStopped)
+		if err != nil {
+			s.logger.App().Fatal(err)
+		}
+		s.syslog = syslog
+		if s.config.Syslog.UdpPort > 0 {
+			if err := s.syslog.ListenUDP(":" + strconv.Itoa(s.config.Syslog.UdpPort)); err != nil {
+				s.logger.App().Fatal(err)
+			}
+		}
+		if s.config.Syslog.TcpPort > 0 {
+			if err := s.syslog.ListenTCP(":" + strconv.Itoa(s.config.Syslog.TcpPort)); err != nil {
+				s.logger.App().Fatal(err)
+			}
+		}
+	}
+
+	// consume events from kafka, when configured
+	if s.config.Kafka.Enabled() {
+		kafka, err := newKafkaConsumer(s.config, &s.httpHandler, s.logger)
+		if err != nil {
+			s.logger.App().Fatal(err)
+		}
+		s.kafka = kafka
+		s.kafka.Start()
+	}
+
 	s.Stop(httpServer, 5*time.Second)
 }
 
@@ -109,19 +162,67 @@ func (s *EventsumServer) Stop(hs *http.Server, timeout time.Duration) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-
-	// make sure we process events inside the queue
-	s.httpHandler.es.Stop()
 	s.logger.App().Printf("Shutdown with timeout: %s", timeout)
-	s.logger.App().Printf("Processing events still left in the queue")
-	close(s.httpHandler.es.channel.queue)
-	s.httpHandler.es.SummarizeBatchEvents()
 
+	// stop every source of events before closing the queue they are sent to
 	if err := hs.Shutdown(ctx); err != nil {
 		s.logger.App().Errorf("Error: %v", err)
 	} else {
 		s.logger.App().Println("Server stopped")
 	}
+
+	if s.grpcServer != nil {
+		s.stopGrpc(ctx)
+	}
+
+	if s.syslog != nil {
+		s.syslog.Stop()
+	}
+
+	if s.kafka != nil {
+		s.kafka.Stop()
+		s.logger.App().Println("Kafka consumer stopped")
+	}
+
+	// the backfill saves its batches directly, so it ends before the saver
+	s.httpHandler.es.backfill.stop()
+
+	// make sure we process events inside the queue
+	s.httpHandler.es.Stop()
+	s.logger.App().Printf("Processing events still left in the queue")
+	s.httpHandler.es.closeQueue()
+	s.httpHandler.es.SummarizeBatchEvents()
+	if err := s.httpHandler.es.saver.stop(ctx); err != nil {
+		s.logger.App().Errorf("Error: %v, batches still being saved at shutdown", err)
+	}
+	if s.httpHandler.es.aggregator != nil {
+		s.httpHandler.es.aggregator.stop()
+		if err := s.httpHandler.es.flushPeriods(); err != nil {
+			s.logger.App().Errorf("Error: %v, event instance periods lost at shutdown", err)
+		}
+	}
+	if s.httpHandler.es.wal != nil {
+		// batches still being saved are acknowledged after the close
+		s.httpHandler.es.wal.Close()
+	}
+}
+
+// Gracefully stops the gRPC server, or closes every connection if the
+// open streams do not finish before the context is done
+func (s *EventsumServer) stopGrpc(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.logger.App().Println("gRPC server stopped")
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		s.logger.App().Errorf("Error: %v, closed remaining gRPC connections", ctx.Err())
+	}
 }
 
 // User Defined configurable filters
@@ -159,10 +260,10 @@ func newServer(options func(server *EventsumServer)) *EventsumServer {
 		s.httpHandler.sendResp(w, "message", "To visit EventSum UI, please go to https://opsdb.prod.wish.com/eventsum")
 
 	}))
-	s.route.GET("/search", latency("/search", s.httpHandler.searchEventsHandler))
-	s.route.GET("/detail", latency("/detail", s.httpHandler.detailsEventsHandler))
-	s.route.GET("/histogram", latency("/histogram", s.httpHandler.histogramEventsHandler))
-	s.route.GET("/test", latency("/test", s.httpHandler.test))
+	s.route.GET("/search", s.httpHandler.authorizeScoped(capabilityRead, latency("/search", s.httpHandler.searchEventsHandler)))
+	s.route.GET("/detail", s.httpHandler.authorize(capabilityRead, latency("/detail", s.httpHandler.detailsEventsHandler)))
+	s.route.GET("/histogram", s.httpHandler.authorize(capabilityRead, latency("/histogram", s.httpHandler.histogramEventsHandler)))
+	s.route.GET("/test", s.httpHandler.authorize(capabilityRead, latency("/test", s.httpHandler.test)))
 	s.route.GET("/health", latency("/health", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 		if s.isStopped() {
@@ -191,37 +292,59 @@ func newServer(options func(server *EventsumServer)) *EventsumServer {
 		}
 
 	}))
-	s.route.GET("/group", latency("/group", s.httpHandler.searchGroupHandler))
-	s.route.GET("/count", latency("/count", s.httpHandler.countEventsHandler))
-	s.route.GET("/opsdb", latency("/opsdb", s.httpHandler.opsdbEventsHandler))
+	s.route.GET("/group", s.httpHandler.authorize(capabilityRead, latency("/group", s.httpHandler.searchGroupHandler)))
+	s.route.GET("/count", s.httpHandler.authorize(capabilityRead, latency("/count", s.httpHandler.countEventsHandler)))
+	s.route.GET("/opsdb", s.httpHandler.authorizeScoped(capabilityRead, latency("/opsdb", s.httpHandler.opsdbEventsHandler)))
 	s.route.Handler("GET", "/metrics", promhttp.Handler())
 
-	s.route.GET("/types/env", latency("/types/env", s.httpHandler.envTypesHandler))
-	s.route.GET("/types/tier", latency("/types/tier", s.httpHandler.tierTypesHandler))
-	s.route.GET("/types/group", latency("/types/group", s.httpHandler.groupTypesHandler))
-	s.route.GET("/types/region", latency("/types/region", s.httpHandler.regionTypesHandler))
+	s.route.GET("/types/env", s.httpHandler.authorize(capabilityRead, latency("/types/env", s.httpHandler.envTypesHandler)))
+	s.route.GET("/types/tier", s.httpHandler.authorize(capabilityRead, latency("/types/tier", s.httpHandler.tierTypesHandler)))
+	s.route.GET("/types/group", s.httpHandler.authorize(capabilityRead, latency("/types/group", s.httpHandler.groupTypesHandler)))
+	s.route.GET("/types/region", s.httpHandler.authorize(capabilityRead, latency("/types/region", s.httpHandler.regionTypesHandler)))
+
+	s.route.GET("/admin/discarded", s.httpHandler.authorize(capabilityAdmin, latency("/admin/discarded", s.httpHandler.discardedEventsHandler)))
+	s.route.GET("/admin/quotas", s.httpHandler.authorize(capabilityAdmin, latency("/admin/quotas", s.httpHandler.quotasHandler)))
+	s.route.GET("/admin/backfill", s.httpHandler.authorize(capabilityAdmin, latency("/admin/backfill", s.httpHandler.backfillHandler)))
+	s.route.GET("/admin/keys", s.httpHandler.authorize(capabilityAdmin, latency("/admin/keys", s.httpHandler.listAPIKeysHandler)))
+	s.route.GET("/registry/:kind", s.httpHandler.authorize(capabilityRead, latency("/registry", s.httpHandler.listRegistryHandler)))
 
-	s.route.GET("/recent_exceptions", latency("/recent_exceptions", s.httpHandler.recentExceptionHandler))
+	s.route.GET("/recent_exceptions", s.httpHandler.authorize(capabilityRead, latency("/recent_exceptions", s.httpHandler.recentExceptionHandler)))
 
 	// PUT requests
-	s.route.PUT("/group", latency("/group", s.httpHandler.modifyGroupHandler))
+	s.route.PUT("/group", s.httpHandler.authorize(capabilityAdmin, latency("/group", s.httpHandler.modifyGroupHandler)))
+	s.route.PUT("/registry/:kind/:id", s.httpHandler.authorize(capabilityAdmin, latency("/registry", s.httpHandler.renameRegistryHandler)))
 
 	// POST requests
-	s.route.POST("/capture", latency("/capture", s.httpHandler.captureEventsHandler))
-	s.route.POST("/assign_group", latency("/assign_group", s.httpHandler.assignGroupHandler))
-	s.route.POST("/group", latency("/group", s.httpHandler.createGroupHandler))
-	s.route.POST("/db_cpu_alert", latency("/db_cpu_alert", s.httpHandler.cpuAlertHandler))
-	s.route.POST("/server_cpu_alert", latency("/server_cpu_alert", s.httpHandler.diskAlertHandler))
+	s.route.POST("/capture", s.httpHandler.authorize(capabilityIngest, latency("/capture", limitBody(s.config.Limits.BodyBytes, decompress(s.config.MaxDecompressedBytes, s.httpHandler.captureEventsHandler)))))
+	s.route.POST("/capture/batch", s.httpHandler.authorize(capabilityIngest, latency("/capture/batch", limitBody(s.config.Limits.BodyBytes, decompress(s.config.MaxDecompressedBytes, s.httpHandler.captureBatchEventsHandler)))))
+	s.route.POST("/assign_group", s.httpHandler.authorize(capabilityAdmin, latency("/assign_group", s.httpHandler.assignGroupHandler)))
+	s.route.POST("/group", s.httpHandler.authorize(capabilityAdmin, latency("/group", s.httpHandler.createGroupHandler)))
+	s.route.POST("/registry/:kind", s.httpHandler.authorize(capabilityAdmin, latency("/registry", s.httpHandler.createRegistryHandler)))
+	s.route.POST("/admin/backfill", s.httpHandler.authorize(capabilityAdmin, latency("/admin/backfill", s.httpHandler.startBackfillHandler)))
+	s.route.POST("/admin/id_cache/invalidate", s.httpHandler.authorize(capabilityAdmin, latency("/admin/id_cache/invalidate", s.httpHandler.invalidateIDCacheHandler)))
+	s.route.POST("/admin/keys", s.httpHandler.authorize(capabilityAdmin, latency("/admin/keys", s.httpHandler.issueAPIKeyHandler)))
+	s.route.POST("/db_cpu_alert", s.httpHandler.authorize(capabilityAdmin, latency("/db_cpu_alert", s.httpHandler.cpuAlertHandler)))
+	s.route.POST("/server_cpu_alert", s.httpHandler.authorize(capabilityAdmin, latency("/server_cpu_alert", s.httpHandler.diskAlertHandler)))
 
 	// DELETE requests
-	s.route.DELETE("/group", latency("/group", s.httpHandler.deleteGroupHandler))
+	s.route.DELETE("/group", s.httpHandler.authorize(capabilityAdmin, latency("/group", s.httpHandler.deleteGroupHandler)))
+	s.route.DELETE("/registry/:kind/:id", s.httpHandler.authorize(capabilityAdmin, latency("/registry", s.httpHandler.retireRegistryHandler)))
+	s.route.DELETE("/admin/keys/:id", s.httpHandler.authorize(capabilityAdmin, latency("/admin/keys", s.httpHandler.revokeAPIKeyHandler)))
 
 	// Grafana endpoints
-	s.route.GET("/grafana", latency("/grafana", cors(s.httpHandler.grafanaOk)))
-	s.route.GET("/grafana/", latency("/grafana/", cors(s.httpHandler.grafanaOk)))
+	s.route.GET("/grafana", s.httpHandler.authorize(capabilityRead, latency("/grafana", cors(s.httpHandler.grafanaOk))))
+	s.route.GET("/grafana/", s.httpHandler.authorize(capabilityRead, latency("/grafana/", cors(s.httpHandler.grafanaOk))))
 	s.route.OPTIONS("/grafana/:route", latency("/grafana", cors(s.httpHandler.grafanaOk)))
-	s.route.POST("/grafana/query", latency("/grafana/query", cors(s.httpHandler.grafanaTest)))
-	s.route.POST("/grafana/search", latency("/grafana/search", cors(s.httpHandler.grafanaSearch)))
+	s.route.POST("/grafana/query", s.httpHandler.authorize(capabilityRead, latency("/grafana/query", cors(s.httpHandler.grafanaTest))))
+	s.route.POST("/grafana/search", s.httpHandler.authorize(capabilityRead, latency("/grafana/search", cors(s.httpHandler.grafanaSearch))))
+
+	// Sentry compatible endpoints
+	s.route.POST("/api/:project/store/", s.httpHandler.authorize(capabilityIngest, latency("/api/store", limitBody(s.config.Limits.BodyBytes, decompress(s.config.MaxDecompressedBytes, s.httpHandler.sentryStoreHandler)))))
+	s.route.POST("/api/:project/envelope/", s.httpHandler.authorize(capabilityIngest, latency("/api/envelope", limitBody(s.config.Limits.BodyBytes, decompress(s.config.MaxDecompressedBytes, s.httpHandler.sentryEnvelopeHandler)))))
+
+	// OpenTelemetry OTLP/HTTP endpoints
+	s.route.POST("/v1/traces", s.httpHandler.authorize(capabilityIngest, latency("/v1/traces", limitBody(s.config.Limits.BodyBytes, decompress(s.config.MaxDecompressedBytes, s.httpHandler.otlpTracesHandler)))))
+	s.route.POST("/v1/logs", s.httpHandler.authorize(capabilityIngest, latency("/v1/logs", limitBody(s.config.Limits.BodyBytes, decompress(s.config.MaxDecompressedBytes, s.httpHandler.otlpLogsHandler)))))
 
 	return s
 }
@@ -255,7 +378,7 @@ func New(flag conf.Flags) *EventsumServer {
 	// create new http store
 	return newServer(func(s *EventsumServer) {
 		s.logger = logger
-		s.httpHandler = newHTTPHandler(es, logger, config.TimeFormat)
+		s.httpHandler = newHTTPHandler(es, logger, config)
 		s.port = ":" + strconv.Itoa(config.ServerPort)
 		s.config = config
 	})
@@ -0,0 +1,410 @@
+package eventsum
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+// Largest syslog message accepted, over UDP or TCP
+const syslogMaxMessageSize = 64 << 10
+
+// Names of the syslog severities, indexed by their code
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Names of the syslog facilities, indexed by their code
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// syslogMessage is a syslog message parsed from either the RFC 5424 or the
+// legacy RFC 3164 format
+type syslogMessage struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcId    string
+	MsgId     string
+	Message   string
+}
+
+// syslogServer receives syslog messages over UDP and TCP, and captures the ones
+// of the configured severities
+type syslogServer struct {
+	h          *httpHandler
+	config     conf.SyslogConfig
+	severities map[int]bool
+	isStopped  func() bool
+
+	udp   net.PacketConn
+	tcp   net.Listener
+	conns map[net.Conn]bool
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+}
+
+func newSyslogServer(h *httpHandler, config conf.SyslogConfig, isStopped func() bool) (*syslogServer, error) {
+	severities := make(map[int]bool)
+	for _, name := range config.Severities {
+		code := indexOf(syslogSeverities, strings.ToLower(name))
+		if code < 0 {
+			return nil, errors.Errorf("unknown syslog severity %q", name)
+		}
+		severities[code] = true
+	}
+	return &syslogServer{
+		h:          h,
+		config:     config,
+		severities: severities,
+		isStopped:  isStopped,
+		conns:      make(map[net.Conn]bool),
+	}, nil
+}
+
+// Receives one message per datagram
+func (ss *syslogServer) ListenUDP(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ss.udp = udp
+	ss.h.log.App().Printf("Listening for syslog on udp://%s", udp.LocalAddr())
+
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done()
+		buf := make([]byte, syslogMaxMessageSize)
+		for {
+			n, _, err := udp.ReadFrom(buf)
+			if err != nil {
+				if !ss.isStopped() {
+					ss.h.log.App().Errorf("Error reading syslog datagram: %v", err)
+				}
+				return
+			}
+			ss.handle(buf[:n])
+		}
+	}()
+	return nil
+}
+
+// Receives messages framed with either octet counting or a trailing newline
+// (RFC 6587)
+func (ss *syslogServer) ListenTCP(addr string) error {
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ss.tcp = tcp
+	ss.h.log.App().Printf("Listening for syslog on tcp://%s", tcp.Addr())
+
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done()
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				if !ss.isStopped() {
+					ss.h.log.App().Errorf("Error accepting syslog connection: %v", err)
+				}
+				return
+			}
+			ss.mu.Lock()
+			ss.conns[conn] = true
+			ss.mu.Unlock()
+
+			ss.wg.Add(1)
+			go func() {
+				defer ss.wg.Done()
+				ss.serveConn(conn)
+				ss.mu.Lock()
+				delete(ss.conns, conn)
+				ss.mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+	return nil
+}
+
+func (ss *syslogServer) serveConn(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, syslogMaxMessageSize)
+	for {
+		msg, err := readSyslogFrame(reader)
+		if len(msg) > 0 {
+			ss.handle(msg)
+		}
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if !ss.isStopped() {
+				ss.h.log.App().Infof("Closing syslog connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// Stops the listeners, closes the open connections and waits for the messages
+// being handled
+func (ss *syslogServer) Stop() {
+	if ss.udp != nil {
+		ss.udp.Close()
+	}
+	if ss.tcp != nil {
+		ss.tcp.Close()
+	}
+	ss.mu.Lock()
+	for conn := range ss.conns {
+		conn.Close()
+	}
+	ss.mu.Unlock()
+	ss.wg.Wait()
+}
+
+// Captures the message if its severity is one of the configured ones
+func (ss *syslogServer) handle(b []byte) {
+	if ss.isStopped() {
+		return
+	}
+	msg, err := parseSyslog(b, time.Now())
+	if err != nil {
+		ss.h.log.App().Infof("Skipping invalid syslog message: %v", err)
+		return
+	}
+	if !ss.severities[msg.Severity] {
+		return
+	}
+
+	evt := syslogToUnaddedEvent(msg, ss.config, ss.h.timeFormat)
+	if err := ss.h.validateEvent(&evt); err != nil {
+		ss.h.log.App().Infof("Skipping invalid syslog event: %v", err)
+		return
+	}
+	if err := ss.h.es.Send(evt); err != nil {
+		ss.h.log.App().Infof("Dropping syslog event: %v", err)
+	}
+}
+
+// Reads the next message of a TCP stream. Octet counted frames start with the
+// length of the message, other frames end with a newline.
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	b, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] < '0' || b[0] > '9' {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("syslog message too long")
+		}
+		return bytes.TrimRight(line, "\r\n\x00"), err
+	}
+
+	prefix, err := reader.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(prefix))
+	if err != nil || length > syslogMaxMessageSize {
+		return nil, errors.Errorf("invalid syslog frame length %q", prefix)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Parses a syslog message. Messages in the RFC 5424 format have a version
+// right after the priority, all others are parsed as RFC 3164 messages.
+func parseSyslog(b []byte, now time.Time) (syslogMessage, error) {
+	var msg syslogMessage
+	s := strings.TrimRight(string(b), "\r\n\x00")
+
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return msg, errors.New("missing syslog priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return msg, errors.Errorf("invalid syslog priority %q", s[1:end])
+	}
+	msg.Facility, msg.Severity = pri/8, pri%8
+	s = s[end+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		err = parseSyslog5424(&msg, s[2:], now)
+	} else {
+		parseSyslog3164(&msg, s, now)
+	}
+	return msg, err
+}
+
+// Parses the header, structured data and message of an RFC 5424 message
+func parseSyslog5424(msg *syslogMessage, s string, now time.Time) error {
+	fields := strings.SplitN(s, " ", 6)
+	if len(fields) < 6 {
+		return errors.New("incomplete syslog header")
+	}
+	nilValue := func(v string) string {
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+
+	msg.Timestamp = now.UTC()
+	if ts := nilValue(fields[0]); ts != "" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return errors.Wrap(err, "syslog timestamp")
+		}
+		msg.Timestamp = t.UTC()
+	}
+	msg.Hostname = nilValue(fields[1])
+	msg.AppName = nilValue(fields[2])
+	msg.ProcId = nilValue(fields[3])
+	msg.MsgId = nilValue(fields[4])
+
+	rest, err := skipStructuredData(fields[5])
+	if err != nil {
+		return err
+	}
+	msg.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return nil
+}
+
+// Returns what follows the structured data of an RFC 5424 message, which is
+// either `-` or a list of `[id key="value" ...]` elements
+func skipStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, "-") {
+		return s[1:], nil
+	}
+	for strings.HasPrefix(s, "[") {
+		end := structuredDataElementEnd(s)
+		if end < 0 {
+			return "", errors.New("unterminated syslog structured data")
+		}
+		s = s[end+1:]
+	}
+	return s, nil
+}
+
+// Returns the index of the `]` closing the element starting s, or -1. Values
+// are quoted and may contain escaped characters.
+func structuredDataElementEnd(s string) int {
+	inQuotes := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == ']' && !inQuotes:
+			return i
+		}
+	}
+	return -1
+}
+
+// Parses an RFC 3164 message, `Mmm dd hh:mm:ss host tag[pid]: message`. The
+// format is loosely followed, so every part but the message is optional.
+func parseSyslog3164(msg *syslogMessage, s string, now time.Time) {
+	msg.Timestamp = now.UTC()
+	if len(s) >= len(time.Stamp) {
+		if t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], time.Local); err == nil {
+			// the year is not sent, messages dated in the future are from last year
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			msg.Timestamp = t.UTC()
+			s = strings.TrimPrefix(s[len(time.Stamp):], " ")
+
+			if sp := strings.IndexByte(s, ' '); sp > 0 && !strings.ContainsAny(s[:sp], ":[") {
+				msg.Hostname, s = s[:sp], s[sp+1:]
+			}
+		}
+	}
+
+	// the tag is made of alphanumeric characters, and may be followed by a pid
+	tagEnd := strings.IndexAny(s, "[: ")
+	if tagEnd > 0 && (s[tagEnd] == '[' || s[tagEnd] == ':') {
+		msg.AppName, s = s[:tagEnd], s[tagEnd:]
+		if strings.HasPrefix(s, "[") {
+			if end := strings.IndexByte(s, ']'); end > 0 {
+				msg.ProcId, s = s[1:end], s[end+1:]
+			}
+		}
+		s = strings.TrimPrefix(s, ":")
+	}
+	msg.Message = strings.TrimSpace(s)
+}
+
+// Translates a syslog message into an UnaddedEvent. The app-name is mapped to
+// a service, and the message is used as the raw data so repeated lines are
+// aggregated into the same event.
+func syslogToUnaddedEvent(msg syslogMessage, config conf.SyslogConfig, timeFormat string) UnaddedEvent {
+	service := config.Services[msg.AppName]
+	if service == "" {
+		service = msg.AppName
+	}
+	if service == "" {
+		service = "default"
+	}
+	name := msg.MsgId
+	if name == "" {
+		name = msg.AppName
+	}
+	if name == "" {
+		name = "syslog"
+	}
+
+	extraArgs := map[string]interface{}{
+		"facility": syslogFacilities[msg.Facility],
+		"severity": syslogSeverities[msg.Severity],
+	}
+	if msg.Hostname != "" {
+		extraArgs["hostname"] = msg.Hostname
+	}
+	if msg.ProcId != "" {
+		extraArgs["proc_id"] = msg.ProcId
+	}
+
+	return UnaddedEvent{
+		Service:     service,
+		Environment: config.Environment,
+		Name:        name,
+		Type:        "syslog",
+		Data: EventData{
+			RawMessage: msg.Message,
+			Raw:        msg.Message,
+		},
+		ExtraArgs: extraArgs,
+		Timestamp: msg.Timestamp.Format(timeFormat),
+	}
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,150 @@
+package eventsum
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2020, 1, 26, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		in       string
+		expected syslogMessage
+		err      bool
+	}{
+		{
+			in: `<187>1 2020-01-26T00:53:20.003Z web-1 merchant_be 4242 DBError [meta seq="1" note="a \"]\" b"] connection refused`,
+			expected: syslogMessage{
+				Facility: 23, Severity: 3,
+				Timestamp: time.Date(2020, 1, 26, 0, 53, 20, 3e6, time.UTC),
+				Hostname:  "web-1", AppName: "merchant_be", ProcId: "4242", MsgId: "DBError",
+				Message: "connection refused",
+			},
+		},
+		{
+			in: "<11>1 - - - - - -\n",
+			expected: syslogMessage{
+				Facility: 1, Severity: 3, Timestamp: now.UTC(),
+			},
+		},
+		{
+			in: "<34>Jan  5 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8",
+			expected: syslogMessage{
+				Facility: 4, Severity: 2,
+				Timestamp: time.Date(2020, 1, 5, 22, 14, 15, 0, time.Local).UTC(),
+				Hostname:  "mymachine", AppName: "su", ProcId: "123",
+				Message: "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			// dated in the future, so sent last year
+			in: "<13>Dec 31 23:59:59 host cron: job failed",
+			expected: syslogMessage{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2019, 12, 31, 23, 59, 59, 0, time.Local).UTC(),
+				Hostname:  "host", AppName: "cron",
+				Message: "job failed",
+			},
+		},
+		{
+			in: "<3>kernel: out of memory",
+			expected: syslogMessage{
+				Severity: 3, Timestamp: now.UTC(), AppName: "kernel", Message: "out of memory",
+			},
+		},
+		{in: "no priority", err: true},
+		{in: "<200>1 - - - - - -", err: true},
+		{in: `<11>1 - - - - - [meta unterminated`, err: true},
+	}
+
+	for _, test := range tests {
+		msg, err := parseSyslog([]byte(test.in), now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.in, err)
+		} else if msg != test.expected {
+			t.Errorf("%q:\nexpected %+v\ngot      %+v", test.in, test.expected, msg)
+		}
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	es := newTestEventStore(10)
+	h := newHTTPHandler(es, newTestLogger(t), conf.DefaultConfig())
+	config := conf.DefaultConfig().Syslog
+	config.Services = map[string]string{"pgbouncer": "merchant_be"}
+
+	ss, err := newSyslogServer(&h, config, func() bool { return false })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ss.ListenUDP("127.0.0.1:0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ss.ListenTCP("127.0.0.1:0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ss.Stop()
+
+	udp, err := net.Dial("udp", ss.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer udp.Close()
+	fmt.Fprint(udp, "<11>1 2020-01-26T00:53:20Z db-1 pgbouncer - - - pooler error")
+	fmt.Fprint(udp, "<14>1 2020-01-26T00:53:20Z db-1 pgbouncer - - - stats: 0 xacts/s")
+
+	tcp, err := net.Dial("tcp", ss.tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg := "<10>Jan 26 00:53:20 web-2 crond[7]: cannot fork"
+	fmt.Fprintf(tcp, "%d %s", len(msg), msg)
+	fmt.Fprint(tcp, "<30>Jan 26 00:53:20 web-2 crond[7]: started\n")
+	fmt.Fprint(tcp, "<8>Jan 26 00:53:20 web-2 crond[7]: out of memory\n")
+	tcp.Close()
+
+	received := make(map[string]UnaddedEvent)
+	for len(received) < 3 {
+		select {
+		case evt := <-es.channel.queue:
+			received[evt.Data.Message] = evt
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for syslog events, got %v", received)
+		}
+	}
+
+	evt, ok := received["pooler error"]
+	if !ok {
+		t.Fatalf("missing udp event, got %v", received)
+	}
+	if evt.Service != "merchant_be" || evt.Name != "pgbouncer" || evt.Type != "syslog" || evt.Environment != "default" {
+		t.Errorf("unexpected event: %+v", evt)
+	}
+	if evt.ExtraArgs["hostname"] != "db-1" || evt.ExtraArgs["facility"] != "user" || evt.ExtraArgs["severity"] != "err" {
+		t.Errorf("unexpected extra args: %v", evt.ExtraArgs)
+	}
+	if evt.Timestamp != "2020-01-26 00:53:20" {
+		t.Errorf("unexpected timestamp: %v", evt.Timestamp)
+	}
+
+	for _, message := range []string{"cannot fork", "out of memory"} {
+		evt, ok := received[message]
+		if !ok {
+			t.Fatalf("missing tcp event %q, got %v", message, received)
+		}
+		if evt.Service != "crond" || evt.ExtraArgs["hostname"] != "web-2" || evt.ExtraArgs["proc_id"] != "7" {
+			t.Errorf("unexpected event: %+v", evt)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Package tail implements an agent following NDJSON files of events, and
+// forwarding them to a remote eventsum server. It lets processes that cannot
+// make HTTP calls, like batch jobs, report their events by writing to a file.
+package tail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/retryafter"
+)
+
+type Config struct {
+	Files         []string      // NDJSON files to follow
+	StateFile     string        // file the read positions are saved to
+	Endpoint      string        // base url of the eventsum server
+	APIKey        string        // key with the ingest capability, if the server requires one
+	BatchSize     int           // events forwarded per request
+	FlushInterval time.Duration // longest time an event waits for its batch to fill
+	PollInterval  time.Duration // time between two reads of the files
+	MinBackoff    time.Duration // backoff after the first failed request
+	MaxBackoff    time.Duration
+}
+
+// Header the server reads the API key from
+const apiKeyHeader = "X-Eventsum-Key"
+
+func DefaultConfig() Config {
+	return Config{
+		StateFile:     "eventsum-tail.state",
+		BatchSize:     100,
+		FlushInterval: 5 * time.Second,
+		PollInterval:  time.Second,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+	}
+}
+
+// Agent follows the files, and forwards the events they contain in batches.
+// The position of a line is only saved once its batch has been accepted by the
+// server, so events are forwarded again if the agent stops before that.
+type Agent struct {
+	config    Config
+	client    *http.Client
+	log       *log.Logger
+	followers []*follower
+	state     map[string]position
+	pending   []line
+	firstSeen time.Time // when the oldest pending line was read
+}
+
+func NewAgent(config Config, logger *log.Logger) (*Agent, error) {
+	if len(config.Files) == 0 {
+		return nil, errors.New("no file to follow")
+	}
+	if config.Endpoint == "" {
+		return nil, errors.New("missing eventsum endpoint")
+	}
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+
+	state, err := loadState(config.StateFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading tail state")
+	}
+	a := &Agent{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		log:    logger,
+		state:  state,
+	}
+	for _, path := range config.Files {
+		a.followers = append(a.followers, newFollower(path))
+	}
+	return a, nil
+}
+
+// Follows the files until the context is done. Lines still pending when the
+// context is done are read again on the next run.
+func (a *Agent) Run(ctx context.Context) error {
+	defer func() {
+		for _, f := range a.followers {
+			f.close()
+		}
+	}()
+
+	ticker := time.NewTicker(a.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.poll(ctx); err != nil {
+			return err
+		}
+		if len(a.pending) > 0 && time.Since(a.firstSeen) >= a.config.FlushInterval {
+			if err := a.flush(ctx); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Reads every file, forwarding the batches that fill up
+func (a *Agent) poll(ctx context.Context) error {
+	for _, f := range a.followers {
+		var err error
+		pollErr := f.poll(a.state[f.path], func(l line) {
+			if err != nil {
+				return
+			}
+			if len(a.pending) == 0 {
+				a.firstSeen = time.Now()
+			}
+			a.pending = append(a.pending, l)
+			if len(a.pending) >= a.config.BatchSize {
+				err = a.flush(ctx)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if pollErr != nil {
+			a.log.Errorf("Error reading %s: %v", f.path, pollErr)
+		}
+	}
+	return nil
+}
+
+// Forwards the pending events, then saves the position of the pending lines.
+// Returns an error only if the state could not be saved.
+func (a *Agent) flush(ctx context.Context) error {
+	var events [][]byte
+	for _, l := range a.pending {
+		data := bytes.TrimSpace(l.data)
+		if len(data) == 0 {
+			continue
+		}
+		var evt models.UnaddedEvent
+		if err := json.Unmarshal(data, &evt); err != nil {
+			a.log.Infof("Skipping invalid event in %s: %v", l.path, err)
+			continue
+		}
+		events = append(events, data)
+	}
+
+	if len(events) > 0 && !a.forward(ctx, events) {
+		// the context is done, the lines will be read again on the next run
+		return nil
+	}
+
+	for _, l := range a.pending {
+		a.state[l.path] = position{Inode: l.inode, Offset: l.end}
+	}
+	a.pending = nil
+	return errors.Wrap(saveState(a.config.StateFile, a.state), "saving tail state")
+}
+
+// Sends the batch to the capture endpoint, retrying with a backoff until it
+// is accepted, rejected or the context is done. Returns false in the last case.
+// The events the server had no room for are sent again, after the delay it
+// asked for.
+func (a *Agent) forward(ctx context.Context, events [][]byte) bool {
+	url := strings.TrimRight(a.config.Endpoint, "/") + "/capture/batch"
+	backoff := a.config.MinBackoff
+	for {
+		var body bytes.Buffer
+		for _, data := range events {
+			body.Write(data)
+			body.WriteByte('\n')
+		}
+		retry, requeued, err := a.post(ctx, url, body.Bytes())
+		if err == nil {
+			return true
+		}
+		if !retry {
+			a.log.Errorf("Dropping batch of %d events: %v", len(events), err)
+			return true
+		}
+		if len(requeued) > 0 {
+			var left [][]byte
+			for _, i := range requeued {
+				if i >= 0 && i < len(events) {
+					left = append(left, events[i])
+				}
+			}
+			events = left
+		}
+		wait := backoff
+		if delay := retryafter.Delay(err); delay > wait {
+			wait = delay
+		}
+		a.log.Errorf("Error forwarding batch of %d events, retrying in %v: %v", len(events), wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+		if backoff *= 2; backoff > a.config.MaxBackoff {
+			backoff = a.config.MaxBackoff
+		}
+	}
+}
+
+// Posts the batch, and tells whether a failed request should be retried.
+// Events rejected individually by the server are logged, but for the events it
+// had no room for, whose indices are returned along with an error to retry
+// after.
+func (a *Agent) post(ctx context.Context, url string, body []byte) (bool, []int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if a.config.APIKey != "" {
+		req.Header.Set(apiKeyHeader, a.config.APIKey)
+	}
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err := fmt.Errorf("server responded %s: %s", resp.Status, respBody)
+		return true, nil, retryafter.New(err, resp.Header.Get("Retry-After"))
+	case resp.StatusCode >= 500:
+		return true, nil, fmt.Errorf("server responded %s: %s", resp.Status, respBody)
+	case resp.StatusCode >= 300:
+		return false, nil, fmt.Errorf("server responded %s: %s", resp.Status, respBody)
+	}
+
+	var captured struct {
+		Results []models.CaptureResult `json:"results"`
+	}
+	var requeued []int
+	if err := json.Unmarshal(respBody, &captured); err == nil {
+		for _, result := range captured.Results {
+			if result.Retry {
+				requeued = append(requeued, result.Index)
+			} else if !result.Accepted {
+				a.log.Infof("Event %d of the batch was rejected: %s", result.Index, result.Error)
+			}
+		}
+	}
+	if len(requeued) > 0 {
+		err := fmt.Errorf("server is overloaded, %d events to send again", len(requeued))
+		return true, requeued, retryafter.New(err, resp.Header.Get("Retry-After"))
+	}
+	return false, nil, nil
+}
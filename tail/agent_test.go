@@ -0,0 +1,200 @@
+package tail
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// captureServer records the names of the events it receives. The first
+// request fails, so that the agent has to retry it.
+type captureServer struct {
+	sync.Mutex
+	names    []string
+	keys     []string
+	requests int
+}
+
+func (s *captureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	s.keys = append(s.keys, r.Header.Get(apiKeyHeader))
+	if s.requests == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var evt models.UnaddedEvent
+		json.Unmarshal(scanner.Bytes(), &evt)
+		s.names = append(s.names, evt.Name)
+	}
+	w.Write([]byte(`{"results": []}`))
+}
+
+func (s *captureServer) waitFor(t *testing.T, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.Lock()
+		names := append([]string{}, s.names...)
+		s.Unlock()
+		if len(names) >= count {
+			return names
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d events", count)
+	return nil
+}
+
+func writeEvents(t *testing.T, path string, flag int, names ...string) {
+	f, err := os.OpenFile(path, flag|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	for _, name := range names {
+		fmt.Fprintf(f, `{"service_name":"batch_job","event_name":%q,"event_type":"python","timestamp":"2020-01-26 00:53:20"}`+"\n", name)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+	statePath := filepath.Join(dir, "state")
+
+	server := &captureServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	config := DefaultConfig()
+	config.Files = []string{path}
+	config.StateFile = statePath
+	config.Endpoint = ts.URL
+	config.APIKey = "esk_test"
+	config.BatchSize = 2
+	config.FlushInterval = 20 * time.Millisecond
+	config.PollInterval = 10 * time.Millisecond
+	config.MinBackoff = 10 * time.Millisecond
+
+	run := func() (context.CancelFunc, chan error) {
+		agent, err := NewAgent(config, log.New())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- agent.Run(ctx) }()
+		return cancel, done
+	}
+
+	writeEvents(t, path, os.O_CREATE|os.O_TRUNC, "a", "b", "c")
+	cancel, done := run()
+	server.waitFor(t, 3)
+
+	// a partially written line is only forwarded once complete
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`not json` + "\n" + `{"event_name":`)
+	time.Sleep(50 * time.Millisecond)
+	f.WriteString(`"d"}` + "\n")
+	f.Close()
+	server.waitFor(t, 4)
+
+	// rotation: the old file is renamed, and a new one created at the path
+	os.Rename(path, path+".1")
+	writeEvents(t, path+".1", os.O_APPEND, "e")
+	writeEvents(t, path, os.O_CREATE|os.O_TRUNC, "f")
+	server.waitFor(t, 6)
+
+	// truncation: the file is read again from its start
+	os.Truncate(path, 0)
+	time.Sleep(50 * time.Millisecond)
+	writeEvents(t, path, os.O_APPEND, "g")
+	server.waitFor(t, 7)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a new run resumes where the previous one stopped
+	writeEvents(t, path, os.O_APPEND, "h")
+	cancel, done = run()
+	names := server.waitFor(t, 8)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	server.Lock()
+	defer server.Unlock()
+	expected := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	if fmt.Sprint(server.names) != fmt.Sprint(expected) {
+		t.Errorf("expected events %v, got %v", expected, names)
+	}
+	if server.requests < 2 {
+		t.Errorf("expected the failed request to be retried")
+	}
+	if server.keys[0] != "esk_test" {
+		t.Errorf("expected the API key to be sent, got %q", server.keys[0])
+	}
+
+	state, err := loadState(statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fi, _ := os.Stat(path)
+	if state[path].Offset != fi.Size() {
+		t.Errorf("expected offset %d to be saved, got %d", fi.Size(), state[path].Offset)
+	}
+}
+
+func TestForwardRetriesEventsWithoutRoom(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			// the server has no room for the second event
+			w.Header().Set("Retry-After", "0")
+			w.Write([]byte(`{"results": [{"index": 0, "accepted": true}, {"index": 1, "accepted": false, "error": "ingest buffer is full", "retry": true}]}`))
+			return
+		}
+		w.Write([]byte(`{"results": [{"index": 0, "accepted": true}]}`))
+	}))
+	defer ts.Close()
+
+	config := DefaultConfig()
+	config.Endpoint = ts.URL
+	config.MinBackoff = time.Millisecond
+	a := &Agent{config: config, client: http.DefaultClient, log: log.New()}
+	if !a.forward(context.Background(), [][]byte{[]byte(`{"event_name":"a"}`), []byte(`{"event_name":"b"}`)}) {
+		t.Fatal("expected the batch to be forwarded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 || bodies[1] != `{"event_name":"b"}`+"\n" {
+		t.Errorf("expected the rejected event to be sent again alone, got %q", bodies)
+	}
+}
@@ -0,0 +1,160 @@
+package tail
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Lines longer than this are skipped
+const maxLineBytes = 1 << 20
+
+// follower reads the lines appended to a file, and keeps following the path
+// when the file is rotated (a new inode appears at the path) or truncated.
+type follower struct {
+	path    string
+	file    *os.File
+	inode   uint64
+	offset  int64  // offset of the next byte to read
+	partial []byte // start of a line whose end was not written yet
+	skip    bool   // whether the line being read is too long, and skipped
+}
+
+// line is a complete line of a file, and the position right after it
+type line struct {
+	path  string
+	data  []byte
+	inode uint64
+	end   int64
+}
+
+func newFollower(path string) *follower {
+	return &follower{path: path}
+}
+
+// Reads the lines appended since the last poll. A rotated file is read until
+// its end before following the new file from its start.
+func (f *follower) poll(pos position, emit func(line)) error {
+	if f.file == nil {
+		// the file may not exist yet
+		if err := f.open(pos); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if err := f.read(emit); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		// rotated away, and the new file is not created yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if inode(fi) != f.inode {
+		if len(f.partial) > 0 && !f.skip {
+			// the writer moved on, the last line will never be completed
+			emit(line{path: f.path, data: f.partial, inode: f.inode, end: f.offset})
+		}
+		f.close()
+		if err := f.open(position{}); err != nil {
+			return err
+		}
+		return f.read(emit)
+	}
+
+	if fi.Size() < f.offset {
+		// truncated, what is left of the file was written after the truncation
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		f.offset, f.partial, f.skip = 0, nil, false
+		return f.read(emit)
+	}
+	return nil
+}
+
+// Opens the file at path, resuming at the saved position if it is still the
+// same file and it was not truncated since
+func (f *follower) open(pos position) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.inode = file, inode(fi)
+	f.offset, f.partial, f.skip = 0, nil, false
+	if pos.Inode == f.inode && pos.Offset <= fi.Size() {
+		if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+			f.close()
+			return err
+		}
+		f.offset = pos.Offset
+	}
+	return nil
+}
+
+// Reads the file until its end, emitting every complete line
+func (f *follower) read(emit func(line)) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := f.file.Read(buf)
+		f.split(buf[:n], emit)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *follower) split(b []byte, emit func(line)) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			f.offset += int64(len(b))
+			if !f.skip {
+				f.partial = append(f.partial, b...)
+			}
+			if len(f.partial) > maxLineBytes {
+				f.partial, f.skip = nil, true
+			}
+			return
+		}
+
+		f.offset += int64(i + 1)
+		if !f.skip {
+			data := append(append([]byte{}, f.partial...), b[:i]...)
+			emit(line{path: f.path, data: data, inode: f.inode, end: f.offset})
+		}
+		f.partial, f.skip = nil, false
+		b = b[i+1:]
+	}
+}
+
+func (f *follower) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+// Returns the inode of the file. The agent only runs on unix systems.
+func inode(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
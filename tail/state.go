@@ -0,0 +1,56 @@
+package tail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// position is where the agent stopped reading a file. The inode tells whether
+// the file was rotated since the position was saved.
+type position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Reads the positions saved in the state file, keyed by file path. A missing
+// state file means nothing was read yet.
+func loadState(path string) (map[string]position, error) {
+	state := make(map[string]position)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &state)
+	return state, err
+}
+
+// Saves the positions to the state file. The file is replaced atomically so a
+// crash never leaves a partially written state.
+func saveState(path string, state map[string]position) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,221 @@
+// Package truncate bounds the size of events before they are saved.
+//
+// Stack traces keep their top and bottom frames, frames keep their first
+// variables by name, long strings are cut and values nested too deep are
+// replaced. Truncation only depends on the event and the limits, so that the
+// same event is always truncated, and so hashed, the same way. Every cut
+// leaves a marker in the event, e.g. the number of frames dropped, and
+// truncating an event again leaves it as is.
+package truncate
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/models"
+)
+
+// Limits reported by Truncate, e.g. for metrics
+const (
+	LimitFrames       = "frames"
+	LimitFrameVars    = "frame_vars"
+	LimitStringLength = "string_length"
+	LimitDepth        = "depth"
+)
+
+const (
+	framesKey          = "frames"
+	varsKey            = "vars"
+	truncatedFramesKey = "_truncated_frames" // number of frames dropped, next to the frames
+	truncatedVarsKey   = "_truncated_vars"   // number of variables dropped, among the variables
+
+	// Replaces the values nested deeper than the depth limit
+	DepthMarker = "[truncated: too deep]"
+)
+
+// Follows the strings cut to the string length limit
+var stringMarker = regexp.MustCompile(`\.\.\.\[truncated \d+ bytes\]$`)
+
+// Truncator cuts events down to its limits
+type Truncator struct {
+	limits conf.LimitsConfig
+}
+
+// Builds the truncator of the limits of the config. Returns nil if no event
+// limit is set.
+func New(limits conf.LimitsConfig) *Truncator {
+	if limits.Frames == 0 && limits.FrameVars == 0 && limits.StringLength == 0 && limits.Depth == 0 {
+		return nil
+	}
+	return &Truncator{limits: limits}
+}
+
+// Truncates the raw data, message and extra args of an event. Returns the
+// sorted limits that were hit.
+func (t *Truncator) Truncate(evt *models.UnaddedEvent) []string {
+	hit := make(map[string]bool)
+	evt.Data.Raw = t.value(evt.Data.Raw, 1, hit)
+	evt.Data.RawMessage = t.value(evt.Data.RawMessage, 1, hit)
+	evt.Data.Message = t.string(evt.Data.Message, hit)
+	if evt.ExtraArgs != nil {
+		evt.ExtraArgs = t.object(evt.ExtraArgs, 1, hit)
+	}
+
+	limits := make([]string, 0, len(hit))
+	for limit := range hit {
+		limits = append(limits, limit)
+	}
+	sort.Strings(limits)
+	return limits
+}
+
+// Returns a truncated copy of a value decoded from JSON, or of a stack trace,
+// found at the given depth
+func (t *Truncator) value(v interface{}, depth int, hit map[string]bool) interface{} {
+	switch v := v.(type) {
+	case string:
+		return t.string(v, hit)
+	case map[string]interface{}:
+		if t.tooDeep(depth, hit) {
+			return DepthMarker
+		}
+		return t.object(v, depth, hit)
+	case []interface{}:
+		if t.tooDeep(depth, hit) {
+			return DepthMarker
+		}
+		values := make([]interface{}, len(v))
+		for i, value := range v {
+			values[i] = t.value(value, depth+1, hit)
+		}
+		return values
+	case models.StackTrace:
+		return t.stackTrace(v, hit)
+	case *models.StackTrace:
+		if v == nil {
+			return v
+		}
+		stacktrace := t.stackTrace(*v, hit)
+		return &stacktrace
+	}
+	return v
+}
+
+func (t *Truncator) tooDeep(depth int, hit map[string]bool) bool {
+	if t.limits.Depth > 0 && depth > t.limits.Depth {
+		hit[LimitDepth] = true
+		return true
+	}
+	return false
+}
+
+func (t *Truncator) object(m map[string]interface{}, depth int, hit map[string]bool) map[string]interface{} {
+	object := make(map[string]interface{}, len(m))
+	truncatedFrames := 0
+	for k, value := range m {
+		switch v := value.(type) {
+		case []interface{}:
+			if k == framesKey {
+				value, truncatedFrames = t.frames(v, hit)
+			}
+		case map[string]interface{}:
+			if k == varsKey {
+				value = t.vars(v, hit)
+			}
+		}
+		object[k] = t.value(value, depth+1, hit)
+	}
+	if truncatedFrames > 0 {
+		object[truncatedFramesKey] = truncatedFrames + count(m[truncatedFramesKey])
+	}
+	return object
+}
+
+// Returns the number of a marker left by a previous truncation, 0 if none
+func count(marker interface{}) int {
+	switch n := marker.(type) {
+	case int:
+		return n
+	case float64:
+		// decoded from JSON
+		return int(n)
+	}
+	return 0
+}
+
+// Keeps the top and bottom frames of a list. Returns the frames kept and the
+// number of frames dropped.
+func (t *Truncator) frames(frames []interface{}, hit map[string]bool) ([]interface{}, int) {
+	n := t.limits.Frames
+	if n == 0 || len(frames) <= 2*n {
+		return frames, 0
+	}
+	hit[LimitFrames] = true
+	kept := make([]interface{}, 0, 2*n)
+	kept = append(kept, frames[:n]...)
+	kept = append(kept, frames[len(frames)-n:]...)
+	return kept, len(frames) - 2*n
+}
+
+// Keeps the first variables of a frame by name
+func (t *Truncator) vars(vars map[string]interface{}, hit map[string]bool) map[string]interface{} {
+	n := t.limits.FrameVars
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if name != truncatedVarsKey {
+			names = append(names, name)
+		}
+	}
+	if n == 0 || len(names) <= n {
+		return vars
+	}
+	hit[LimitFrameVars] = true
+	sort.Strings(names)
+	kept := make(map[string]interface{}, n+1)
+	for _, name := range names[:n] {
+		kept[name] = vars[name]
+	}
+	kept[truncatedVarsKey] = len(names) - n + count(vars[truncatedVarsKey])
+	return kept
+}
+
+func (t *Truncator) stackTrace(stacktrace models.StackTrace, hit map[string]bool) models.StackTrace {
+	frames := stacktrace.Frames
+	truncated := stacktrace.TruncatedFrames
+	if n := t.limits.Frames; n > 0 && len(frames) > 2*n {
+		hit[LimitFrames] = true
+		truncated += len(frames) - 2*n
+		frames = append(frames[:n:n], frames[len(frames)-n:]...)
+	}
+
+	copied := make([]models.Frame, len(frames))
+	for i, frame := range frames {
+		frame.ContextLine = t.string(frame.ContextLine, hit)
+		if frame.Vars != nil {
+			// as deep as the variables of a decoded stack trace
+			frame.Vars = t.object(t.vars(frame.Vars, hit), 4, hit)
+		}
+		copied[i] = frame
+	}
+	return models.StackTrace{Frames: copied, TruncatedFrames: truncated}
+}
+
+// Cuts a string to the string length limit, on a rune boundary
+func (t *Truncator) string(str string, hit map[string]bool) string {
+	n := t.limits.StringLength
+	if n == 0 || len(str) <= n {
+		return str
+	}
+	if loc := stringMarker.FindStringIndex(str); loc != nil && loc[0] <= n {
+		// already cut
+		return str
+	}
+	hit[LimitStringLength] = true
+	for n > 0 && !utf8.RuneStart(str[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s...[truncated %d bytes]", str[:n], len(str)-n)
+}
@@ -0,0 +1,157 @@
+package truncate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/models"
+)
+
+func testLimits() conf.LimitsConfig {
+	return conf.LimitsConfig{Frames: 2, FrameVars: 2, StringLength: 8, Depth: 5}
+}
+
+func TestNewDisabled(t *testing.T) {
+	if New(conf.LimitsConfig{BodyBytes: 10}) != nil {
+		t.Errorf("expected no truncator without event limits")
+	}
+}
+
+func TestTruncateStrings(t *testing.T) {
+	tr := New(testLimits())
+	tests := []struct {
+		in     string
+		out    string
+		limits []string
+	}{
+		{"short", "short", []string{}},
+		{"exactly8", "exactly8", []string{}},
+		{"a long message", "a long m...[truncated 6 bytes]", []string{LimitStringLength}},
+		{"héhéhéhé", "héhéh...[truncated 5 bytes]", []string{LimitStringLength}},
+	}
+	for _, test := range tests {
+		evt := models.UnaddedEvent{Data: models.EventData{Message: test.in}}
+		limits := tr.Truncate(&evt)
+		if evt.Data.Message != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, evt.Data.Message)
+		}
+		if !reflect.DeepEqual(limits, test.limits) {
+			t.Errorf("%q: expected limits %v, got %v", test.in, test.limits, limits)
+		}
+	}
+}
+
+func TestTruncateFrames(t *testing.T) {
+	tr := New(testLimits())
+	frames := make([]interface{}, 5)
+	for i := range frames {
+		frames[i] = map[string]interface{}{
+			"function": string('a' + rune(i)),
+			"vars":     map[string]interface{}{"c": "3", "a": "1", "b": "2"},
+		}
+	}
+	raw := map[string]interface{}{"frames": frames}
+	evt := models.UnaddedEvent{Data: models.EventData{Raw: raw}}
+
+	limits := tr.Truncate(&evt)
+	if expected := []string{LimitFrameVars, LimitFrames}; !reflect.DeepEqual(limits, expected) {
+		t.Errorf("expected limits %v, got %v", expected, limits)
+	}
+	truncated := evt.Data.Raw.(map[string]interface{})
+	if truncated[truncatedFramesKey] != 1 {
+		t.Errorf("expected 1 truncated frame, got %v", truncated[truncatedFramesKey])
+	}
+	kept := truncated["frames"].([]interface{})
+	functions := []string{}
+	for _, frame := range kept {
+		functions = append(functions, frame.(map[string]interface{})["function"].(string))
+	}
+	if expected := []string{"a", "b", "d", "e"}; !reflect.DeepEqual(functions, expected) {
+		t.Errorf("expected the top and bottom frames %v, got %v", expected, functions)
+	}
+	vars := kept[0].(map[string]interface{})["vars"]
+	if expected := map[string]interface{}{"a": "1", "b": "2", truncatedVarsKey: 1}; !reflect.DeepEqual(vars, expected) {
+		t.Errorf("expected vars %v, got %v", expected, vars)
+	}
+
+	// the original event is left as is
+	if len(raw["frames"].([]interface{})) != 5 {
+		t.Errorf("expected the original frames to be kept")
+	}
+}
+
+func TestTruncateStackTrace(t *testing.T) {
+	tr := New(testLimits())
+	stacktrace := models.StackTrace{}
+	for _, function := range []string{"a", "b", "c", "d", "e", "f"} {
+		stacktrace.Frames = append(stacktrace.Frames, models.Frame{
+			Function:    function,
+			ContextLine: "raise KeyError(key)",
+			Vars:        map[string]interface{}{"x": "1"},
+		})
+	}
+	evt := models.UnaddedEvent{Data: models.EventData{Raw: &stacktrace}}
+	tr.Truncate(&evt)
+
+	truncated := evt.Data.Raw.(*models.StackTrace)
+	if len(truncated.Frames) != 4 || truncated.TruncatedFrames != 2 {
+		t.Fatalf("expected 4 frames and 2 truncated, got %d and %d", len(truncated.Frames), truncated.TruncatedFrames)
+	}
+	if truncated.Frames[2].Function != "e" || !strings.HasSuffix(truncated.Frames[2].ContextLine, "[truncated 11 bytes]") {
+		t.Errorf("unexpected frame %+v", truncated.Frames[2])
+	}
+	if len(stacktrace.Frames) != 6 || stacktrace.Frames[2].Function != "c" {
+		t.Errorf("expected the original stack trace to be kept")
+	}
+}
+
+func TestTruncateDepth(t *testing.T) {
+	tr := New(testLimits())
+	nested := map[string]interface{}{"leaf": "x"}
+	for i := 0; i < 6; i++ {
+		nested = map[string]interface{}{"next": nested}
+	}
+	evt := models.UnaddedEvent{ExtraArgs: nested}
+	limits := tr.Truncate(&evt)
+	if !reflect.DeepEqual(limits, []string{LimitDepth}) {
+		t.Errorf("expected the depth limit, got %v", limits)
+	}
+
+	v := interface{}(evt.ExtraArgs)
+	for depth := 1; depth <= 5; depth++ {
+		v = v.(map[string]interface{})["next"]
+	}
+	if v != DepthMarker {
+		t.Errorf("expected the marker at depth 6, got %v", v)
+	}
+
+	// the same event is always truncated the same way
+	again := models.UnaddedEvent{ExtraArgs: nested}
+	tr.Truncate(&again)
+	if !reflect.DeepEqual(evt.ExtraArgs, again.ExtraArgs) {
+		t.Errorf("expected truncation to be deterministic")
+	}
+}
+
+func TestTruncateAgain(t *testing.T) {
+	tr := New(testLimits())
+	frames := make([]interface{}, 5)
+	for i := range frames {
+		frames[i] = map[string]interface{}{
+			"function": strings.Repeat(string('a'+rune(i)), 10),
+			"vars":     map[string]interface{}{"c": "3", "a": "1", "b": "2"},
+		}
+	}
+	evt := models.UnaddedEvent{Data: models.EventData{Raw: map[string]interface{}{"frames": frames}}}
+	tr.Truncate(&evt)
+	truncated := evt.Data.Raw
+
+	if limits := tr.Truncate(&evt); len(limits) != 0 {
+		t.Errorf("expected a truncated event to hit no limit, got %v", limits)
+	}
+	if !reflect.DeepEqual(evt.Data.Raw, truncated) {
+		t.Errorf("expected a truncated event to be left as is, got %v", evt.Data.Raw)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"runtime/pprof"
 	"time"
@@ -202,11 +203,56 @@ func EpochToTime2(epoch string) (string, error) {
 	return tm.UTC().Format("2006-01-02 15:04:05"), nil
 }
 
+// Epoch times above this are in milliseconds, as in seconds they would be
+// after the year 5000
+const maxEpochSeconds = 1e11
+
+// Parses the timestamp of an event, in UTC. Accepts the legacy format, which
+// has no zone and is read as UTC, RFC 3339 with an offset, and epoch seconds
+// or milliseconds, with an optional fraction.
+func ParseTimestamp(timestamp string, legacyFormat string) (time.Time, error) {
+	timestamp = strings.TrimSpace(timestamp)
+	if t, err := time.Parse(legacyFormat, timestamp); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return t.UTC(), nil
+	}
+	if epoch, err := strconv.ParseInt(timestamp, 10, 64); err == nil && epoch >= 0 {
+		if epoch >= maxEpochSeconds {
+			return time.Unix(0, epoch*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(epoch, 0).UTC(), nil
+	}
+	if epoch, err := strconv.ParseFloat(timestamp, 64); err == nil && epoch >= 0 {
+		if epoch >= maxEpochSeconds {
+			epoch /= 1000
+		}
+		// floats are only precise to about the microsecond
+		sec, frac := math.Modf(epoch)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e6))*int64(time.Microsecond)).UTC(), nil
+	}
+	return time.Time{}, errors.Errorf("timestamp '%s' is neither in format '%s', RFC 3339, nor epoch seconds or milliseconds",
+		timestamp, legacyFormat)
+}
+
 func EncodeToJsonRawMsg(data interface{}) []byte {
 	jsonString, _ := json.Marshal(data)
 	return jsonString
 }
 
+// Converts a value into its generic JSON representation (maps, slices, float64, ...),
+// which is the form event data has after being decoded from a request body.
+func ToGenericJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	err = json.Unmarshal(b, &res)
+	return res, err
+}
+
 func ProcessEventRawMessage(evt *models.UnaddedEvent) {
 	switch evt.Data.RawMessage.(type) {
 	case string:
@@ -0,0 +1,157 @@
+package eventsum
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	"github.com/ContextLogic/eventsum/log"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/wal"
+)
+
+// Opens the write-ahead log of the config. Returns nil if it is disabled.
+func openWAL(config conf.WALConfig, log *log.Logger) *wal.WAL {
+	if config.Dir == "" {
+		return nil
+	}
+	w, err := wal.Open(config.Dir, config.SegmentBytes, time.Duration(config.SyncInterval)*time.Millisecond)
+	if err != nil {
+		log.App().Fatalf("Unable to open the write-ahead log: %v", err)
+	}
+	return w
+}
+
+// Appends an event to the write-ahead log, and records the segment it was
+// appended to on the event
+func (es *eventStore) appendWAL(exc *UnaddedEvent) error {
+	record, err := json.Marshal(NewStoredEvent(*exc))
+	if err != nil {
+		return errors.Wrap(err, "encoding event for the wal")
+	}
+	exc.WALSegment, err = es.wal.Append(record)
+	return err
+}
+
+// Acknowledges the events of a batch saved, by segment, so that the segments
+// fully saved are deleted
+func (es *eventStore) ackWAL(evts []UnaddedEvent) {
+	if es.wal == nil {
+		return
+	}
+	acks := make(map[uint64]int)
+	for _, evt := range evts {
+		if evt.WALSegment != 0 {
+			acks[evt.WALSegment]++
+		}
+	}
+	for segment, n := range acks {
+		es.wal.Ack(segment, n)
+	}
+}
+
+// Saves a batch of events taken off the channel, and acknowledges them once
+// saved. The events that failed to be saved are saved again with a backoff
+// until the context is done, in which case they are kept in the wal and
+// replayed at the next start.
+func (es *eventStore) saveBatch(ctx context.Context, evts []UnaddedEvent) {
+	backoff := kafkaMinBackoff
+	for len(evts) > 0 {
+		err := es.SaveToDB(evts)
+		saved, failed := splitSaved(evts, err)
+		es.ackSaved(saved)
+		if err == nil {
+			return
+		}
+		es.log.App().Errorf("Error saving a batch, retrying %d events in %v: %v", len(failed), backoff, err)
+		evts = es.rewriteWAL(failed)
+		if !sleepContext(ctx, backoff) {
+			es.log.App().Errorf("Gave up saving %d events, kept in the wal", len(evts))
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// Acknowledges the events saved, once their periods are
+func (es *eventStore) ackSaved(evts []UnaddedEvent) {
+	if es.aggregator != nil {
+		// the periods of the batch are only saved by the next flush
+		es.aggregator.deferAcks(evts)
+		return
+	}
+	es.ackWAL(evts)
+}
+
+// Appends the events that failed to be saved to the wal again, and
+// acknowledges their previous records, so that the events saved along with
+// them are not replayed at the next start. An event that cannot be appended is
+// kept in its previous record.
+func (es *eventStore) rewriteWAL(evts []UnaddedEvent) []UnaddedEvent {
+	if es.wal == nil {
+		return evts
+	}
+	for i := range evts {
+		prev := evts[i]
+		if prev.WALSegment == 0 {
+			continue
+		}
+		if err := es.appendWAL(&evts[i]); err != nil {
+			es.log.App().Errorf("Error appending event to the wal again: %v", err)
+			evts[i] = prev
+			continue
+		}
+		es.ackWAL([]UnaddedEvent{prev})
+	}
+	return evts
+}
+
+// Saves the events of the segments left by a previous run, in batches. The
+// events of a segment are appended to the wal of this run before the segment
+// is deleted, and only saved then, so that every batch is acknowledged once
+// saved like the events captured, and the events failing to be saved are
+// retried until the context is done, then kept for the next start.
+func (es *eventStore) replayWAL(ctx context.Context) {
+	replayed := 0
+	var appended []UnaddedEvent // events of the last segment deleted, to save
+	save := func() {
+		for len(appended) > 0 {
+			n := es.channel.BatchSize
+			if n <= 0 || n > len(appended) {
+				n = len(appended)
+			}
+			es.saveBatch(ctx, appended[:n])
+			appended = appended[n:]
+		}
+	}
+	err := es.wal.Replay(func(records [][]byte) error {
+		save()
+		evts := make([]UnaddedEvent, 0, len(records))
+		for _, record := range records {
+			evt, err := DecodeStoredEvent(record)
+			if err != nil {
+				es.log.App().Errorf("Skipping undecodable wal record: %v", err)
+				continue
+			}
+			if err := es.appendWAL(&evt); err != nil {
+				// the segment is kept whole, so the events appended are not
+				es.ackWAL(evts)
+				return err
+			}
+			evts = append(evts, evt)
+		}
+		appended = evts
+		replayed += len(evts)
+		return nil
+	})
+	save()
+	if err != nil {
+		es.log.App().Errorf("Error replaying the wal, its segments are kept for the next start: %v", err)
+	}
+	if replayed > 0 {
+		es.log.App().Infof("Replayed %d events from the wal", replayed)
+	}
+}
@@ -0,0 +1,337 @@
+// Package wal keeps the events captured on local disk until they are saved,
+// so that they survive a crash of the server.
+//
+// Records are appended to the active segment file until it reaches its size
+// limit, after which a new segment is started. Every record is written with a
+// single write, so that it survives the process being killed, while fsyncs are
+// batched every sync interval. A segment is deleted once every one of its
+// records is acknowledged. Segments left by a previous run are replayed by
+// Replay.
+//
+// A record is its length and CRC-32 as two little endian uint32, followed by
+// its payload. Reading a segment stops at the first short or corrupt record,
+// e.g. the last record written before a crash.
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ContextLogic/eventsum/metrics"
+)
+
+const (
+	segmentExt = ".wal"
+	headerSize = 8
+)
+
+// Returned by Append once the WAL is closed
+var ErrClosed = errors.New("wal is closed")
+
+type segment struct {
+	seq      uint64
+	size     int64
+	appended int
+	acked    int
+	sealed   bool // no longer appended to
+}
+
+// WAL is a segmented write-ahead log
+type WAL struct {
+	sync.Mutex
+	dir          string
+	segmentBytes int64
+
+	active    *os.File
+	activeSeq uint64
+	segments  map[uint64]*segment // segments of this run, by sequence number
+	pending   []uint64            // segments left by a previous run, to replay
+	bytes     int64               // total size of the segments
+	dirty     bool                // written since the last fsync
+	closed    bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Opens the WAL of a directory, created if needed, and starts a new segment.
+// The segments already in the directory are kept for Replay.
+func Open(dir string, segmentBytes int64, syncInterval time.Duration) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "creating wal directory")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing wal segments")
+	}
+
+	w := &WAL{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		segments:     make(map[uint64]*segment),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	var last uint64
+	for _, f := range files {
+		seq, ok := parseSegmentName(f.Name())
+		if !ok || f.IsDir() {
+			continue
+		}
+		w.pending = append(w.pending, seq)
+		w.bytes += f.Size()
+		if seq > last {
+			last = seq
+		}
+	}
+	sort.Slice(w.pending, func(i, j int) bool { return w.pending[i] < w.pending[j] })
+
+	if err := w.rotate(last + 1); err != nil {
+		return nil, err
+	}
+	go w.syncLoop(syncInterval)
+	return w, nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentExt)
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+	return seq, err == nil && seq > 0
+}
+
+func (w *WAL) path(seq uint64) string {
+	return filepath.Join(w.dir, segmentName(seq))
+}
+
+// Seals the active segment, if any, and starts a new one. Must be called with
+// the lock held.
+func (w *WAL) rotate(seq uint64) error {
+	f, err := os.OpenFile(w.path(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "creating wal segment")
+	}
+	if w.active != nil {
+		w.seal()
+	}
+	w.active = f
+	w.activeSeq = seq
+	w.segments[seq] = &segment{seq: seq}
+	w.report()
+	return nil
+}
+
+// Syncs and closes the active segment, which is deleted if already acked. Must
+// be called with the lock held.
+func (w *WAL) seal() {
+	w.active.Sync()
+	w.active.Close()
+	w.active = nil
+	w.dirty = false
+
+	s := w.segments[w.activeSeq]
+	s.sealed = true
+	w.deleteIfAcked(s)
+}
+
+// Appends a record to the active segment. Returns the sequence number of the
+// segment, to acknowledge the record with.
+func (w *WAL) Append(record []byte) (uint64, error) {
+	buf := make([]byte, headerSize+len(record))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[headerSize:], record)
+
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	seq := w.activeSeq
+	s := w.segments[seq]
+	if s.size > 0 && s.size+int64(len(buf)) > w.segmentBytes {
+		if err := w.rotate(seq + 1); err != nil {
+			return 0, err
+		}
+		seq++
+		s = w.segments[seq]
+	}
+
+	n, err := w.active.Write(buf)
+	s.size += int64(n)
+	w.bytes += int64(n)
+	w.dirty = true
+	if err != nil {
+		// the segment ends with a partial record, that replays stop at
+		w.rotate(seq + 1)
+		return 0, errors.Wrap(err, "appending to wal")
+	}
+	s.appended++
+	w.report()
+	return seq, nil
+}
+
+// Acknowledges n records of a segment, once saved. The segment is deleted once
+// sealed and fully acknowledged.
+func (w *WAL) Ack(seq uint64, n int) {
+	w.Lock()
+	defer w.Unlock()
+	s, ok := w.segments[seq]
+	if !ok {
+		return
+	}
+	s.acked += n
+	w.deleteIfAcked(s)
+}
+
+// Must be called with the lock held
+func (w *WAL) deleteIfAcked(s *segment) {
+	if !s.sealed || s.acked < s.appended {
+		return
+	}
+	if err := os.Remove(w.path(s.seq)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	delete(w.segments, s.seq)
+	w.bytes -= s.size
+	w.report()
+}
+
+// Replays the segments left by a previous run, oldest first. Each segment is
+// deleted once fn returns nil for its records, and kept to be replayed again
+// otherwise. The records appended by fn are synced before the segment is
+// deleted, so that fn may append the records it has yet to process. Returns
+// the first error of fn.
+func (w *WAL) Replay(fn func(records [][]byte) error) error {
+	w.Lock()
+	pending := append([]uint64(nil), w.pending...)
+	w.Unlock()
+
+	var firstErr error
+	for _, seq := range pending {
+		path := w.path(seq)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		records, err := readSegment(path)
+		if err == nil {
+			err = fn(records)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "replaying wal segment %d", seq)
+			}
+			continue
+		}
+		w.Lock()
+		if w.dirty && w.active != nil {
+			w.active.Sync()
+			w.dirty = false
+		}
+		w.Unlock()
+		if err := os.Remove(path); err == nil {
+			w.Lock()
+			for i, p := range w.pending {
+				if p == seq {
+					w.pending = append(w.pending[:i], w.pending[i+1:]...)
+					break
+				}
+			}
+			w.bytes -= info.Size()
+			w.report()
+			w.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// Reads the records of a segment, up to the first short or corrupt record
+func readSegment(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records [][]byte
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return records, nil
+		}
+		record := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(f, record); err != nil {
+			return records, nil
+		}
+		if crc32.ChecksumIEEE(record) != binary.LittleEndian.Uint32(header[4:8]) {
+			return records, nil
+		}
+		records = append(records, record)
+	}
+}
+
+// Returns the number of segments on disk and their total size
+func (w *WAL) Stats() (int, int64) {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.segments) + len(w.pending), w.bytes
+}
+
+// Must be called with the lock held
+func (w *WAL) report() {
+	metrics.WALSegments(len(w.segments)+len(w.pending), w.bytes)
+}
+
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Lock()
+			if w.dirty && w.active != nil {
+				w.active.Sync()
+				w.dirty = false
+			}
+			w.Unlock()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// Syncs and closes the active segment. Records can still be acknowledged, so
+// that the segments fully saved are deleted.
+func (w *WAL) Close() error {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.seal()
+	w.Unlock()
+
+	close(w.quit)
+	<-w.done
+	return nil
+}
@@ -0,0 +1,131 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ContextLogic/eventsum/metrics"
+)
+
+func TestMain(m *testing.M) {
+	if err := metrics.RegisterPromMetrics("wal_test"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestAppendAck(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// room for two 10 byte records per segment
+	w, err := Open(dir, 2*(headerSize+10), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := make(map[uint64]int)
+	for i := 0; i < 5; i++ {
+		seq, err := w.Append([]byte(fmt.Sprintf("record-%03d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs[seq]++
+	}
+	if len(seqs) != 3 {
+		t.Fatalf("expected 3 segments, got %v", seqs)
+	}
+	if segments, bytes := w.Stats(); segments != 3 || bytes != 5*(headerSize+10) {
+		t.Errorf("expected 3 segments of 90 bytes, got %d of %d", segments, bytes)
+	}
+
+	// sealed segments are deleted once fully acked, the active one is kept
+	w.Ack(1, 1)
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("expected partly acked segments to be kept, got %v", files)
+	}
+	w.Ack(1, 1)
+	w.Ack(3, 1)
+	if files := segmentFiles(t, dir); len(files) != 2 {
+		t.Errorf("expected 2 segments left, got %v", files)
+	}
+
+	w.Close()
+	if _, err := w.Append([]byte("late")); err != ErrClosed {
+		t.Errorf("expected appends to fail once closed, got %v", err)
+	}
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected the acked active segment to be deleted once closed, got %v", files)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := Open(dir, 1<<20, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append([]byte("first"))
+	w.Append([]byte("second"))
+	w.Close()
+
+	// a record cut short by a crash
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{20, 0, 0, 0, 1, 2})
+	f.Close()
+
+	w, err = Open(dir, 1<<20, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.Replay(func(records [][]byte) error { return fmt.Errorf("db is down") }); err == nil {
+		t.Errorf("expected the replay error")
+	}
+	if files := segmentFiles(t, dir); len(files) != 2 {
+		t.Errorf("expected the segment to be kept after a failed replay, got %v", files)
+	}
+
+	var replayed []string
+	err = w.Replay(func(records [][]byte) error {
+		for _, record := range records {
+			replayed = append(replayed, string(record))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("expected %v, got %v", expected, replayed)
+	}
+	if segments, _ := w.Stats(); segments != 1 {
+		t.Errorf("expected only the new segment to be left, got %d", segments)
+	}
+}
@@ -0,0 +1,272 @@
+package eventsum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/ContextLogic/eventsum/config"
+	. "github.com/ContextLogic/eventsum/models"
+	"github.com/ContextLogic/eventsum/rules"
+	"github.com/ContextLogic/eventsum/scrubber"
+	"github.com/ContextLogic/eventsum/truncate"
+	"github.com/ContextLogic/eventsum/wal"
+)
+
+// The segments of the wal hold a single event
+func newWALEventStore(t *testing.T, dir string) (*eventStore, periodDataStore) {
+	w, err := wal.Open(dir, 1, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := periodDataStore{periods: map[int]EventInstancePeriod{}}
+	es := newTestEventStore(5)
+	es.ds = ds
+	es.log = newTestLogger(t)
+	es.dropEvent = DropEventThrottle{Prob: 100}
+	es.timeFormat = conf.DefaultConfig().TimeFormat
+	es.timeInterval = conf.DefaultConfig().TimeInterval
+	es.wal = w
+	return es, ds
+}
+
+func TestWALSendAndReplay(t *testing.T) {
+	globalRule = rules.NewRule()
+	dir, err := ioutil.TempDir("", "eventsum-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	event := func(message string) UnaddedEvent {
+		return UnaddedEvent{
+			Service:     "wish_be",
+			Environment: "prod",
+			Name:        "KeyError",
+			Type:        "python",
+			Data:        EventData{Message: message, Raw: message},
+			Timestamp:   "2020-01-26 00:53:20",
+		}
+	}
+
+	// a saved batch is acknowledged, the other one is left for the next start
+	es, _ := newWALEventStore(t, dir)
+	for _, message := range []string{"a", "a", "bb"} {
+		if err := es.Send(event(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := []UnaddedEvent{<-es.channel.queue, <-es.channel.queue}
+	if saved[0].WALSegment == 0 {
+		t.Fatalf("expected events to be appended to the wal")
+	}
+	es.saveBatch(context.Background(), saved)
+	es.wal.Close()
+
+	es, ds := newWALEventStore(t, dir)
+	defer es.wal.Close()
+	es.replayWAL(context.Background())
+	if p, ok := ds.periods[2]; !ok || p.Count != 1 {
+		t.Errorf("expected the unsaved event to be replayed, got %+v", ds.periods)
+	}
+	if _, ok := ds.periods[1]; ok {
+		t.Errorf("expected the saved events not to be replayed")
+	}
+	if segments, _ := es.wal.Stats(); segments != 1 {
+		t.Errorf("expected the replayed segment to be deleted, got %d segments", segments)
+	}
+}
+
+// flakyDataStore fails to find the instances of the events whose message is
+// down, until up
+type flakyDataStore struct {
+	periodDataStore
+	down string
+	up   chan struct{}
+}
+
+func (f flakyDataStore) FindEventInstanceId(evt EventInstance) (int64, error) {
+	if evt.RawData.Message == f.down {
+		select {
+		case <-f.up:
+		default:
+			return 0, errors.New("database is down")
+		}
+	}
+	return f.periodDataStore.FindEventInstanceId(evt)
+}
+
+func TestSaveBatchRetriesFailedEvents(t *testing.T) {
+	globalRule = rules.NewRule()
+	dir, err := ioutil.TempDir("", "eventsum-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	event := func(message string) UnaddedEvent {
+		return UnaddedEvent{
+			Service:     "wish_be",
+			Environment: "prod",
+			Name:        "KeyError",
+			Type:        "python",
+			Data:        EventData{Message: message, Raw: message},
+			Timestamp:   "2020-01-26 00:53:20",
+		}
+	}
+
+	es, ds := newWALEventStore(t, dir)
+	flaky := flakyDataStore{periodDataStore: ds, down: "bb", up: make(chan struct{})}
+	es.ds = flaky
+	for _, message := range []string{"a", "bb"} {
+		if err := es.Send(event(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := []UnaddedEvent{<-es.channel.queue, <-es.channel.queue}
+
+	saved, failed := splitSaved(batch, es.SaveToDB(batch))
+	if len(saved) != 1 || len(failed) != 1 || failed[0].Data.Message != "bb" {
+		t.Fatalf("expected only the event failing to be reported, got %+v", failed)
+	}
+
+	// only the failed event is retried, and it is the only one left in the wal
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	es.saveBatch(ctx, batch)
+	es.wal.Close()
+
+	es, ds = newWALEventStore(t, dir)
+	defer es.wal.Close()
+	close(flaky.up)
+	es.ds = flakyDataStore{periodDataStore: ds, down: "bb", up: flaky.up}
+	es.replayWAL(context.Background())
+	if _, ok := ds.periods[1]; ok {
+		t.Errorf("expected the saved event not to be replayed")
+	}
+	if ds.periods[2].Count != 1 {
+		t.Errorf("expected the failed event to be replayed, got %+v", ds.periods)
+	}
+}
+
+func TestReplayKeepsOnlyFailedEvents(t *testing.T) {
+	globalRule = rules.NewRule()
+	dir, err := ioutil.TempDir("", "eventsum-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// both events in a single segment
+	es, _ := newWALEventStore(t, dir)
+	es.wal.Close()
+	if es.wal, err = wal.Open(dir, 1<<20, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"a", "bb"} {
+		evt := UnaddedEvent{Service: "wish_be", Environment: "prod", Name: "KeyError", Type: "python",
+			Data: EventData{Message: message, Raw: message}, Timestamp: "2020-01-26 00:53:20"}
+		if err := es.Send(evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	es.wal.Close()
+
+	// the second batch of the replay fails until the context is done
+	es, ds := newWALEventStore(t, dir)
+	es.channel.BatchSize = 1
+	es.ds = flakyDataStore{periodDataStore: ds, down: "bb", up: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	es.replayWAL(ctx)
+	es.wal.Close()
+	if _, ok := ds.periods[1]; !ok {
+		t.Fatalf("expected the first batch to be saved, got %+v", ds.periods)
+	}
+
+	// only the failed event is replayed at the next start
+	es, ds = newWALEventStore(t, dir)
+	defer es.wal.Close()
+	es.replayWAL(context.Background())
+	if _, ok := ds.periods[1]; ok {
+		t.Errorf("expected the saved batch not to be replayed again")
+	}
+	if ds.periods[2].Count != 1 {
+		t.Errorf("expected the failed event to be replayed, got %+v", ds.periods)
+	}
+	if segments, _ := es.wal.Stats(); segments != 1 {
+		t.Errorf("expected only the new segment to be left, got %d", segments)
+	}
+}
+
+func TestDecodeStoredEvent(t *testing.T) {
+	evt := UnaddedEvent{Name: "KeyError", ReceivedAt: "2020-01-26T00:53:20Z", SampleWeight: 4}
+	record, err := json.Marshal(NewStoredEvent(evt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{
+		"stored": record,
+		"legacy": []byte(`{"event_name":"KeyError","received_at":"2020-01-26T00:53:20Z","sample_weight":4}`),
+	} {
+		decoded, err := DecodeStoredEvent(b)
+		if err != nil || decoded.Name != "KeyError" || decoded.ReceivedAt != evt.ReceivedAt || decoded.SampleWeight != 4 {
+			t.Errorf("%s: expected the fields set by the server to be kept, got %+v, %v", name, decoded, err)
+		}
+	}
+}
+
+func TestWALRecordsScrubbedAndTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eventsum-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es, _ := newWALEventStore(t, dir)
+	scrub := conf.DefaultConfig().Scrub
+	scrub.Enabled = true
+	if es.scrubber, err = scrubber.New(scrub); err != nil {
+		t.Fatal(err)
+	}
+	es.truncator = truncate.New(conf.LimitsConfig{StringLength: 40})
+	h := newHTTPHandler(es, es.log, conf.DefaultConfig())
+
+	body := `{"service":"wish_be","environment":"prod","event_name":"KeyError","event_type":"python","timestamp":"2020-01-26 00:53:20",
+		"event_data":{"message":"no account for jane@example.com"},"extra_args":{"query":"` + strings.Repeat("x", 100) + `"}}`
+	w := httptest.NewRecorder()
+	h.captureEventsHandler(w, httptest.NewRequest("POST", "/capture", strings.NewReader(body)), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+
+	// the event is scrubbed and truncated before being appended to the wal
+	es.wal.Close()
+	replayed, err := wal.Open(dir, 1, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	var records [][]byte
+	replayed.Replay(func(r [][]byte) error {
+		records = append(records, r...)
+		return errors.New("kept")
+	})
+	if len(records) != 1 || strings.Contains(string(records[0]), "jane@example.com") {
+		t.Fatalf("expected a scrubbed wal record, got %q", records)
+	}
+	if evt, err := DecodeStoredEvent(records[0]); err != nil || fmt.Sprint(evt.Scrubbed) != "[email]" {
+		t.Errorf("expected the scrub rules to be kept, got %+v, %v", evt, err)
+	}
+	if strings.Contains(string(records[0]), strings.Repeat("x", 41)) {
+		t.Errorf("expected a truncated wal record, got %q", records[0])
+	}
+}